@@ -0,0 +1,501 @@
+package caddy_waf_t1k
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(AdminAPI{})
+}
+
+// Admin overrides of an engine's availability.
+const (
+	// adminAuto leaves availability to health checks and the circuit breaker.
+	adminAuto int32 = iota
+	// adminDrain takes the engine out of rotation for maintenance, letting
+	// its in-flight detections finish.
+	adminDrain
+	// adminDown marks the engine down, regardless of health checks.
+	adminDown
+	// adminUp marks the engine up, regardless of health checks, failures
+	// and its circuit breaker.
+	adminUp
+)
+
+var adminStateNames = []string{"auto", "drain", "down", "up"}
+
+// runningGroups holds the started engine groups, for the admin API.
+var runningGroups = struct {
+	sync.Mutex
+	groups map[*engineGroup]struct{}
+}{groups: make(map[*engineGroup]struct{})}
+
+func registerEngineGroup(g *engineGroup) {
+	runningGroups.Lock()
+	defer runningGroups.Unlock()
+	runningGroups.groups[g] = struct{}{}
+}
+
+func unregisterEngineGroup(g *engineGroup) {
+	runningGroups.Lock()
+	defer runningGroups.Unlock()
+	delete(runningGroups.groups, g)
+}
+
+// AdminAPI is a module that serves the engines and modes of all
+// waf_chaitin instances on the admin API:
+//
+//	GET  /waf_chaitin/engines[?instance=<id>]
+//	POST /waf_chaitin/engines {"instance": "<id>", "engine": "<addr>", "action": "<action>"}
+//	GET  /waf_chaitin/mode
+//	POST /waf_chaitin/mode {"name": "<name>", "mode": "<mode>", "reason": "<text>"}
+//
+// The instance of a shared engine group is "group:<name>", that of a
+// handler's own engines "inline:<number>". Engine actions are drain (stop
+// new detections; the engine reports drained once its in-flight detections
+// finish), down, up, auto (undo drain, down or up) and reset (clear failure
+// counts and close the circuit). Modes are block, monitor, bypass and config
+// (undo the override); they are switched by handler name, which persists
+// across config reloads. A POST without instance or name applies to all
+// instances or handlers.
+type AdminAPI struct {
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.waf_chaitin",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Provision sets up the module.
+func (a *AdminAPI) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger()
+	return nil
+}
+
+// Routes returns the admin routes of the module.
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/waf_chaitin/engines", Handler: caddy.AdminHandlerFunc(a.handleEngines)},
+		{Pattern: "/waf_chaitin/mode", Handler: caddy.AdminHandlerFunc(a.handleMode)},
+		{Pattern: "/waf_chaitin/bans", Handler: caddy.AdminHandlerFunc(a.handleBans)},
+	}
+}
+
+// instanceStatus is the admin API view of an engine group.
+type instanceStatus struct {
+	Instance string         `json:"instance"`
+	Engines  []engineStatus `json:"engines"`
+}
+
+// engineStatus is the admin API view of an engine.
+type engineStatus struct {
+	Addr      string     `json:"addr"`
+	Backup    bool       `json:"backup,omitempty"`
+	Weight    int        `json:"weight"`
+	Fails     int        `json:"fails"`
+	Available bool       `json:"available"`
+	Healthy   bool       `json:"healthy"` // last active health check result
+	Circuit   string     `json:"circuit,omitempty"`
+	Admin     string     `json:"admin"`
+	InFlight  int64      `json:"in_flight"`
+	Drained   bool       `json:"drained,omitempty"` // drained with no detections in flight
+	Pool      poolStatus `json:"pool"`
+}
+
+// poolStatus is the admin API view of an engine's t1k.PoolStats.
+type poolStatus struct {
+	IdleConns     int    `json:"idle_conns"`
+	ActiveConns   int    `json:"active_conns"`
+	MaxActive     int    `json:"max_active"`
+	WaitingReqs   int    `json:"waiting_requests"`
+	DialFailed    uint64 `json:"dial_failed"`
+	IdleExpired   uint64 `json:"idle_expired"`
+	PingFailed    uint64 `json:"ping_failed"`
+	PoolFullClose uint64 `json:"pool_full_close"`
+	MaxActiveHit  uint64 `json:"max_active_hit"`
+}
+
+func newEngineStatus(e *Engine) engineStatus {
+	stats := e.poolStats()
+	status := engineStatus{
+		Addr:      e.addr,
+		Backup:    e.backup,
+		Weight:    e.Weight(),
+		Fails:     e.Fails(),
+		Available: e.Available(),
+		Healthy:   !e.healthDown.Load(),
+		Admin:     adminStateNames[e.admin.Load()],
+		InFlight:  e.inFlight.Load(),
+		Drained:   e.drained(),
+		Pool: poolStatus{
+			IdleConns:     int(stats.IdleConns),
+			ActiveConns:   int(stats.ActiveConns),
+			MaxActive:     int(stats.MaxActive),
+			WaitingReqs:   int(stats.WaitingReqs),
+			DialFailed:    stats.DialFailed,
+			IdleExpired:   stats.IdleExpired,
+			PingFailed:    stats.PingFailed,
+			PoolFullClose: stats.PoolFullClose,
+			MaxActiveHit:  stats.MaxActiveHit,
+		},
+	}
+	if e.breaker != nil {
+		status.Circuit = e.breaker.currentState().String()
+	}
+	return status
+}
+
+// engineAction is the body of a POST to /waf_chaitin/engines.
+type engineAction struct {
+	Instance string `json:"instance,omitempty"`
+	Engine   string `json:"engine"`
+	Action   string `json:"action"`
+}
+
+func (a *AdminAPI) handleEngines(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, engineInstances(r.URL.Query().Get("instance"), ""))
+	case http.MethodPost:
+		var action engineAction
+		if err := json.NewDecoder(r.Body).Decode(&action); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("decoding request: %v", err)}
+		}
+		apply, ok := engineActions[action.Action]
+		if !ok {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("unknown action %q, expected one of %s", action.Action, strings.Join(slices.Sorted(maps.Keys(engineActions)), ", "))}
+		}
+		if action.Engine == "" {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("missing engine")}
+		}
+		var applied int
+		for _, e := range matchEngines(action.Instance, action.Engine) {
+			apply(e)
+			applied++
+		}
+		if applied == 0 {
+			return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("engine %q not found", action.Engine)}
+		}
+		if a.logger != nil {
+			a.logger.Info("WAF engine admin action",
+				zap.String("action", action.Action),
+				zap.String("engine", action.Engine),
+				zap.String("instance", action.Instance),
+				zap.Int("engines", applied))
+		}
+		return writeJSON(w, engineInstances(action.Instance, action.Engine))
+	default:
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method %s not allowed", r.Method)}
+	}
+}
+
+// engineActions maps the admin API actions to what they do to an engine.
+var engineActions = map[string]func(*Engine){
+	"drain": func(e *Engine) { e.admin.Store(adminDrain) },
+	"down":  func(e *Engine) { e.admin.Store(adminDown) },
+	"up":    func(e *Engine) { e.admin.Store(adminUp) },
+	"auto":  func(e *Engine) { e.admin.Store(adminAuto) },
+	"reset": (*Engine).resetFailures,
+}
+
+// sortedGroups returns the running engine groups ordered by instance.
+func sortedGroups() []*engineGroup {
+	runningGroups.Lock()
+	groups := make([]*engineGroup, 0, len(runningGroups.groups))
+	for g := range runningGroups.groups {
+		groups = append(groups, g)
+	}
+	runningGroups.Unlock()
+	slices.SortFunc(groups, func(a, b *engineGroup) int { return strings.Compare(a.instanceID, b.instanceID) })
+	return groups
+}
+
+// matchEngines returns the engines with address addr of the given instance,
+// or of all instances if instance is empty.
+func matchEngines(instance, addr string) []*Engine {
+	var out []*Engine
+	for _, g := range sortedGroups() {
+		if instance != "" && g.instanceID != instance {
+			continue
+		}
+		for _, e := range g.current() {
+			if e.addr == addr {
+				out = append(out, e)
+			}
+		}
+	}
+	return out
+}
+
+// engineInstances returns the status of the engines of the given instance
+// and address, or of all of them if empty.
+func engineInstances(instance, addr string) []instanceStatus {
+	out := []instanceStatus{}
+	for _, g := range sortedGroups() {
+		if instance != "" && g.instanceID != instance {
+			continue
+		}
+		status := instanceStatus{Instance: g.instanceID, Engines: []engineStatus{}}
+		for _, e := range g.current() {
+			if addr == "" || e.addr == addr {
+				status.Engines = append(status.Engines, newEngineStatus(e))
+			}
+		}
+		if addr != "" && len(status.Engines) == 0 {
+			continue
+		}
+		out = append(out, status)
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// modeConfig is the mode override value that restores the configured mode.
+const modeConfig = "config"
+
+// modeOverrideSet is an immutable snapshot of the admin API mode overrides.
+type modeOverrideSet struct {
+	all   string            // override of all handlers, if set
+	names map[string]string // overrides per handler name
+}
+
+// modeOverrides holds the current overrides. Requests read it without
+// locking; modeOverridesMu serializes writers.
+var (
+	modeOverrides   atomic.Pointer[modeOverrideSet]
+	modeOverridesMu sync.Mutex
+)
+
+// currentMode returns the mode requests are handled in: the admin API
+// override of the handler's name or of all handlers, else the configured
+// Mode.
+func (m *CaddyWAF) currentMode() string {
+	if o := modeOverrides.Load(); o != nil {
+		if mode, ok := o.names[m.Name]; ok && m.Name != "" {
+			return mode
+		}
+		if o.all != "" {
+			return o.all
+		}
+	}
+	return m.Mode
+}
+
+// setModeOverride overrides the mode of the handlers named name, or of all
+// handlers if empty, and returns the previous override. modeConfig removes
+// the override. An override of all handlers replaces those of names.
+// Overrides are kept when handlers are unloaded, so they apply again to the
+// handlers of the same name after a config reload.
+func setModeOverride(name, mode string) (previous string) {
+	modeOverridesMu.Lock()
+	defer modeOverridesMu.Unlock()
+	next := &modeOverrideSet{names: make(map[string]string)}
+	if o := modeOverrides.Load(); o != nil {
+		next.all = o.all
+		if name != "" {
+			maps.Copy(next.names, o.names)
+		}
+		previous = o.all
+		if p, ok := o.names[name]; ok && name != "" {
+			previous = p
+		}
+	}
+	if mode == modeConfig {
+		mode = ""
+	}
+	switch {
+	case name == "":
+		next.all = mode
+	case mode == "":
+		delete(next.names, name)
+	default:
+		next.names[name] = mode
+	}
+	modeOverrides.Store(next)
+	if previous == "" {
+		previous = modeConfig
+	}
+	return previous
+}
+
+// runningHandlers holds the provisioned waf_chaitin handlers, for the admin
+// API.
+var runningHandlers = struct {
+	sync.Mutex
+	handlers map[*CaddyWAF]struct{}
+}{handlers: make(map[*CaddyWAF]struct{})}
+
+func registerHandler(m *CaddyWAF) {
+	runningHandlers.Lock()
+	defer runningHandlers.Unlock()
+	runningHandlers.handlers[m] = struct{}{}
+}
+
+func unregisterHandler(m *CaddyWAF) {
+	runningHandlers.Lock()
+	defer runningHandlers.Unlock()
+	delete(runningHandlers.handlers, m)
+}
+
+// handlerMode is the admin API view of a handler's mode.
+type handlerMode struct {
+	Name       string `json:"name,omitempty"`
+	Instance   string `json:"instance"`
+	Configured string `json:"configured"`
+	Mode       string `json:"mode"`
+}
+
+// modeChange is the body of a POST to /waf_chaitin/mode.
+type modeChange struct {
+	Name   string `json:"name,omitempty"`
+	Mode   string `json:"mode"`
+	Reason string `json:"reason,omitempty"`
+	// Instance is rejected: instance IDs of inline engines change on
+	// reload and those of engine groups are shared by their handlers.
+	Instance string `json:"instance,omitempty"`
+}
+
+func (a *AdminAPI) handleMode(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, handlerModes(""))
+	case http.MethodPost:
+		var change modeChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("decoding request: %v", err)}
+		}
+		switch change.Mode {
+		case modeBlock, modeMonitor, modeBypass, modeConfig:
+		default:
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("unknown mode %q, expected %s, %s, %s or %s", change.Mode, modeBlock, modeMonitor, modeBypass, modeConfig)}
+		}
+		if change.Instance != "" {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("modes are switched by handler name, not instance")}
+		}
+		if change.Name != "" && len(handlerModes(change.Name)) == 0 {
+			return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("handler %q not found", change.Name)}
+		}
+		previous := setModeOverride(change.Name, change.Mode)
+		if a.logger != nil {
+			name := change.Name
+			if name == "" {
+				name = "*"
+			}
+			a.logger.Warn("WAF mode changed",
+				zap.String("name", name),
+				zap.String("from", previous),
+				zap.String("to", change.Mode),
+				zap.String("reason", change.Reason),
+				zap.String("remote_addr", r.RemoteAddr),
+				zap.String("user_agent", r.UserAgent()))
+		}
+		return writeJSON(w, handlerModes(change.Name))
+	default:
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method %s not allowed", r.Method)}
+	}
+}
+
+// handlerModes returns the modes of the handlers named name, or of all
+// handlers if empty, ordered by name and instance.
+func handlerModes(name string) []handlerMode {
+	out := []handlerMode{}
+	for _, m := range handlers("") {
+		if name == "" || m.Name == name {
+			out = append(out, handlerMode{Name: m.Name, Instance: m.instanceID, Configured: m.Mode, Mode: m.currentMode()})
+		}
+	}
+	slices.SortFunc(out, func(a, b handlerMode) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Instance, b.Instance); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Configured, b.Configured)
+	})
+	return out
+}
+
+// handleBans lists the banned clients on GET, and lifts a ban on DELETE with
+// the key and optional instance as query parameters.
+func (a *AdminAPI) handleBans(w http.ResponseWriter, r *http.Request) error {
+	instance := r.URL.Query().Get("instance")
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, bans(instance))
+	case http.MethodDelete:
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("key is required")}
+		}
+		var lifted bool
+		for _, m := range handlers(instance) {
+			if m.bans != nil && m.bans.unban(r.Context(), key) {
+				lifted = true
+			}
+		}
+		if !lifted {
+			return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("no ban of %q found", key)}
+		}
+		if a.logger != nil {
+			a.logger.Info("WAF ban lifted",
+				zap.String("key", key),
+				zap.String("instance", instance),
+				zap.String("remote_addr", r.RemoteAddr))
+		}
+		return writeJSON(w, bans(instance))
+	default:
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method %s not allowed", r.Method)}
+	}
+}
+
+// bans returns the bans of the handlers of instance, or of all handlers if
+// empty, ordered by instance and key.
+func bans(instance string) []banStatus {
+	out := []banStatus{}
+	for _, m := range handlers(instance) {
+		if m.bans != nil {
+			out = append(out, m.bans.list()...)
+		}
+	}
+	slices.SortStableFunc(out, func(a, b banStatus) int { return strings.Compare(a.Instance, b.Instance) })
+	return out
+}
+
+// handlers returns the running handlers of instance, or all of them if
+// empty.
+func handlers(instance string) []*CaddyWAF {
+	runningHandlers.Lock()
+	defer runningHandlers.Unlock()
+	var out []*CaddyWAF
+	for m := range runningHandlers.handlers {
+		if instance == "" || m.instanceID == instance {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+	_ caddy.Provisioner = (*AdminAPI)(nil)
+)
@@ -0,0 +1,389 @@
+package caddy_waf_t1k
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/chaitin/t1k-go"
+	"github.com/chaitin/t1k-go/detection"
+	"go.uber.org/zap"
+)
+
+func newAdminTestGroup(t *testing.T, instance string, engines ...*Engine) *engineGroup {
+	t.Helper()
+	g := newEngineGroup(context.Background(), &EngineGroup{}, instance, zap.NewNop())
+	g.engines = engines
+	registerEngineGroup(g)
+	t.Cleanup(func() { unregisterEngineGroup(g) })
+	return g
+}
+
+func adminRequest(t *testing.T, a *AdminAPI, method, target, body string) ([]instanceStatus, error) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	err := a.handleEngines(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if err != nil {
+		return nil, err
+	}
+	var out []instanceStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+	}
+	return out, nil
+}
+
+func TestAdminAPIListsEngines(t *testing.T) {
+	stats := func() t1k.PoolStats { return t1k.PoolStats{IdleConns: 2, ActiveConns: 3, MaxActive: 32, DialFailed: 4} }
+	e1 := &Engine{addr: "192.0.2.1:8000", weight: 3, statsFn: stats}
+	e2 := &Engine{addr: "127.0.0.1:8000", backup: true, maxFails: 1, statsFn: stats,
+		breaker: newCircuitBreaker(CircuitBreaker{ConsecutiveFailures: 1}, nil)}
+	addFailures(e2, 1)
+	e2.breaker.record(true)
+	newAdminTestGroup(t, "admin-b", e2)
+	newAdminTestGroup(t, "admin-a", e1)
+
+	a := new(AdminAPI)
+	got, err := adminRequest(t, a, http.MethodGet, "/waf_chaitin/engines", "")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	byInstance := make(map[string][]engineStatus)
+	for i, status := range got {
+		if i > 0 && got[i-1].Instance > status.Instance {
+			t.Errorf("instances not ordered: %s before %s", got[i-1].Instance, status.Instance)
+		}
+		byInstance[status.Instance] = status.Engines
+	}
+	if len(byInstance["admin-a"]) != 1 || len(byInstance["admin-b"]) != 1 {
+		t.Fatalf("instances = %+v, want admin-a and admin-b with one engine each", got)
+	}
+	want := engineStatus{
+		Addr: "192.0.2.1:8000", Weight: 3, Available: true, Healthy: true, Admin: "auto",
+		Pool: poolStatus{IdleConns: 2, ActiveConns: 3, MaxActive: 32, DialFailed: 4},
+	}
+	if byInstance["admin-a"][0] != want {
+		t.Errorf("engine = %+v, want %+v", byInstance["admin-a"][0], want)
+	}
+	if e := byInstance["admin-b"][0]; !e.Backup || e.Fails != 1 || e.Available || e.Circuit != "open" {
+		t.Errorf("engine = %+v, want an unavailable backup with 1 fail and an open circuit", e)
+	}
+
+	got, err = adminRequest(t, a, http.MethodGet, "/waf_chaitin/engines?instance=admin-b", "")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if len(got) != 1 || got[0].Instance != "admin-b" {
+		t.Errorf("filtered instances = %+v, want admin-b only", got)
+	}
+}
+
+func TestAdminAPIActions(t *testing.T) {
+	e := &Engine{addr: "192.0.2.1:8000", maxFails: 1, statsFn: func() t1k.PoolStats { return t1k.PoolStats{} }}
+	other := &Engine{addr: "192.0.2.1:8000", statsFn: e.statsFn}
+	newAdminTestGroup(t, "admin-actions", e)
+	newAdminTestGroup(t, "admin-other", other)
+	a := new(AdminAPI)
+	post := func(body string) []instanceStatus {
+		t.Helper()
+		got, err := adminRequest(t, a, http.MethodPost, "/waf_chaitin/engines", body)
+		if err != nil {
+			t.Fatalf("POST %s: %v", body, err)
+		}
+		return got
+	}
+
+	got := post(`{"instance": "admin-actions", "engine": "192.0.2.1:8000", "action": "drain"}`)
+	if e.Available() || !other.Available() {
+		t.Fatal("drain did not take only the instance's engine out of rotation")
+	}
+	if len(got) != 1 || got[0].Engines[0].Admin != "drain" {
+		t.Errorf("response = %+v, want the drained engine", got)
+	}
+
+	e.healthDown.Store(true)
+	addFailures(e, 1)
+	post(`{"instance": "admin-actions", "engine": "192.0.2.1:8000", "action": "up"}`)
+	if !e.Available() || !e.allow() {
+		t.Fatal("forced up engine is unavailable")
+	}
+	post(`{"instance": "admin-actions", "engine": "192.0.2.1:8000", "action": "auto"}`)
+	if e.Available() {
+		t.Fatal("auto did not return the engine to its health checks")
+	}
+	post(`{"instance": "admin-actions", "engine": "192.0.2.1:8000", "action": "reset"}`)
+	if e.Fails() != 0 {
+		t.Errorf("Fails() = %d after reset, want 0", e.Fails())
+	}
+
+	// Without an instance, the action applies to all of them.
+	if got := post(`{"engine": "192.0.2.1:8000", "action": "down"}`); len(got) < 2 {
+		t.Errorf("response = %+v, want both instances", got)
+	}
+	if other.Available() {
+		t.Error("down did not apply to all instances")
+	}
+
+	for _, tt := range []struct {
+		method, body string
+		status       int
+	}{
+		{http.MethodPost, `{"engine": "192.0.2.1:8000", "action": "explode"}`, http.StatusBadRequest},
+		{http.MethodPost, `{"action": "drain"}`, http.StatusBadRequest},
+		{http.MethodPost, `not json`, http.StatusBadRequest},
+		{http.MethodPost, `{"engine": "192.0.2.77:8000", "action": "drain"}`, http.StatusNotFound},
+		{http.MethodDelete, ``, http.StatusMethodNotAllowed},
+	} {
+		_, err := adminRequest(t, a, tt.method, "/waf_chaitin/engines", tt.body)
+		var apiErr caddy.APIError
+		if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.status {
+			t.Errorf("%s %s: error = %v, want status %d", tt.method, tt.body, err, tt.status)
+		}
+	}
+}
+
+func TestAdminAPIDrainWaitsForInFlightDetections(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	e := &Engine{addr: "192.0.2.1:8000", statsFn: func() t1k.PoolStats { return t1k.PoolStats{} },
+		detectFn: func(*http.Request) (*detection.Result, error) {
+			close(started)
+			<-release
+			return &detection.Result{Head: '.'}, nil
+		}}
+	newAdminTestGroup(t, "admin-drain", e)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = e.DetectHttpRequest(httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	<-started
+
+	a := new(AdminAPI)
+	got, err := adminRequest(t, a, http.MethodPost, "/waf_chaitin/engines", `{"instance": "admin-drain", "engine": "192.0.2.1:8000", "action": "drain"}`)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	if s := got[0].Engines[0]; s.Available || s.InFlight != 1 || s.Drained {
+		t.Errorf("engine = %+v, want an unavailable engine with 1 detection in flight", s)
+	}
+
+	close(release)
+	<-done
+	got, err = adminRequest(t, a, http.MethodGet, "/waf_chaitin/engines?instance=admin-drain", "")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if s := got[0].Engines[0]; s.InFlight != 0 || !s.Drained {
+		t.Errorf("engine = %+v, want a drained engine", s)
+	}
+}
+
+func TestEngineGroupDestructUnregisters(t *testing.T) {
+	g := newTestEngineGroup()
+	registerEngineGroup(g)
+	g.Destruct()
+	runningGroups.Lock()
+	_, ok := runningGroups.groups[g]
+	runningGroups.Unlock()
+	if ok {
+		t.Error("destructed group is still registered")
+	}
+}
+
+func TestSetModeOverride(t *testing.T) {
+	t.Cleanup(func() { modeOverrides.Store(nil) })
+	a := &CaddyWAF{Mode: modeBlock, Name: "a"}
+	b := &CaddyWAF{Mode: modeMonitor, Name: "b"}
+
+	if prev := setModeOverride("a", modeBypass); prev != modeConfig {
+		t.Errorf("previous = %q, want %q", prev, modeConfig)
+	}
+	if a.currentMode() != modeBypass || b.currentMode() != modeMonitor {
+		t.Errorf("modes = %s, %s; want bypass, monitor", a.currentMode(), b.currentMode())
+	}
+	if prev := setModeOverride("", modeMonitor); prev != modeConfig {
+		t.Errorf("previous = %q, want %q", prev, modeConfig)
+	}
+	// Overriding all handlers replaces the override of a.
+	if a.currentMode() != modeMonitor || b.currentMode() != modeMonitor {
+		t.Errorf("modes = %s, %s; want monitor, monitor", a.currentMode(), b.currentMode())
+	}
+	setModeOverride("b", modeBlock)
+	if prev := setModeOverride("b", modeConfig); prev != modeBlock {
+		t.Errorf("previous = %q, want %q", prev, modeBlock)
+	}
+	if b.currentMode() != modeMonitor {
+		t.Errorf("mode = %s after clearing the name override, want the override of all", b.currentMode())
+	}
+	setModeOverride("", modeConfig)
+	if a.currentMode() != modeBlock || b.currentMode() != modeMonitor {
+		t.Errorf("modes = %s, %s; want the configured block, monitor", a.currentMode(), b.currentMode())
+	}
+}
+
+func TestAdminAPIMode(t *testing.T) {
+	t.Cleanup(func() { modeOverrides.Store(nil) })
+	// h1 and h2 share an engine group, but only h1 is named mode-a.
+	h1 := &CaddyWAF{Mode: modeBlock, Name: "mode-a", instanceID: "group:mode"}
+	h2 := &CaddyWAF{Mode: modeMonitor, Name: "mode-b", instanceID: "group:mode"}
+	h3 := &CaddyWAF{Mode: modeBlock, Name: "mode-a", instanceID: "inline:1"}
+	h4 := &CaddyWAF{Mode: modeBlock, instanceID: "inline:2"}
+	for _, h := range []*CaddyWAF{h1, h2, h3, h4} {
+		registerHandler(h)
+		t.Cleanup(func() { unregisterHandler(h) })
+	}
+	a := &AdminAPI{logger: zap.NewNop()}
+	request := func(method, body string) ([]handlerMode, error) {
+		rec := httptest.NewRecorder()
+		if err := a.handleMode(rec, httptest.NewRequest(method, "/waf_chaitin/mode", strings.NewReader(body))); err != nil {
+			return nil, err
+		}
+		var out []handlerMode
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+			t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+		}
+		return out, nil
+	}
+
+	got, err := request(http.MethodPost, `{"name": "mode-a", "mode": "bypass", "reason": "false positives"}`)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	want := []handlerMode{
+		{Name: "mode-a", Instance: "group:mode", Configured: modeBlock, Mode: modeBypass},
+		{Name: "mode-a", Instance: "inline:1", Configured: modeBlock, Mode: modeBypass},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("response = %+v, want %+v", got, want)
+	}
+	if h2.currentMode() != modeMonitor || h4.currentMode() != modeBlock {
+		t.Error("override of mode-a applied to other handlers")
+	}
+
+	got, err = request(http.MethodGet, "")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if !slices.Contains(got, handlerMode{Name: "mode-b", Instance: "group:mode", Configured: modeMonitor, Mode: modeMonitor}) ||
+		!slices.Contains(got, handlerMode{Instance: "inline:2", Configured: modeBlock, Mode: modeBlock}) {
+		t.Errorf("GET = %+v, want mode-b in monitor mode and the unnamed handler in block mode", got)
+	}
+
+	if _, err := request(http.MethodPost, `{"mode": "monitor"}`); err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	if h1.currentMode() != modeMonitor || h4.currentMode() != modeMonitor {
+		t.Error("override of all handlers did not apply")
+	}
+
+	for _, tt := range []struct {
+		method, body string
+		status       int
+	}{
+		{http.MethodPost, `{"mode": "observe"}`, http.StatusBadRequest},
+		{http.MethodPost, `{`, http.StatusBadRequest},
+		{http.MethodPost, `{"instance": "group:mode", "mode": "block"}`, http.StatusBadRequest},
+		{http.MethodPost, `{"name": "mode-zzz", "mode": "block"}`, http.StatusNotFound},
+		{http.MethodPut, ``, http.StatusMethodNotAllowed},
+	} {
+		_, err := request(tt.method, tt.body)
+		var apiErr caddy.APIError
+		if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.status {
+			t.Errorf("%s %s: error = %v, want status %d", tt.method, tt.body, err, tt.status)
+		}
+	}
+}
+
+func TestModeOverrideOutlivesReload(t *testing.T) {
+	t.Cleanup(func() { modeOverrides.Store(nil) })
+	old := &CaddyWAF{Mode: modeBlock, Name: "mode-reload", instanceID: "inline:1"}
+	registerHandler(old)
+	setModeOverride("mode-reload", modeBypass)
+
+	// A reload provisions the new handler before cleaning up the old one,
+	// under a new instance ID.
+	reloaded := &CaddyWAF{Mode: modeBlock, Name: "mode-reload", instanceID: "inline:2"}
+	registerHandler(reloaded)
+	t.Cleanup(func() { unregisterHandler(reloaded) })
+	unregisterHandler(old)
+	if reloaded.currentMode() != modeBypass {
+		t.Fatalf("mode = %s after reload, want the override", reloaded.currentMode())
+	}
+
+	unregisterHandler(reloaded)
+	if modeOverrides.Load().names["mode-reload"] != modeBypass {
+		t.Error("override dropped with the name's last handler")
+	}
+}
+
+func TestAdminAPIBans(t *testing.T) {
+	ensureWAFMetrics(t)
+	h1 := &CaddyWAF{instanceID: "bans-a", bans: newBanTracker(1, time.Minute, time.Minute, "bans-a", zap.NewNop())}
+	h2 := &CaddyWAF{instanceID: "bans-b", bans: newBanTracker(1, time.Minute, time.Minute, "bans-b", zap.NewNop())}
+	for _, h := range []*CaddyWAF{h1, h2, {instanceID: "bans-c"}} {
+		registerHandler(h)
+		t.Cleanup(func() { unregisterHandler(h) })
+		if h.bans != nil {
+			t.Cleanup(h.bans.close)
+		}
+	}
+	h1.bans.recordBlock("192.0.2.1")
+	h2.bans.recordBlock("192.0.2.1")
+	h2.bans.recordBlock("192.0.2.2")
+
+	a := &AdminAPI{logger: zap.NewNop()}
+	request := func(method, target string) ([]banStatus, error) {
+		rec := httptest.NewRecorder()
+		if err := a.handleBans(rec, httptest.NewRequest(method, target, nil)); err != nil {
+			return nil, err
+		}
+		var out []banStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+			t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+		}
+		return out, nil
+	}
+
+	got, err := request(http.MethodGet, "/waf_chaitin/bans?instance=bans-b")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if len(got) != 2 || got[0].Key != "192.0.2.1" || got[1].Key != "192.0.2.2" || got[0].Instance != "bans-b" {
+		t.Errorf("bans = %+v, want the two bans of bans-b", got)
+	}
+
+	// Without an instance, the ban is lifted everywhere.
+	got, err = request(http.MethodDelete, "/waf_chaitin/bans?key=192.0.2.1")
+	if err != nil {
+		t.Fatalf("DELETE: %v", err)
+	}
+	if h1.bans.banned("192.0.2.1") || h2.bans.banned("192.0.2.1") || !h2.bans.banned("192.0.2.2") {
+		t.Error("DELETE did not lift only the bans of the key")
+	}
+	if !slices.ContainsFunc(got, func(b banStatus) bool { return b.Key == "192.0.2.2" }) {
+		t.Errorf("response = %+v, want the remaining ban", got)
+	}
+
+	for _, tt := range []struct {
+		method, target string
+		status         int
+	}{
+		{http.MethodDelete, "/waf_chaitin/bans", http.StatusBadRequest},
+		{http.MethodDelete, "/waf_chaitin/bans?key=192.0.2.1", http.StatusNotFound},
+		{http.MethodDelete, "/waf_chaitin/bans?key=192.0.2.2&instance=bans-a", http.StatusNotFound},
+		{http.MethodPost, "/waf_chaitin/bans", http.StatusMethodNotAllowed},
+	} {
+		_, err := request(tt.method, tt.target)
+		var apiErr caddy.APIError
+		if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.status {
+			t.Errorf("%s %s: error = %v, want status %d", tt.method, tt.target, err, tt.status)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package caddy_waf_t1k
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(App{})
+}
+
+// engineGroups holds the running named engine groups, keyed by name and
+// configuration, so a reload that keeps a group's configuration keeps its
+// pools, health state and metrics.
+var engineGroups = caddy.NewUsagePool()
+
+// App defines engine groups shared by waf_chaitin handlers. A handler
+// referencing a group by name uses the group's connection pools instead of
+// opening its own.
+type App struct {
+	// Groups maps a group name to its engine configuration.
+	Groups map[string]*EngineGroup `json:"groups,omitempty"`
+
+	groups map[string]*engineGroup
+	keys   []string
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "waf_chaitin",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+// Provision starts the engine groups, or reuses the running ones of a
+// previous config with the same name and configuration.
+func (a *App) Provision(ctx caddy.Context) error {
+	a.logger = ctx.Logger(a)
+	a.groups = make(map[string]*engineGroup, len(a.Groups))
+	initWAFMetrics(ctx.GetMetricsRegistry())
+
+	for name, cfg := range a.Groups {
+		if cfg == nil {
+			return fmt.Errorf("engine group %q: no configuration", name)
+		}
+		if len(cfg.WafEngineAddrs) == 0 && cfg.UpstreamsRaw == nil {
+			return fmt.Errorf("engine group %q: no engine addresses specified", name)
+		}
+		key, err := engineGroupKey(name, cfg)
+		if err != nil {
+			return fmt.Errorf("engine group %q: %v", name, err)
+		}
+
+		val, loaded, err := engineGroups.LoadOrNew(key, func() (caddy.Destructor, error) {
+			// Shared groups outlive the config that started them.
+			g := newEngineGroup(context.Background(), cfg, instancePrefixGroup+name, a.logger.With(zap.String("engine_group", name)))
+			if err := g.start(ctx); err != nil {
+				g.Destruct()
+				return nil, err
+			}
+			return g, nil
+		})
+		if err != nil {
+			return fmt.Errorf("engine group %q: %v", name, err)
+		}
+		if loaded {
+			a.logger.Info("reusing running engine group", zap.String("engine_group", name))
+		}
+		a.groups[name] = val.(*engineGroup)
+		a.keys = append(a.keys, key)
+	}
+	return nil
+}
+
+// engineGroupKey identifies a group in engineGroups by name and configuration.
+// It must be computed before the group starts, which applies defaults and
+// consumes UpstreamsRaw.
+func engineGroupKey(name string, cfg *EngineGroup) (string, error) {
+	cfgJSON, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	return name + "/" + string(cfgJSON), nil
+}
+
+// Validate ensures the app configuration is valid.
+func (a *App) Validate() error {
+	for name, cfg := range a.Groups {
+		if err := cfg.validate(); err != nil {
+			return fmt.Errorf("engine group %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Start implements caddy.App. Groups are started in Provision so handlers
+// can use them while they are provisioned.
+func (a *App) Start() error { return nil }
+
+// Stop implements caddy.App.
+func (a *App) Stop() error { return nil }
+
+// Cleanup releases this config's references to the engine groups. A group
+// is destructed once no config uses it.
+func (a *App) Cleanup() error {
+	for _, key := range a.keys {
+		if _, err := engineGroups.Delete(key); err != nil {
+			a.logger.Error("releasing engine group", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.App          = (*App)(nil)
+	_ caddy.Provisioner  = (*App)(nil)
+	_ caddy.Validator    = (*App)(nil)
+	_ caddy.CleanerUpper = (*App)(nil)
+	_ caddy.Destructor   = (*engineGroup)(nil)
+)
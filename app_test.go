@@ -0,0 +1,153 @@
+package caddy_waf_t1k
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func TestParseGlobalOption(t *testing.T) {
+	input := `waf_chaitin {
+		engine_group default {
+			waf_engine_addr 192.0.2.1:8000 192.0.2.2:8000
+			max_cap 64
+			health_interval 10s
+		}
+		engine_group canary {
+			upstreams a canary.waf.svc 8000
+		}
+	}`
+	val, err := parseGlobalOption(caddyfile.NewTestDispenser(input), nil)
+	if err != nil {
+		t.Fatalf("parseGlobalOption: %v", err)
+	}
+	appVal := val.(httpcaddyfile.App)
+	if appVal.Name != "waf_chaitin" {
+		t.Fatalf("app name = %q, want waf_chaitin", appVal.Name)
+	}
+
+	// A second occurrence of the option is merged.
+	val, err = parseGlobalOption(caddyfile.NewTestDispenser(`waf_chaitin {
+		engine_group internal {
+			waf_engine_addr unix//run/safeline/detector.sock
+		}
+	}`), appVal)
+	if err != nil {
+		t.Fatalf("parseGlobalOption: %v", err)
+	}
+	var app App
+	if err := json.Unmarshal(val.(httpcaddyfile.App).Value, &app); err != nil {
+		t.Fatal(err)
+	}
+	if len(app.Groups) != 3 {
+		t.Fatalf("groups = %v, want default, canary and internal", app.Groups)
+	}
+	if g := app.Groups["default"]; len(g.WafEngineAddrs) != 2 || g.MaxCap != 64 {
+		t.Errorf("default group = %+v", g)
+	}
+	if g := app.Groups["canary"]; string(g.UpstreamsRaw) != `{"name":"canary.waf.svc","port":"8000","source":"a"}` {
+		t.Errorf("canary upstreams = %s", g.UpstreamsRaw)
+	}
+
+	for _, input := range []string{
+		"waf_chaitin {\nengine_group a {\nwaf_engine_addr 192.0.2.1:8000\n}\nengine_group a {\nwaf_engine_addr 192.0.2.2:8000\n}\n}",
+		"waf_chaitin {\nengine_group a {\nmax_cap 8\n}\n}",
+		"waf_chaitin {\nengine_group a {\nmode monitor\n}\n}",
+		"waf_chaitin {\nengine_group\n}",
+		"waf_chaitin {\ngroups a\n}",
+	} {
+		if _, err := parseGlobalOption(caddyfile.NewTestDispenser(input), nil); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileEngineGroup(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`waf_chaitin {
+		engine_group default
+		mode monitor
+	}`)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.Group != "default" || m.Mode != modeMonitor {
+		t.Errorf("Group = %q, Mode = %q", m.Group, m.Mode)
+	}
+}
+
+func TestProvisionRejectsEngineGroupWithEngineSettings(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	m := &CaddyWAF{Group: "default", EngineGroup: EngineGroup{WafEngineAddrs: []string{"192.0.2.1:8000"}}}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatal("expected error for engine_group combined with waf_engine_addr")
+	}
+
+	m = &CaddyWAF{Group: "default"}
+	if err := m.Provision(ctx); err == nil {
+		t.Fatal("expected error for engine_group without the waf_chaitin app")
+	}
+}
+
+func TestAppSharesEngineGroupsAcrossReloads(t *testing.T) {
+	ensureWAFMetrics(t)
+	path := filepath.Join(t.TempDir(), "engines.txt")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	newApp := func(maxCap int) *App {
+		upstreams, _ := json.Marshal(map[string]string{"source": "file", "path": path})
+		return &App{Groups: map[string]*EngineGroup{
+			"default": {UpstreamsRaw: upstreams, MaxCap: maxCap},
+		}}
+	}
+	provision := func(a *App) {
+		t.Helper()
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(cancel)
+		if err := a.Provision(ctx); err != nil {
+			t.Fatalf("Provision: %v", err)
+		}
+	}
+
+	first := newApp(8)
+	provision(first)
+	reloaded := newApp(8)
+	provision(reloaded)
+	changed := newApp(16)
+	provision(changed)
+
+	if first.groups["default"] != reloaded.groups["default"] {
+		t.Error("reload with the same configuration started a new engine group")
+	}
+	if first.groups["default"] == changed.groups["default"] {
+		t.Error("changed configuration reused the running engine group")
+	}
+
+	group := first.groups["default"]
+	if group.instanceID != "group:default" {
+		t.Errorf("instance = %q, want group:default", group.instanceID)
+	}
+	if err := first.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if group.ctx.Err() != nil {
+		t.Error("engine group stopped while still in use")
+	}
+	if err := reloaded.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if group.ctx.Err() == nil {
+		t.Error("engine group still running after its last user was cleaned up")
+	}
+	if err := changed.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,403 @@
+package caddy_waf_t1k
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultBanWindow is the default window in which ban_threshold blocks
+	// ban a client.
+	defaultBanWindow = time.Minute
+	// defaultBanDuration is how long a client is banned by default.
+	defaultBanDuration = 10 * time.Minute
+	// banSweepInterval is how often expired bans and offenders are dropped.
+	banSweepInterval = 5 * time.Second
+	// banStoreTimeout bounds writing a ban to storage, and how long cleanup
+	// waits for pending writes.
+	banStoreTimeout = 10 * time.Second
+	// maxBanThreshold bounds ban_threshold, as each offender keeps the
+	// times of its last ban_threshold blocks: with banMaxOffenders, the
+	// offenders take at most about 80MB.
+	maxBanThreshold = 100
+	// banMaxOffenders bounds the clients whose blocks are counted, so a
+	// flood of blocked requests from many addresses cannot exhaust memory.
+	banMaxOffenders = 100000
+	// banStoragePrefix is the storage directory of shared bans, which holds
+	// a directory per handler name.
+	banStoragePrefix = "waf_chaitin/bans"
+)
+
+// offender holds the times of a client's last blocks, oldest at next once
+// the ring is full.
+type offender struct {
+	blocks []int64 // unix nanoseconds, a ring of ban_threshold entries
+	next   int
+}
+
+// newest returns the time of the client's last block.
+func (o *offender) newest() int64 {
+	return o.blocks[(o.next+len(o.blocks)-1)%len(o.blocks)]
+}
+
+// banEntry is a ban of a key.
+type banEntry struct {
+	expires time.Time
+	// stored is when the ban was found in or written to storage, zero if
+	// it is not shared.
+	stored time.Time
+}
+
+// storedBan is the storage record of a shared ban.
+type storedBan struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+// banTracker counts blocks per ban key in a sliding window and bans keys
+// that reach the threshold. With a storage, bans are shared with the other
+// trackers using it, e.g. on other Caddy instances.
+type banTracker struct {
+	threshold    int
+	maxOffenders int
+	window       time.Duration
+	duration     time.Duration
+	instanceID   string
+	logger       *zap.Logger
+	now          func() time.Time
+
+	storage       certmagic.Storage
+	storagePrefix string // see banStorageDir
+	storeTimeout  time.Duration
+	syncInterval  time.Duration
+	writes        sync.WaitGroup
+
+	mu        sync.RWMutex
+	offenders map[string]*offender
+	bans      map[string]*banEntry
+}
+
+func newBanTracker(threshold int, window, duration time.Duration, instanceID string, logger *zap.Logger) *banTracker {
+	if window == 0 {
+		window = defaultBanWindow
+	}
+	if duration == 0 {
+		duration = defaultBanDuration
+	}
+	return &banTracker{
+		threshold:    threshold,
+		maxOffenders: banMaxOffenders,
+		storeTimeout: banStoreTimeout,
+		window:       window,
+		duration:     duration,
+		instanceID:   instanceID,
+		logger:       logger,
+		now:          time.Now,
+		offenders:    make(map[string]*offender),
+		bans:         make(map[string]*banEntry),
+	}
+}
+
+// banned reports whether key is banned.
+func (t *banTracker) banned(key string) bool {
+	t.mu.RLock()
+	ban, ok := t.bans[key]
+	t.mu.RUnlock()
+	return ok && t.now().Before(ban.expires)
+}
+
+// recordBlock counts a block of key and bans it once it reaches the
+// threshold within the window. It reports whether key was banned.
+func (t *banTracker) recordBlock(key string) bool {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ban, ok := t.bans[key]; ok && now.Before(ban.expires) {
+		return false
+	}
+	o := t.offenders[key]
+	if o == nil {
+		if len(t.offenders) >= t.maxOffenders {
+			t.evictOffender()
+		}
+		o = &offender{blocks: make([]int64, t.threshold)}
+		t.offenders[key] = o
+	}
+	o.blocks[o.next] = now.UnixNano()
+	o.next = (o.next + 1) % len(o.blocks)
+	if oldest := o.blocks[o.next]; oldest == 0 || now.UnixNano()-oldest > int64(t.window) {
+		return false
+	}
+
+	delete(t.offenders, key)
+	if _, ok := t.bans[key]; !ok {
+		wafMetrics.activeBans.WithLabelValues(t.instanceID).Inc()
+	}
+	ban := &banEntry{expires: now.Add(t.duration)}
+	t.bans[key] = ban
+	wafMetrics.bansTotal.WithLabelValues(t.instanceID).Inc()
+	if t.storage != nil {
+		t.writes.Add(1)
+		go t.store(key, ban)
+	}
+	t.logger.Warn("client banned after repeated blocks",
+		zap.String("key", key),
+		zap.Int("blocks", t.threshold),
+		zap.Duration("window", t.window),
+		zap.Duration("duration", t.duration))
+	return true
+}
+
+// evictOffender forgets the blocks of a random offender to make room for
+// another. Map iteration order is random, so this needs no bookkeeping per
+// block.
+func (t *banTracker) evictOffender() {
+	for key := range t.offenders {
+		delete(t.offenders, key)
+		return
+	}
+}
+
+// unban lifts the ban of key, reporting whether it was banned. A shared
+// ban is deleted from storage.
+func (t *banTracker) unban(ctx context.Context, key string) bool {
+	t.mu.Lock()
+	_, ok := t.bans[key]
+	if ok {
+		delete(t.bans, key)
+		wafMetrics.activeBans.WithLabelValues(t.instanceID).Dec()
+	}
+	t.mu.Unlock()
+	if ok && t.storage != nil {
+		if err := t.storage.Delete(ctx, t.storageKey(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.logger.Error("deleting shared ban", zap.String("key", key), zap.Error(err))
+		}
+	}
+	return ok
+}
+
+// sweep drops expired bans and offenders without blocks in the window.
+func (t *banTracker) sweep() {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, ban := range t.bans {
+		if !now.Before(ban.expires) {
+			delete(t.bans, key)
+			wafMetrics.activeBans.WithLabelValues(t.instanceID).Dec()
+		}
+	}
+	for key, o := range t.offenders {
+		if now.UnixNano()-o.newest() > int64(t.window) {
+			delete(t.offenders, key)
+		}
+	}
+}
+
+// start sweeps the tracker, and syncs it with the storage if it has one,
+// until ctx is done.
+func (t *banTracker) start(ctx context.Context) {
+	go func() {
+		sweep := time.NewTicker(banSweepInterval)
+		defer sweep.Stop()
+		var syncC <-chan time.Time
+		if t.storage != nil {
+			t.syncLogged(ctx)
+			ticker := time.NewTicker(t.syncInterval)
+			defer ticker.Stop()
+			syncC = ticker.C
+		}
+		for {
+			select {
+			case <-sweep.C:
+				t.sweep()
+			case <-syncC:
+				t.syncLogged(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// banStorageDir returns the storage directory of the shared bans of the
+// handlers named name, so the bans of different sites stay apart.
+func banStorageDir(name string) string {
+	return path.Join(banStoragePrefix, url.PathEscape(name))
+}
+
+// storageKey returns the storage key of the ban of key. Keys are hashed as
+// they may contain any characters.
+func (t *banTracker) storageKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return path.Join(t.storagePrefix, hex.EncodeToString(sum[:]))
+}
+
+// store writes a new ban to storage.
+func (t *banTracker) store(key string, ban *banEntry) {
+	defer t.writes.Done()
+	data, err := json.Marshal(storedBan{Key: key, Expires: ban.expires})
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), t.storeTimeout)
+		err = t.storage.Store(ctx, t.storageKey(key), data)
+		cancel()
+	}
+	if err != nil {
+		t.logger.Error("storing shared ban", zap.String("key", key), zap.Error(err))
+		return
+	}
+	t.mu.Lock()
+	ban.stored = t.now()
+	t.mu.Unlock()
+}
+
+func (t *banTracker) syncLogged(ctx context.Context) {
+	if err := t.sync(ctx); err != nil && ctx.Err() == nil {
+		t.logger.Error("syncing shared bans", zap.Error(err))
+	}
+}
+
+// sync merges the bans in storage into the tracker. It adds bans issued
+// elsewhere, drops shared bans that were lifted elsewhere, and deletes
+// expired bans from storage.
+func (t *banTracker) sync(ctx context.Context) error {
+	start := t.now()
+	keys, err := t.storage.List(ctx, t.storagePrefix, false)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// Bans the tracker shares already need not be loaded again.
+	t.mu.RLock()
+	known := make(map[string]string, len(t.bans))
+	for key, ban := range t.bans {
+		if !ban.stored.IsZero() {
+			known[t.storageKey(key)] = key
+		}
+	}
+	t.mu.RUnlock()
+
+	found := make(map[string]time.Time, len(keys))
+	for _, storageKey := range keys {
+		if key, ok := known[storageKey]; ok {
+			found[key] = time.Time{}
+			continue
+		}
+		data, err := t.storage.Load(ctx, storageKey)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var ban storedBan
+		if err := json.Unmarshal(data, &ban); err != nil || t.storageKey(ban.Key) != storageKey {
+			t.logger.Warn("ignoring invalid shared ban", zap.String("storage_key", storageKey), zap.Error(err))
+			continue
+		}
+		if !start.Before(ban.Expires) {
+			if err := t.storage.Delete(ctx, storageKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		found[ban.Key] = ban.Expires
+	}
+
+	var expired []string
+	t.mu.Lock()
+	for key, expires := range found {
+		if expires.IsZero() {
+			continue
+		}
+		ban, ok := t.bans[key]
+		if !ok {
+			ban = new(banEntry)
+			t.bans[key] = ban
+			delete(t.offenders, key)
+			wafMetrics.activeBans.WithLabelValues(t.instanceID).Inc()
+		}
+		if expires.After(ban.expires) {
+			ban.expires = expires
+		}
+		ban.stored = start
+	}
+	for key, ban := range t.bans {
+		_, ok := found[key]
+		switch {
+		case !ok && !ban.stored.IsZero() && ban.stored.Before(start):
+			// Lifted elsewhere.
+			delete(t.bans, key)
+			wafMetrics.activeBans.WithLabelValues(t.instanceID).Dec()
+		case ok && !start.Before(ban.expires):
+			expired = append(expired, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, key := range expired {
+		if err := t.storage.Delete(ctx, t.storageKey(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// close waits up to the store timeout for pending storage writes and drops
+// all bans from the active bans gauge.
+func (t *banTracker) close() {
+	written := make(chan struct{})
+	go func() {
+		t.writes.Wait()
+		close(written)
+	}()
+	timer := time.NewTimer(t.storeTimeout)
+	select {
+	case <-written:
+	case <-timer.C:
+		t.logger.Warn("shared ban writes still pending at cleanup, not waiting for them",
+			zap.Duration("timeout", t.storeTimeout))
+	}
+	timer.Stop()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	wafMetrics.activeBans.WithLabelValues(t.instanceID).Sub(float64(len(t.bans)))
+	clear(t.bans)
+	clear(t.offenders)
+}
+
+// banStatus is the admin API view of a ban.
+type banStatus struct {
+	Instance string    `json:"instance"`
+	Key      string    `json:"key"`
+	Expires  time.Time `json:"expires"`
+	Shared   bool      `json:"shared,omitempty"`
+}
+
+// list returns the unexpired bans, ordered by key.
+func (t *banTracker) list() []banStatus {
+	now := t.now()
+	t.mu.RLock()
+	out := make([]banStatus, 0, len(t.bans))
+	for key, ban := range t.bans {
+		if now.Before(ban.expires) {
+			out = append(out, banStatus{Instance: t.instanceID, Key: key, Expires: ban.expires, Shared: !ban.stored.IsZero()})
+		}
+	}
+	t.mu.RUnlock()
+	slices.SortFunc(out, func(a, b banStatus) int { return strings.Compare(a.Key, b.Key) })
+	return out
+}
@@ -0,0 +1,287 @@
+package caddy_waf_t1k
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func newTestBanTracker(t *testing.T, threshold int, instanceID string) (*banTracker, *fakeClock) {
+	t.Helper()
+	ensureWAFMetrics(t)
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	b := newBanTracker(threshold, time.Minute, 10*time.Minute, instanceID, zap.NewNop())
+	b.now = clock.now
+	t.Cleanup(b.close)
+	return b, clock
+}
+
+func TestBanTrackerThreshold(t *testing.T) {
+	b, clock := newTestBanTracker(t, 3, "ban-threshold")
+	b.recordBlock("192.0.2.1")
+	clock.advance(30 * time.Second)
+	b.recordBlock("192.0.2.1")
+	b.recordBlock("192.0.2.2")
+	clock.advance(31 * time.Second)
+
+	// The first block slid out of the window.
+	if b.recordBlock("192.0.2.1") || b.banned("192.0.2.1") {
+		t.Fatal("banned with 2 blocks in the window")
+	}
+	if !b.recordBlock("192.0.2.1") || !b.banned("192.0.2.1") {
+		t.Fatal("not banned after 3 blocks in the window")
+	}
+	if b.banned("192.0.2.2") {
+		t.Error("ban applied to another key")
+	}
+	if b.recordBlock("192.0.2.1") {
+		t.Error("banned client banned again")
+	}
+	if got := testutil.ToFloat64(wafMetrics.bansTotal.WithLabelValues("ban-threshold")); got != 1 {
+		t.Errorf("bans_total = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(wafMetrics.activeBans.WithLabelValues("ban-threshold")); got != 1 {
+		t.Errorf("active_bans = %v, want 1", got)
+	}
+}
+
+func TestBanTrackerExpiry(t *testing.T) {
+	b, clock := newTestBanTracker(t, 1, "ban-expiry")
+	b.recordBlock("192.0.2.1")
+	b.recordBlock("192.0.2.2")
+	clock.advance(5 * time.Minute)
+	if got := b.list(); len(got) != 2 || got[0].Key != "192.0.2.1" || !got[0].Expires.Equal(clock.t.Add(5*time.Minute)) {
+		t.Errorf("list = %+v, want both bans expiring in 5m", got)
+	}
+	if !b.unban(context.Background(), "192.0.2.2") || b.unban(context.Background(), "192.0.2.2") || b.banned("192.0.2.2") {
+		t.Error("unban did not lift the ban exactly once")
+	}
+
+	clock.advance(5 * time.Minute)
+	if b.banned("192.0.2.1") {
+		t.Fatal("ban outlived ban_duration")
+	}
+	b.sweep()
+	if len(b.bans) != 0 || len(b.offenders) != 0 {
+		t.Errorf("sweep kept bans %v and offenders %v", b.bans, b.offenders)
+	}
+	if got := testutil.ToFloat64(wafMetrics.activeBans.WithLabelValues("ban-expiry")); got != 0 {
+		t.Errorf("active_bans = %v, want 0", got)
+	}
+}
+
+func TestBanTrackerSweepsOffenders(t *testing.T) {
+	b, clock := newTestBanTracker(t, 5, "ban-sweep")
+	b.recordBlock("192.0.2.1")
+	clock.advance(30 * time.Second)
+	b.recordBlock("192.0.2.2")
+	clock.advance(31 * time.Second)
+	b.sweep()
+	if _, ok := b.offenders["192.0.2.1"]; ok {
+		t.Error("offender without blocks in the window was kept")
+	}
+	if _, ok := b.offenders["192.0.2.2"]; !ok {
+		t.Error("offender with a block in the window was dropped")
+	}
+}
+
+func TestBanTrackerBoundsOffenders(t *testing.T) {
+	b, _ := newTestBanTracker(t, 3, "ban-bounded")
+	b.maxOffenders = 4
+	for i := range 20 {
+		b.recordBlock(fmt.Sprintf("192.0.2.%d", i))
+	}
+	if len(b.offenders) != 4 {
+		t.Fatalf("tracking %d offenders, want 4", len(b.offenders))
+	}
+	if _, ok := b.offenders["192.0.2.19"]; !ok {
+		t.Error("newest offender was evicted")
+	}
+
+	// Offenders already tracked keep counting without evicting others.
+	b.recordBlock("192.0.2.19")
+	if !b.recordBlock("192.0.2.19") || len(b.offenders) != 3 {
+		t.Errorf("offender not banned after 3 blocks, or others evicted: %d offenders", len(b.offenders))
+	}
+}
+
+func newSharedBanTrackers(t *testing.T, instanceIDs ...string) ([]*banTracker, *fakeClock, certmagic.Storage) {
+	t.Helper()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	var trackers []*banTracker
+	var clock *fakeClock
+	for _, id := range instanceIDs {
+		b, c := newTestBanTracker(t, 1, id)
+		if clock == nil {
+			clock = c
+		}
+		b.now = clock.now
+		b.storage = storage
+		b.storagePrefix = banStorageDir("shared")
+		trackers = append(trackers, b)
+	}
+	return trackers, clock, storage
+}
+
+func TestBanTrackerSharesBans(t *testing.T) {
+	ctx := context.Background()
+	trackers, clock, storage := newSharedBanTrackers(t, "ban-node-a", "ban-node-b")
+	a, b := trackers[0], trackers[1]
+
+	a.recordBlock("192.0.2.1")
+	a.writes.Wait()
+	if !storage.Exists(ctx, a.storageKey("192.0.2.1")) {
+		t.Fatal("ban was not stored")
+	}
+	if b.banned("192.0.2.1") {
+		t.Fatal("ban shared before a sync")
+	}
+	clock.advance(time.Second)
+	if err := b.sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if !b.banned("192.0.2.1") {
+		t.Fatal("ban of another node not enforced after a sync")
+	}
+	if got := b.list(); len(got) != 1 || !got[0].Shared || !got[0].Expires.Equal(a.list()[0].Expires) {
+		t.Errorf("list = %+v, want the shared ban with the original expiry", got)
+	}
+	if got := testutil.ToFloat64(wafMetrics.activeBans.WithLabelValues("ban-node-b")); got != 1 {
+		t.Errorf("active_bans = %v, want 1", got)
+	}
+
+	// Lifting the ban on one node lifts it on the others at their next sync.
+	clock.advance(time.Second)
+	if !b.unban(ctx, "192.0.2.1") {
+		t.Fatal("unban found no ban")
+	}
+	if storage.Exists(ctx, a.storageKey("192.0.2.1")) {
+		t.Fatal("lifted ban still stored")
+	}
+	if err := a.sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if a.banned("192.0.2.1") {
+		t.Error("ban lifted elsewhere still enforced")
+	}
+}
+
+func TestBanTrackerSyncExpiresBans(t *testing.T) {
+	ctx := context.Background()
+	trackers, clock, storage := newSharedBanTrackers(t, "ban-ttl-a", "ban-ttl-b")
+	a, b := trackers[0], trackers[1]
+
+	a.recordBlock("192.0.2.1")
+	a.recordBlock("192.0.2.2")
+	a.writes.Wait()
+	clock.advance(time.Second)
+	if err := b.sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	// A stored ban that is invalid is ignored.
+	if err := storage.Store(ctx, b.storagePrefix+"/garbage", []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(10 * time.Minute)
+	if err := b.sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	for _, key := range []string{"192.0.2.1", "192.0.2.2"} {
+		if storage.Exists(ctx, a.storageKey(key)) {
+			t.Errorf("expired ban of %s still stored", key)
+		}
+		if b.banned(key) {
+			t.Errorf("expired ban of %s enforced", key)
+		}
+	}
+	if err := a.sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if len(a.list()) != 0 {
+		t.Errorf("list = %+v after expiry, want none", a.list())
+	}
+}
+
+func TestBanTrackerSharesBansPerName(t *testing.T) {
+	ctx := context.Background()
+	trackers, clock, storage := newSharedBanTrackers(t, "ban-ns-a", "ban-ns-b")
+	a, other := trackers[0], trackers[1]
+	other.storagePrefix = banStorageDir("other/site")
+
+	a.recordBlock("192.0.2.1")
+	a.writes.Wait()
+	clock.advance(time.Second)
+	if err := other.sync(ctx); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if other.banned("192.0.2.1") {
+		t.Error("ban shared with a handler of another name")
+	}
+	if got := other.storageKey("192.0.2.1"); !strings.HasPrefix(got, "waf_chaitin/bans/other%2Fsite/") {
+		t.Errorf("storage key = %q, want it under the escaped name", got)
+	}
+	other.recordBlock("192.0.2.1")
+	other.writes.Wait()
+	if !other.unban(ctx, "192.0.2.1") || !storage.Exists(ctx, a.storageKey("192.0.2.1")) {
+		t.Error("lifting a ban deleted the ban of another name")
+	}
+}
+
+// stallingStorage is a storage whose writes hang until release is closed,
+// or until their context is done if honorCtx is set.
+type stallingStorage struct {
+	certmagic.Storage
+	honorCtx bool
+	release  chan struct{}
+}
+
+func (s *stallingStorage) Store(ctx context.Context, _ string, _ []byte) error {
+	if s.honorCtx {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.release:
+			return nil
+		}
+	}
+	<-s.release
+	return nil
+}
+
+func TestBanTrackerStoreTimeout(t *testing.T) {
+	ensureWAFMetrics(t)
+	for _, honorCtx := range []bool{true, false} {
+		storage := &stallingStorage{Storage: &certmagic.FileStorage{Path: t.TempDir()}, honorCtx: honorCtx, release: make(chan struct{})}
+		t.Cleanup(func() { close(storage.release) })
+		b := newBanTracker(1, time.Minute, time.Minute, "ban-stall", zap.NewNop())
+		b.storage = storage
+		b.storagePrefix = banStorageDir("stall")
+		b.storeTimeout = 20 * time.Millisecond
+		b.recordBlock("192.0.2.1")
+
+		closed := make(chan struct{})
+		go func() {
+			b.close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("close blocked on a stalled storage write (storage honors context: %v)", honorCtx)
+		}
+	}
+}
+
+func TestBanTrackerSyncWithoutStoredBans(t *testing.T) {
+	trackers, _, _ := newSharedBanTrackers(t, "ban-empty")
+	if err := trackers[0].sync(context.Background()); err != nil {
+		t.Errorf("sync of an empty storage: %v", err)
+	}
+}
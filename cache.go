@@ -0,0 +1,271 @@
+package caddy_waf_t1k
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	defaultCacheMaxEntries  = 10000
+	defaultCacheTTL         = time.Minute
+	defaultCacheMaxBodySize = 64 * 1024
+)
+
+// VerdictCache caches the detection verdicts of identical requests in
+// memory, so repeated requests skip the engine. Requests are identical if
+// they come from the same client IP and have the same method, host, request
+// URI, key headers and body.
+type VerdictCache struct {
+	// MaxEntries is the number of verdicts kept; the least recently used
+	// one is evicted first. Default 10000.
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// TTL is how long a verdict is used. Default 1m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// Methods are the request methods whose verdicts are cached.
+	// Default GET and HEAD.
+	Methods []string `json:"methods,omitempty"`
+
+	// Headers are the request headers that are part of the cache key.
+	// Headers not in the key are not inspected on a hit. Default all
+	// headers.
+	Headers []string `json:"headers,omitempty"`
+
+	// MaxBodySize is the largest request body whose verdict is cached.
+	// Default 64KiB.
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+
+	// SharedAcrossClients leaves the client IP out of the cache key, so a
+	// verdict, including the event ID of a block, is replayed to every
+	// client. Engine rules that depend on the client, such as IP lists,
+	// rate limits and bot rules, are then bypassed for cached requests.
+	SharedAcrossClients bool `json:"shared_across_clients,omitempty"`
+
+	now     func() time.Time
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type cacheEntry struct {
+	key     [sha256.Size]byte
+	result  *detection.Result
+	expires time.Time
+}
+
+// validate ensures the cache configuration is valid.
+func (c *VerdictCache) validate() error {
+	if c.MaxEntries < 0 || c.TTL < 0 || c.MaxBodySize < 0 {
+		return fmt.Errorf("verdict_cache: max_entries, ttl and max_body_size must be >= 0")
+	}
+	return nil
+}
+
+// provision applies the defaults and initializes the cache.
+func (c *VerdictCache) provision() {
+	if c.MaxEntries == 0 {
+		c.MaxEntries = defaultCacheMaxEntries
+	}
+	if c.TTL == 0 {
+		c.TTL = caddy.Duration(defaultCacheTTL)
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{http.MethodGet, http.MethodHead}
+	}
+	for i, method := range c.Methods {
+		c.Methods[i] = strings.ToUpper(method)
+	}
+	for i, field := range c.Headers {
+		c.Headers[i] = http.CanonicalHeaderKey(field)
+	}
+	slices.Sort(c.Headers)
+	if c.MaxBodySize == 0 {
+		c.MaxBodySize = defaultCacheMaxBodySize
+	}
+	c.now = time.Now
+	c.lru = list.New()
+	c.entries = make(map[[sha256.Size]byte]*list.Element)
+}
+
+// cacheable reports whether the verdict of r may be cached. Its body must
+// be buffered to be part of the key.
+func (c *VerdictCache) cacheable(r *http.Request) bool {
+	if c == nil || !slices.Contains(c.Methods, r.Method) {
+		return false
+	}
+	return r.Body == nil || r.Body == http.NoBody || (r.ContentLength >= 0 && r.ContentLength <= c.MaxBodySize)
+}
+
+// key hashes the request and body. The URI is used as received: normalizing
+// the path could let a request get the verdict of one the engine would
+// judge differently.
+func (c *VerdictCache) key(r *http.Request, body []byte) [sha256.Size]byte {
+	h := sha256.New()
+	if !c.SharedAcrossClients {
+		client := clientIP(r)
+		if ip, err := clientAddr(r); err == nil {
+			client = ip.String()
+		}
+		writeKeyField(h, client)
+	}
+	writeKeyField(h, r.Method)
+	writeKeyField(h, strings.ToLower(r.Host))
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	writeKeyField(h, uri)
+	fields := c.Headers
+	if len(fields) == 0 {
+		fields = slices.Sorted(maps.Keys(r.Header))
+	}
+	for _, field := range fields {
+		values := r.Header.Values(field)
+		writeKeyField(h, field)
+		binary.Write(h, binary.BigEndian, uint64(len(values))) //nolint:errcheck // hashes do not fail
+		for _, value := range values {
+			writeKeyField(h, value)
+		}
+	}
+	writeKeyField(h, string(body))
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// writeKeyField writes s length-prefixed, so fields cannot run into each
+// other.
+func writeKeyField(h hash.Hash, s string) {
+	binary.Write(h, binary.BigEndian, uint64(len(s))) //nolint:errcheck // hashes do not fail
+	h.Write([]byte(s))
+}
+
+// get returns the unexpired verdict cached for key.
+func (c *VerdictCache) get(key [sha256.Size]byte) (*detection.Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.result, true
+}
+
+// put caches the verdict for key, evicting the least recently used verdict
+// if the cache is full.
+func (c *VerdictCache) put(key [sha256.Size]byte, result *detection.Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(time.Duration(c.TTL))
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.result, entry.expires = result, expires
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, result: result, expires: expires})
+	for c.lru.Len() > c.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// unmarshalVerdictCache parses the verdict cache from Caddyfile tokens:
+//
+//	verdict_cache {
+//	    max_entries   <n>
+//	    ttl           <duration>
+//	    methods       <methods...>
+//	    headers       <fields...>
+//	    max_body_size <size>
+//	    shared_across_clients
+//	}
+func unmarshalVerdictCache(d *caddyfile.Dispenser) (*VerdictCache, error) {
+	c := new(VerdictCache)
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "max_entries":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			n, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid max_entries value: %v", err)
+			}
+			if n <= 0 {
+				return nil, d.Err("max_entries must be > 0")
+			}
+			c.MaxEntries = n
+		case "ttl":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid ttl value: %v", err)
+			}
+			if dur <= 0 {
+				return nil, d.Err("ttl must be > 0")
+			}
+			c.TTL = caddy.Duration(dur)
+		case "methods", "headers":
+			name := d.Val()
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return nil, d.ArgErr()
+			}
+			if name == "methods" {
+				c.Methods = append(c.Methods, args...)
+			} else {
+				c.Headers = append(c.Headers, args...)
+			}
+		case "max_body_size":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid max_body_size value: %v", err)
+			}
+			if size > uint64(maxBodySizeLimit) {
+				return nil, d.Errf("max_body_size must be <= %d", maxBodySizeLimit)
+			}
+			c.MaxBodySize = int64(size)
+		case "shared_across_clients":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			c.SharedAcrossClients = true
+		default:
+			return nil, d.Errf("unrecognized verdict_cache option %s", d.Val())
+		}
+	}
+	return c, nil
+}
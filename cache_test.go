@@ -0,0 +1,132 @@
+package caddy_waf_t1k
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chaitin/t1k-go/detection"
+)
+
+func newTestVerdictCache(c *VerdictCache) (*VerdictCache, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	c.provision()
+	c.now = clock.now
+	return c, clock
+}
+
+func TestVerdictCacheKey(t *testing.T) {
+	c, _ := newTestVerdictCache(&VerdictCache{})
+	newReq := func(method, target string, header http.Header, body string) *http.Request {
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(method, u.RequestURI(), strings.NewReader(body))
+		req.Host = u.Host
+		req.Header = header
+		return req
+	}
+	key := func(req *http.Request, body string) [sha256.Size]byte { return c.key(req, []byte(body)) }
+
+	base := key(newReq(http.MethodGet, "http://example.com/a?b=c", http.Header{"Accept": {"*/*"}}, ""), "")
+	otherClient := newReq(http.MethodGet, "http://example.com/a?b=c", http.Header{"Accept": {"*/*"}}, "")
+	otherClient.RemoteAddr = "198.51.100.7:1234"
+	if got := key(newReq(http.MethodGet, "http://EXAMPLE.com/a?b=c", http.Header{"Accept": {"*/*"}}, ""), ""); got != base {
+		t.Error("host case changed the key")
+	}
+	for name, got := range map[string][sha256.Size]byte{
+		"method":       key(newReq(http.MethodHead, "http://example.com/a?b=c", http.Header{"Accept": {"*/*"}}, ""), ""),
+		"host":         key(newReq(http.MethodGet, "http://example.org/a?b=c", http.Header{"Accept": {"*/*"}}, ""), ""),
+		"query":        key(newReq(http.MethodGet, "http://example.com/a?b=d", http.Header{"Accept": {"*/*"}}, ""), ""),
+		"path":         key(newReq(http.MethodGet, "http://example.com/x/../a?b=c", http.Header{"Accept": {"*/*"}}, ""), ""),
+		"header value": key(newReq(http.MethodGet, "http://example.com/a?b=c", http.Header{"Accept": {"text/html"}}, ""), ""),
+		"extra header": key(newReq(http.MethodGet, "http://example.com/a?b=c", http.Header{"Accept": {"*/*"}, "Cookie": {"id=1' OR 1=1"}}, ""), ""),
+		"body":         key(newReq(http.MethodGet, "http://example.com/a?b=c", http.Header{"Accept": {"*/*"}}, "x"), "x"),
+		"client":       key(otherClient, ""),
+	} {
+		if got == base {
+			t.Errorf("%s did not change the key", name)
+		}
+	}
+
+	// Verdicts shared across clients ignore the client IP.
+	c, _ = newTestVerdictCache(&VerdictCache{SharedAcrossClients: true})
+	if key(otherClient, "") != key(newReq(http.MethodGet, "http://example.com/a?b=c", http.Header{"Accept": {"*/*"}}, ""), "") {
+		t.Error("client IP changed the key of a cache shared across clients")
+	}
+
+	// With key headers, other headers are ignored.
+	c, _ = newTestVerdictCache(&VerdictCache{Headers: []string{"accept"}})
+	base = key(newReq(http.MethodGet, "/", http.Header{"Accept": {"*/*"}}, ""), "")
+	if got := key(newReq(http.MethodGet, "/", http.Header{"Accept": {"*/*"}, "User-Agent": {"bot"}}, ""), ""); got != base {
+		t.Error("header outside the key changed the key")
+	}
+	if got := key(newReq(http.MethodGet, "/", http.Header{"Accept": {"*/*", "text/html"}}, ""), ""); got == base {
+		t.Error("key header value did not change the key")
+	}
+}
+
+func TestVerdictCacheLRU(t *testing.T) {
+	c, clock := newTestVerdictCache(&VerdictCache{MaxEntries: 2, TTL: 0})
+	pass := &detection.Result{Head: '.'}
+	a, b, d := [sha256.Size]byte{1}, [sha256.Size]byte{2}, [sha256.Size]byte{3}
+	c.put(a, pass)
+	c.put(b, pass)
+	if _, ok := c.get(a); !ok {
+		t.Fatal("cached verdict missing")
+	}
+	// b is now the least recently used entry.
+	c.put(d, pass)
+	if _, ok := c.get(b); ok {
+		t.Error("least recently used verdict was not evicted")
+	}
+	if _, ok := c.get(a); !ok {
+		t.Error("recently used verdict was evicted")
+	}
+
+	clock.advance(defaultCacheTTL)
+	if _, ok := c.get(d); ok {
+		t.Error("expired verdict was returned")
+	}
+	if len(c.entries) != 1 || c.lru.Len() != 1 {
+		t.Errorf("cache has %d entries, %d in the LRU list after expiry; want 1", len(c.entries), c.lru.Len())
+	}
+}
+
+func TestVerdictCacheCacheable(t *testing.T) {
+	c, _ := newTestVerdictCache(&VerdictCache{Methods: []string{"get", "post"}, MaxBodySize: 4})
+	for _, tt := range []struct {
+		method, body string
+		want         bool
+	}{
+		{http.MethodGet, "", true},
+		{http.MethodPost, "abcd", true},
+		{http.MethodPost, "abcde", false},
+		{http.MethodHead, "", false},
+	} {
+		if got := c.cacheable(httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))); got != tt.want {
+			t.Errorf("cacheable(%s with %d byte body) = %v, want %v", tt.method, len(tt.body), got, tt.want)
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("ab"))
+	req.ContentLength = -1
+	if c.cacheable(req) {
+		t.Error("body of unknown length is cacheable")
+	}
+	if (*VerdictCache)(nil).cacheable(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Error("nil cache reported a cacheable request")
+	}
+}
+
+func TestVerdictCacheValidate(t *testing.T) {
+	for _, c := range []*VerdictCache{{MaxEntries: -1}, {TTL: -1}, {MaxBodySize: -1}} {
+		if err := c.validate(); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
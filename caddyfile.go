@@ -1,8 +1,9 @@
 package caddy_waf_t1k
 
 import (
-	"net"
+	"encoding/json"
 	"strconv"
+	"strings"
 
 	"github.com/dustin/go-humanize"
 
@@ -15,6 +16,78 @@ import (
 
 func init() {
 	httpcaddyfile.RegisterHandlerDirective("waf_chaitin", parseCaddyfileHandler) // Register the directive
+	httpcaddyfile.RegisterGlobalOption("waf_chaitin", parseGlobalOption)
+}
+
+// UnmarshalCaddyfile sets up the app from the waf_chaitin global option:
+//
+//	waf_chaitin {
+//	    engine_group <name> {
+//	        waf_engine_addr <addresses...>
+//	        ...
+//	    }
+//	}
+//
+// Engine groups accept the engine subdirectives of the waf_chaitin handler.
+func (a *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "engine_group":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if _, ok := a.Groups[name]; ok {
+					return d.Errf("engine group %q already defined", name)
+				}
+				group := new(EngineGroup)
+				for groupNesting := d.Nesting(); d.NextBlock(groupNesting); {
+					ok, err := group.unmarshalCaddyfileOption(d)
+					if err != nil {
+						return err
+					}
+					if !ok {
+						return d.Errf("unrecognized engine group subdirective %s", d.Val())
+					}
+				}
+				if len(group.WafEngineAddrs) == 0 && group.UpstreamsRaw == nil {
+					return d.Errf("engine group %q: no engine addresses specified", name)
+				}
+				if a.Groups == nil {
+					a.Groups = make(map[string]*EngineGroup)
+				}
+				a.Groups[name] = group
+			default:
+				return d.Errf("unrecognized waf_chaitin option %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// parseGlobalOption parses the waf_chaitin global option into the app config,
+// merging repeated occurrences.
+func parseGlobalOption(d *caddyfile.Dispenser, existingVal any) (any, error) {
+	app := new(App)
+	if existing, ok := existingVal.(httpcaddyfile.App); ok {
+		if err := json.Unmarshal(existing.Value, app); err != nil {
+			return nil, err
+		}
+	}
+	if err := app.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+	return httpcaddyfile.App{
+		Name:  "waf_chaitin",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
 }
 
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
@@ -25,60 +98,14 @@ func (m *CaddyWAF) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		switch d.Val() {
-		case "waf_engine_addr":
-			args := d.RemainingArgs()
-			if len(args) == 0 {
-				return d.ArgErr()
-			}
-			for _, addr := range args {
-				host, port, err := net.SplitHostPort(addr)
-				if err != nil {
-					return d.Errf("invalid address format %q: %v", addr, err)
-				}
-				if net.ParseIP(host) == nil {
-					return d.Errf("invalid IP address: %s", host)
-				}
-				if _, err := strconv.Atoi(port); err != nil {
-					return d.Errf("invalid port number: %s", port)
-				}
-			}
-			m.WafEngineAddrs = args
-		case "initial_cap":
-			if !d.NextArg() {
-				return d.ArgErr()
-			}
-			initialCap, err := strconv.Atoi(d.Val())
-			if err != nil {
-				return d.Errf("invalid initial_cap value: %v", err)
-			}
-			m.InitialCap = initialCap
-		case "max_idle":
+		case "engine_group":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			maxIdle, err := strconv.Atoi(d.Val())
-			if err != nil {
-				return d.Errf("invalid max_idle value: %v", err)
-			}
-			m.MaxIdle = maxIdle
-		case "max_cap":
-			if !d.NextArg() {
+			m.Group = d.Val()
+			if d.NextArg() {
 				return d.ArgErr()
 			}
-			maxCap, err := strconv.Atoi(d.Val())
-			if err != nil {
-				return d.Errf("invalid max_cap value: %v", err)
-			}
-			m.MaxCap = maxCap
-		case "idle_timeout":
-			if !d.NextArg() {
-				return d.ArgErr()
-			}
-			dur, err := caddy.ParseDuration(d.Val())
-			if err != nil {
-				return d.Errf("invalid idle_timeout value: %v", err)
-			}
-			m.IdleTimeout = dur
 		case "max_body_size":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -112,55 +139,498 @@ func (m *CaddyWAF) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				m.LoadBalancing = new(LoadBalancing)
 			}
 			m.LoadBalancing.SelectionPolicyRaw = caddyconfig.JSONModuleObject(sel, "policy", name, nil)
-		case "health_fail_duration":
+		case "lb_retries":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			retries, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid lb_retries value: %v", err)
+			}
+			if retries < 0 {
+				return d.Errf("lb_retries must be >= 0")
+			}
+			if m.LoadBalancing == nil {
+				m.LoadBalancing = new(LoadBalancing)
+			}
+			m.LoadBalancing.Retries = retries
+		case "name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Name = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case modeBlock, modeMonitor, modeBypass:
+				m.Mode = d.Val()
+			default:
+				return d.Errf("unrecognized mode %q, expected %s, %s or %s", d.Val(), modeBlock, modeMonitor, modeBypass)
+			}
+		case "allow_ips":
+			list, err := unmarshalIPList(d, m.AllowIPs)
+			if err != nil {
+				return err
+			}
+			m.AllowIPs = list
+		case "deny_ips":
+			list, err := unmarshalIPList(d, m.DenyIPs)
+			if err != nil {
+				return err
+			}
+			m.DenyIPs = list
+		case "ban_threshold":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			threshold, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("invalid ban_threshold value: %v", err)
+			}
+			if threshold < 0 || threshold > maxBanThreshold {
+				return d.Errf("ban_threshold must be between 0 and %d", maxBanThreshold)
+			}
+			m.BanThreshold = threshold
+		case "ban_window", "ban_duration", "ban_sync_interval":
+			name := d.Val()
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
 			dur, err := caddy.ParseDuration(d.Val())
 			if err != nil {
-				return d.Errf("invalid health_fail_duration value: %v", err)
+				return d.Errf("invalid %s value: %v", name, err)
+			}
+			if dur < 0 {
+				return d.Errf("%s must be >= 0", name)
 			}
-			m.HealthFailDuration = caddy.Duration(dur)
-		case "health_max_fails":
+			switch name {
+			case "ban_window":
+				m.BanWindow = caddy.Duration(dur)
+			case "ban_duration":
+				m.BanDuration = caddy.Duration(dur)
+			default:
+				m.BanSyncInterval = caddy.Duration(dur)
+			}
+		case "ban_key":
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			maxFails, err := strconv.Atoi(d.Val())
+			m.BanKey = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		case "verdict_cache":
+			cache, err := unmarshalVerdictCache(d)
 			if err != nil {
-				return d.Errf("invalid health_max_fails value: %v", err)
+				return err
 			}
-			m.HealthMaxFails = maxFails
-		case "lb_retries":
+			m.VerdictCache = cache
+		case "skip":
+			set, err := caddyhttp.ParseCaddyfileNestedMatcherSet(d)
+			if err != nil {
+				return err
+			}
+			if len(set) == 0 {
+				return d.Err("skip requires at least one matcher")
+			}
+			m.SkipRaw = append(m.SkipRaw, set)
+		case "detect_timeout", "detect_budget":
+			name := d.Val()
 			if !d.NextArg() {
 				return d.ArgErr()
 			}
-			retries, err := strconv.Atoi(d.Val())
+			dur, err := caddy.ParseDuration(d.Val())
 			if err != nil {
-				return d.Errf("invalid lb_retries value: %v", err)
+				return d.Errf("invalid %s value: %v", name, err)
 			}
-			if retries < 0 {
-				return d.Errf("lb_retries must be >= 0")
+			if dur < 0 {
+				return d.Errf("%s must be >= 0", name)
 			}
-			if m.LoadBalancing == nil {
-				m.LoadBalancing = new(LoadBalancing)
+			if name == "detect_timeout" {
+				m.DetectTimeout = caddy.Duration(dur)
+			} else {
+				m.DetectBudget = caddy.Duration(dur)
 			}
-			m.LoadBalancing.Retries = retries
+		case "block_action":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case blockActionRespond, blockActionError:
+				m.BlockAction = d.Val()
+			default:
+				return d.Errf("unrecognized block_action %q, expected %s or %s", d.Val(), blockActionRespond, blockActionError)
+			}
+		case "block_response":
+			resp, err := unmarshalBlockResponse(d)
+			if err != nil {
+				return err
+			}
+			m.BlockResponse = resp
+		case "fail_mode":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch d.Val() {
+			case failModeOpen, failModeClosed:
+				m.FailMode = d.Val()
+			default:
+				return d.Errf("unrecognized fail_mode %q, expected %s or %s", d.Val(), failModeOpen, failModeClosed)
+			}
+		case "fail_response":
+			resp, err := unmarshalBlockResponse(d)
+			if err != nil {
+				return err
+			}
+			m.FailResponse = resp
 		default:
-			return d.Errf("unrecognized subdirective %s", d.Val())
+			ok, err := m.EngineGroup.unmarshalCaddyfileOption(d)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.Errf("unrecognized subdirective %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalCaddyfileOption parses the engine subdirective at the dispenser's
+// current token. It reports false if the subdirective is not an engine option.
+func (c *EngineGroup) unmarshalCaddyfileOption(d *caddyfile.Dispenser) (bool, error) {
+	switch d.Val() {
+	case "waf_engine_addr":
+		if err := c.unmarshalEngineAddrList(d, &c.WafEngineAddrs); err != nil {
+			return true, err
+		}
+	case "backup_engine_addr":
+		if err := c.unmarshalEngineAddrList(d, &c.BackupEngineAddrs); err != nil {
+			return true, err
+		}
+	case "resolve_interval":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid resolve_interval value: %v", err)
+		}
+		c.ResolveInterval = caddy.Duration(dur)
+	case "upstreams":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		if c.UpstreamsRaw != nil {
+			return true, d.Err("upstreams already specified")
+		}
+		name := d.Val()
+		modID := "http.waf_chaitin.upstreams." + name
+		unm, err := caddyfile.UnmarshalModule(d, modID)
+		if err != nil {
+			return true, err
+		}
+		source, ok := unm.(EngineSource)
+		if !ok {
+			return true, d.Errf("module %s (%T) is not a waf_chaitin.EngineSource", modID, unm)
+		}
+		c.UpstreamsRaw = caddyconfig.JSONModuleObject(source, "source", name, nil)
+	case "initial_cap":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		initialCap, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid initial_cap value: %v", err)
+		}
+		c.InitialCap = initialCap
+	case "max_idle":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		maxIdle, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid max_idle value: %v", err)
+		}
+		c.MaxIdle = maxIdle
+	case "max_cap":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		maxCap, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid max_cap value: %v", err)
+		}
+		c.MaxCap = maxCap
+	case "idle_timeout":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid idle_timeout value: %v", err)
+		}
+		c.IdleTimeout = dur
+	case "health_fail_duration":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid health_fail_duration value: %v", err)
+		}
+		c.HealthFailDuration = caddy.Duration(dur)
+	case "health_max_fails":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		maxFails, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid health_max_fails value: %v", err)
+		}
+		c.HealthMaxFails = maxFails
+	case "slow_start":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid slow_start value: %v", err)
+		}
+		c.SlowStart = caddy.Duration(dur)
+	case "circuit_breaker":
+		cb, err := unmarshalCircuitBreaker(d)
+		if err != nil {
+			return true, err
+		}
+		c.CircuitBreaker = cb
+	case "health_interval", "health_timeout":
+		name := d.Val()
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("invalid %s value: %v", name, err)
+		}
+		if name == "health_interval" {
+			c.HealthInterval = caddy.Duration(dur)
+		} else {
+			c.HealthTimeout = caddy.Duration(dur)
+		}
+	case "health_uri":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.HealthURI = d.Val()
+	case "health_malicious_uri":
+		if !d.NextArg() {
+			return true, d.ArgErr()
+		}
+		c.HealthMaliciousURI = d.Val()
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// unmarshalEngineAddrList replaces addrs, and their weights, with the
+// addresses of a waf_engine_addr or backup_engine_addr subdirective:
+//
+//	waf_engine_addr <address> [weight=<n>] ... {
+//	    <address> [weight=<n>]
+//	}
+func (c *EngineGroup) unmarshalEngineAddrList(d *caddyfile.Dispenser, addrs *[]string) error {
+	for _, addr := range *addrs {
+		delete(c.Weights, addr)
+	}
+	*addrs = nil
+	if err := c.unmarshalEngineAddrs(d, addrs, d.RemainingArgs()); err != nil {
+		return err
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if err := c.unmarshalEngineAddrs(d, addrs, append([]string{d.Val()}, d.RemainingArgs()...)); err != nil {
+			return err
+		}
+	}
+	if len(*addrs) == 0 {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// unmarshalEngineAddrs adds engine addresses to addrs, each optionally
+// followed by weight=<n>.
+func (c *EngineGroup) unmarshalEngineAddrs(d *caddyfile.Dispenser, addrs *[]string, args []string) error {
+	for _, arg := range args {
+		if value, ok := strings.CutPrefix(arg, "weight="); ok {
+			if len(*addrs) == 0 {
+				return d.Errf("%s must follow an engine address", arg)
+			}
+			weight, err := strconv.Atoi(value)
+			if err != nil || weight < 1 {
+				return d.Errf("invalid weight %q, expected an integer >= 1", value)
+			}
+			if c.Weights == nil {
+				c.Weights = make(map[string]int)
+			}
+			c.Weights[(*addrs)[len(*addrs)-1]] = weight
+			continue
+		}
+		if _, err := parseEngineAddr(arg); err != nil {
+			return d.Errf("invalid engine address %q: %v", arg, err)
 		}
+		*addrs = append(*addrs, arg)
 	}
 	return nil
 }
 
+// unmarshalCircuitBreaker parses a circuit_breaker block:
+//
+//	circuit_breaker {
+//	    consecutive_failures <n>
+//	    error_ratio <0..1>
+//	    min_requests <n>
+//	    window <duration>
+//	    open_duration <duration>
+//	    half_open_requests <n>
+//	}
+func unmarshalCircuitBreaker(d *caddyfile.Dispenser) (*CircuitBreaker, error) {
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	cb := new(CircuitBreaker)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		val := d.Val()
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch name {
+		case "consecutive_failures", "min_requests", "half_open_requests":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, d.Errf("invalid %s value: %v", name, err)
+			}
+			switch name {
+			case "consecutive_failures":
+				cb.ConsecutiveFailures = n
+			case "min_requests":
+				cb.MinRequests = n
+			default:
+				cb.HalfOpenRequests = n
+			}
+		case "error_ratio":
+			ratio, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, d.Errf("invalid error_ratio value: %v", err)
+			}
+			cb.ErrorRatio = ratio
+		case "window", "open_duration":
+			dur, err := caddy.ParseDuration(val)
+			if err != nil {
+				return nil, d.Errf("invalid %s value: %v", name, err)
+			}
+			if name == "window" {
+				cb.Window = caddy.Duration(dur)
+			} else {
+				cb.OpenDuration = caddy.Duration(dur)
+			}
+		default:
+			return nil, d.Errf("unrecognized circuit_breaker subdirective %s", name)
+		}
+	}
+	return cb, nil
+}
+
+// unmarshalBlockResponse parses a block_response or fail_response block:
+//
+//	block_response [<status>] {
+//	    status <code>
+//	    template <html|json|text> <body>
+//	    template_file <html|json|text> <path>
+//	}
+func unmarshalBlockResponse(d *caddyfile.Dispenser) (*BlockResponse, error) {
+	resp := new(BlockResponse)
+	if d.NextArg() {
+		code, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return nil, d.Errf("invalid status code %q: %v", d.Val(), err)
+		}
+		resp.StatusCode = code
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "status":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			code, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid status code %q: %v", d.Val(), err)
+			}
+			resp.StatusCode = code
+		case "template", "template_file":
+			directive := d.Val()
+			args := d.RemainingArgs()
+			if len(args) != 2 {
+				return nil, d.ArgErr()
+			}
+			format, value := args[0], args[1]
+			if _, ok := formatContentTypes[format]; !ok {
+				return nil, d.Errf("unrecognized response format %q, expected %s, %s or %s", format, formatHTML, formatJSON, formatText)
+			}
+			if directive == "template" {
+				if resp.Templates == nil {
+					resp.Templates = make(map[string]string)
+				}
+				resp.Templates[format] = value
+			} else {
+				if resp.TemplateFiles == nil {
+					resp.TemplateFiles = make(map[string]string)
+				}
+				resp.TemplateFiles[format] = value
+			}
+		default:
+			return nil, d.Errf("unrecognized response subdirective %s", d.Val())
+		}
+	}
+	return resp, nil
+}
+
 // parseCaddyfileHandler unmarshals tokens from h into a new middleware handler value.
 // syntax:
 //
 //	waf_chaitin {
-//	    waf_engine_addr 169.254.0.5:8000 169.254.0.6:8000 169.254.0.7:8000
+//	    waf_engine_addr 169.254.0.5:8000 safeline-detector.waf.svc:8000 unix//run/safeline/detector.sock
+//		upstreams srv _t1k._tcp.safeline.waf.svc
+//		backup_engine_addr 127.0.0.1:8000
 //		initial_cap 1
 //		max_idle 16
 //		max_cap 32
 //		idle_timeout 30s
+//		mode monitor
+//		skip path /static/* /healthz
+//		deny_ips 203.0.113.0/24 {
+//		    file /etc/caddy/denied_ips.txt
+//		}
+//	}
+//
+// or, using an engine group of the waf_chaitin global option:
+//
+//	waf_chaitin {
+//	    engine_group default
 //	}
 func parseCaddyfileHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var m CaddyWAF
@@ -1,8 +1,12 @@
 package caddy_waf_t1k
 
 import (
+	"maps"
+	"slices"
 	"testing"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 )
 
@@ -86,3 +90,494 @@ func TestUnmarshalCaddyfileMaxBodySizeInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestUnmarshalCaddyfileMode(t *testing.T) {
+	input := `waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000
+		mode monitor
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.Mode != modeMonitor {
+		t.Fatalf("Mode = %q, want %q", m.Mode, modeMonitor)
+	}
+
+	d = caddyfile.NewTestDispenser("waf_chaitin {\n\twaf_engine_addr 192.0.2.1:8000\n\tmode bypass\n}")
+	m = CaddyWAF{}
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.Mode != modeBypass {
+		t.Fatalf("Mode = %q, want %q", m.Mode, modeBypass)
+	}
+}
+
+func TestUnmarshalCaddyfileModeInvalid(t *testing.T) {
+	input := `waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000
+		mode observe
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
+
+func TestUnmarshalCaddyfileName(t *testing.T) {
+	d := caddyfile.NewTestDispenser("waf_chaitin {\n\twaf_engine_addr 192.0.2.1:8000\n\tname shop\n}")
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.Name != "shop" {
+		t.Fatalf("Name = %q, want shop", m.Name)
+	}
+
+	for _, input := range []string{"waf_chaitin {\n\tname\n}", "waf_chaitin {\n\tname shop api\n}"} {
+		m = CaddyWAF{}
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileBlockResponse(t *testing.T) {
+	input := `waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000
+		block_response 451 {
+			template json "{\"id\":{{json .EventID}}}"
+			template_file html /etc/caddy/blocked.html
+		}
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.BlockResponse == nil {
+		t.Fatal("BlockResponse is nil")
+	}
+	if m.BlockResponse.StatusCode != 451 {
+		t.Errorf("StatusCode = %d, want 451", m.BlockResponse.StatusCode)
+	}
+	if got := m.BlockResponse.Templates[formatJSON]; got != `{"id":{{json .EventID}}}` {
+		t.Errorf("json template = %q", got)
+	}
+	if got := m.BlockResponse.TemplateFiles[formatHTML]; got != "/etc/caddy/blocked.html" {
+		t.Errorf("html template file = %q", got)
+	}
+}
+
+func TestUnmarshalCaddyfileBlockResponseInvalid(t *testing.T) {
+	for _, block := range []string{
+		"block_response forbidden",
+		"block_response {\n\t\ttemplate xml \"<x/>\"\n\t}",
+		"block_response {\n\t\ttemplate html\n\t}",
+		"block_response {\n\t\tbody foo\n\t}",
+	} {
+		input := "waf_chaitin {\n\twaf_engine_addr 192.0.2.1:8000\n\t" + block + "\n}"
+		d := caddyfile.NewTestDispenser(input)
+		var m CaddyWAF
+		if err := m.UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected error for %q", block)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileBlockAction(t *testing.T) {
+	input := `waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000
+		block_action error
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.BlockAction != blockActionError {
+		t.Fatalf("BlockAction = %q, want %q", m.BlockAction, blockActionError)
+	}
+
+	d = caddyfile.NewTestDispenser("waf_chaitin {\n\tblock_action redirect\n}")
+	if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+		t.Fatal("expected error for unknown block_action")
+	}
+}
+
+func TestUnmarshalCaddyfileDetectTimeouts(t *testing.T) {
+	input := `waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000
+		detect_timeout 200ms
+		detect_budget 1s
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.DetectTimeout != caddy.Duration(200*time.Millisecond) {
+		t.Errorf("DetectTimeout = %v, want 200ms", time.Duration(m.DetectTimeout))
+	}
+	if m.DetectBudget != caddy.Duration(time.Second) {
+		t.Errorf("DetectBudget = %v, want 1s", time.Duration(m.DetectBudget))
+	}
+
+	d = caddyfile.NewTestDispenser("waf_chaitin {\n\tdetect_timeout soon\n}")
+	if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+		t.Fatal("expected error for invalid detect_timeout")
+	}
+}
+
+func TestUnmarshalCaddyfileFailMode(t *testing.T) {
+	input := `waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000
+		fail_mode closed
+		fail_response 503 {
+			template text "try again later"
+		}
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.FailMode != failModeClosed {
+		t.Errorf("FailMode = %q, want %q", m.FailMode, failModeClosed)
+	}
+	if m.FailResponse == nil || m.FailResponse.StatusCode != 503 || m.FailResponse.Templates[formatText] != "try again later" {
+		t.Errorf("FailResponse = %+v", m.FailResponse)
+	}
+
+	d = caddyfile.NewTestDispenser("waf_chaitin {\n\tfail_mode ajar\n}")
+	if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+		t.Fatal("expected error for unknown fail_mode")
+	}
+}
+
+func TestUnmarshalCaddyfileActiveHealthChecks(t *testing.T) {
+	input := `waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000
+		health_interval 10s
+		health_timeout 2s
+		health_uri /healthz
+		health_malicious_uri "/?id=1%27%20OR%201=1--"
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.HealthInterval != caddy.Duration(10*time.Second) || m.HealthTimeout != caddy.Duration(2*time.Second) {
+		t.Errorf("HealthInterval = %v, HealthTimeout = %v", time.Duration(m.HealthInterval), time.Duration(m.HealthTimeout))
+	}
+	if m.HealthURI != "/healthz" || m.HealthMaliciousURI != "/?id=1%27%20OR%201=1--" {
+		t.Errorf("HealthURI = %q, HealthMaliciousURI = %q", m.HealthURI, m.HealthMaliciousURI)
+	}
+}
+
+func TestUnmarshalCaddyfileEngineAddrs(t *testing.T) {
+	input := `waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000 detector.waf.svc:8000 unix//run/safeline/detector.sock
+		resolve_interval 15s
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if len(m.WafEngineAddrs) != 3 {
+		t.Errorf("WafEngineAddrs = %v, want 3 addresses", m.WafEngineAddrs)
+	}
+	if m.ResolveInterval != caddy.Duration(15*time.Second) {
+		t.Errorf("ResolveInterval = %v, want 15s", time.Duration(m.ResolveInterval))
+	}
+
+	for _, addr := range []string{"192.0.2.1", "detector.waf.svc", "udp/192.0.2.1:8000", "192.0.2.1:http"} {
+		d := caddyfile.NewTestDispenser("waf_chaitin {\n\twaf_engine_addr " + addr + "\n}")
+		if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected error for engine address %q", addr)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileEngineWeights(t *testing.T) {
+	input := `waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000 weight=3 192.0.2.2:8000 {
+			192.0.2.3:8000 weight=2
+			detector.waf.svc:8000
+		}
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	wantAddrs := []string{"192.0.2.1:8000", "192.0.2.2:8000", "192.0.2.3:8000", "detector.waf.svc:8000"}
+	if !slices.Equal(m.WafEngineAddrs, wantAddrs) {
+		t.Errorf("WafEngineAddrs = %v, want %v", m.WafEngineAddrs, wantAddrs)
+	}
+	wantWeights := map[string]int{"192.0.2.1:8000": 3, "192.0.2.3:8000": 2}
+	if !maps.Equal(m.Weights, wantWeights) {
+		t.Errorf("Weights = %v, want %v", m.Weights, wantWeights)
+	}
+
+	for _, args := range []string{"weight=2 192.0.2.1:8000", "192.0.2.1:8000 weight=0", "192.0.2.1:8000 weight=x", "{\n}"} {
+		d := caddyfile.NewTestDispenser("waf_chaitin {\n\twaf_engine_addr " + args + "\n}")
+		if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected error for waf_engine_addr %q", args)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileHashPolicies(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"lb_policy ip_hash", `{"policy":"ip_hash"}`},
+		{"lb_policy uri_hash", `{"policy":"uri_hash"}`},
+		{"lb_policy header X-User-ID", `{"field":"X-User-ID","policy":"header"}`},
+		{"lb_policy cookie sid {\nfallback round_robin\n}", `{"fallback":{"policy":"round_robin"},"name":"sid","policy":"cookie"}`},
+	}
+	for _, tt := range tests {
+		d := caddyfile.NewTestDispenser("waf_chaitin {\n" + tt.input + "\n}")
+		var m CaddyWAF
+		if err := m.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("%q: UnmarshalCaddyfile: %v", tt.input, err)
+		}
+		if got := string(m.LoadBalancing.SelectionPolicyRaw); got != tt.want {
+			t.Errorf("%q: SelectionPolicyRaw = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+
+	for _, input := range []string{"lb_policy header", "lb_policy cookie a b", "lb_policy ip_hash x", "lb_policy header X {\nfallback nope\n}"} {
+		d := caddyfile.NewTestDispenser("waf_chaitin {\n" + input + "\n}")
+		if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileBackupEngines(t *testing.T) {
+	input := `waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000 weight=3
+		backup_engine_addr 127.0.0.1:8000 weight=2 {
+			unix//run/safeline/detector.sock
+		}
+		lb_policy first
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if want := []string{"127.0.0.1:8000", "unix//run/safeline/detector.sock"}; !slices.Equal(m.BackupEngineAddrs, want) {
+		t.Errorf("BackupEngineAddrs = %v, want %v", m.BackupEngineAddrs, want)
+	}
+	if want := map[string]int{"192.0.2.1:8000": 3, "127.0.0.1:8000": 2}; !maps.Equal(m.Weights, want) {
+		t.Errorf("Weights = %v, want %v", m.Weights, want)
+	}
+	if got, want := string(m.LoadBalancing.SelectionPolicyRaw), `{"policy":"first"}`; got != want {
+		t.Errorf("SelectionPolicyRaw = %s, want %s", got, want)
+	}
+
+	d = caddyfile.NewTestDispenser("waf_chaitin {\n\tbackup_engine_addr\n}")
+	if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+		t.Error("expected error for backup_engine_addr without addresses")
+	}
+}
+
+func TestUnmarshalCaddyfileCircuitBreaker(t *testing.T) {
+	input := `waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000
+		circuit_breaker {
+			consecutive_failures 5
+			error_ratio 0.5
+			min_requests 10
+			window 20s
+			open_duration 1m
+			half_open_requests 3
+		}
+	}`
+	d := caddyfile.NewTestDispenser(input)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	want := CircuitBreaker{
+		ConsecutiveFailures: 5,
+		ErrorRatio:          0.5,
+		MinRequests:         10,
+		Window:              caddy.Duration(20 * time.Second),
+		OpenDuration:        caddy.Duration(time.Minute),
+		HalfOpenRequests:    3,
+	}
+	if m.CircuitBreaker == nil || *m.CircuitBreaker != want {
+		t.Errorf("CircuitBreaker = %+v, want %+v", m.CircuitBreaker, want)
+	}
+
+	for _, block := range []string{"circuit_breaker x", "circuit_breaker {\nerror_ratio\n}", "circuit_breaker {\nerror_ratio half\n}", "circuit_breaker {\nwindow 1s 2s\n}", "circuit_breaker {\nbogus 1\n}"} {
+		d := caddyfile.NewTestDispenser("waf_chaitin {\n" + block + "\n}")
+		if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected error for %q", block)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileSlowStart(t *testing.T) {
+	d := caddyfile.NewTestDispenser("waf_chaitin {\n\twaf_engine_addr 192.0.2.1:8000\n\tslow_start 30s\n}")
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.SlowStart != caddy.Duration(30*time.Second) {
+		t.Errorf("SlowStart = %v, want 30s", time.Duration(m.SlowStart))
+	}
+	for _, input := range []string{"slow_start", "slow_start soon"} {
+		d := caddyfile.NewTestDispenser("waf_chaitin {\n" + input + "\n}")
+		if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileSkip(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000
+		skip path /static/* /healthz
+		skip {
+			method GET
+			header X-Internal 1
+		}
+	}`)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if len(m.SkipRaw) != 2 {
+		t.Fatalf("SkipRaw = %v, want 2 matcher sets", m.SkipRaw)
+	}
+	if got := string(m.SkipRaw[0]["path"]); got != `["/static/*","/healthz"]` {
+		t.Errorf("path matcher = %s", got)
+	}
+	if got := slices.Sorted(maps.Keys(m.SkipRaw[1])); !slices.Equal(got, []string{"header", "method"}) {
+		t.Errorf("second matcher set = %v, want header and method", got)
+	}
+	for _, input := range []string{"skip", "skip nonexistent_matcher foo"} {
+		d := caddyfile.NewTestDispenser("waf_chaitin {\n" + input + "\n}")
+		if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileIPLists(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000
+		allow_ips 10.0.0.0/8 private_ranges
+		allow_ips 192.0.2.7
+		deny_ips {
+			ranges 203.0.113.0/24
+			file /etc/caddy/denied_ips.txt
+			watch_interval 5s
+		}
+	}`)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.AllowIPs == nil || !slices.Equal(m.AllowIPs.Ranges, []string{"10.0.0.0/8", "private_ranges", "192.0.2.7"}) {
+		t.Errorf("AllowIPs = %+v", m.AllowIPs)
+	}
+	if m.DenyIPs == nil || !slices.Equal(m.DenyIPs.Ranges, []string{"203.0.113.0/24"}) ||
+		m.DenyIPs.File != "/etc/caddy/denied_ips.txt" || m.DenyIPs.WatchInterval != caddy.Duration(5*time.Second) {
+		t.Errorf("DenyIPs = %+v", m.DenyIPs)
+	}
+	for _, input := range []string{
+		"allow_ips",
+		"allow_ips 10.0.0.0/33",
+		"deny_ips {\nfile\n}",
+		"deny_ips {\nfile a.txt\nfile b.txt\n}",
+		"deny_ips {\ncolor red\n}",
+	} {
+		d := caddyfile.NewTestDispenser("waf_chaitin {\n" + input + "\n}")
+		if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileBans(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000
+		ban_threshold 20
+		ban_window 30s
+		ban_duration 1h
+		ban_key {http.request.header.X-Api-Key}
+		ban_sync_interval 10s
+	}`)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	if m.BanThreshold != 20 || m.BanWindow != caddy.Duration(30*time.Second) ||
+		m.BanDuration != caddy.Duration(time.Hour) || m.BanKey != "{http.request.header.X-Api-Key}" {
+		t.Errorf("bans = %d, %v, %v, %q", m.BanThreshold, time.Duration(m.BanWindow), time.Duration(m.BanDuration), m.BanKey)
+	}
+	if m.BanSyncInterval != caddy.Duration(10*time.Second) {
+		t.Errorf("BanSyncInterval = %v, want 10s", time.Duration(m.BanSyncInterval))
+	}
+	for _, input := range []string{"ban_threshold", "ban_threshold -1", "ban_threshold 101", "ban_threshold many", "ban_window -1s", "ban_duration forever", "ban_key a b", "ban_sync_interval"} {
+		d := caddyfile.NewTestDispenser("waf_chaitin {\n" + input + "\n}")
+		if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileVerdictCache(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`waf_chaitin {
+		waf_engine_addr 192.0.2.1:8000
+		verdict_cache {
+			max_entries 500
+			ttl 30s
+			methods GET POST
+			headers Authorization Accept
+			max_body_size 16KiB
+			shared_across_clients
+		}
+	}`)
+	var m CaddyWAF
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %v", err)
+	}
+	c := m.VerdictCache
+	if c == nil || c.MaxEntries != 500 || c.TTL != caddy.Duration(30*time.Second) || c.MaxBodySize != 16*1024 || !c.SharedAcrossClients ||
+		!slices.Equal(c.Methods, []string{"GET", "POST"}) || !slices.Equal(c.Headers, []string{"Authorization", "Accept"}) {
+		t.Errorf("VerdictCache = %+v", c)
+	}
+
+	d = caddyfile.NewTestDispenser("waf_chaitin {\nverdict_cache\n}")
+	m = CaddyWAF{}
+	if err := m.UnmarshalCaddyfile(d); err != nil || m.VerdictCache == nil {
+		t.Errorf("verdict_cache without options: %+v, %v", m.VerdictCache, err)
+	}
+	for _, input := range []string{
+		"verdict_cache on",
+		"verdict_cache {\nmax_entries 0\n}",
+		"verdict_cache {\nttl 0s\n}",
+		"verdict_cache {\nmethods\n}",
+		"verdict_cache {\nmax_body_size lots\n}",
+		"verdict_cache {\nsize 5\n}",
+		"verdict_cache {\nshared_across_clients yes\n}",
+	} {
+		d := caddyfile.NewTestDispenser("waf_chaitin {\n" + input + "\n}")
+		if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package caddy_waf_t1k
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const (
+	defaultCircuitMinRequests  = 20
+	defaultCircuitWindow       = 10 * time.Second
+	defaultCircuitOpenDuration = 30 * time.Second
+
+	// circuitBuckets is the number of buckets of the error ratio window.
+	circuitBuckets = 10
+)
+
+// CircuitBreaker configures a circuit breaker per engine. A closed circuit
+// passes all detections. It opens after ConsecutiveFailures failed
+// detections in a row, or once at least MinRequests detections in Window
+// failed at ErrorRatio or more. An open circuit takes the engine out of
+// selection for OpenDuration; then it is half-open and admits
+// HalfOpenRequests trial detections. The circuit closes when all of them
+// succeed and opens again on the first failure.
+//
+// Failures are the engine errors and timeouts counted by the passive health
+// check. A group with a circuit breaker ignores HealthMaxFails.
+type CircuitBreaker struct {
+	// ConsecutiveFailures opens the circuit after this many failed
+	// detections in a row. 0 disables the threshold.
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"`
+	// ErrorRatio, between 0 and 1, opens the circuit when this share of the
+	// detections in Window failed. 0 disables the threshold.
+	ErrorRatio float64 `json:"error_ratio,omitempty"`
+	// MinRequests is how many detections Window must hold before ErrorRatio
+	// applies. Default 20.
+	MinRequests int `json:"min_requests,omitempty"`
+	// Window is the sliding window of ErrorRatio. Default 10s.
+	Window caddy.Duration `json:"window,omitempty"`
+	// OpenDuration is how long an open circuit stays open. Default 30s.
+	OpenDuration caddy.Duration `json:"open_duration,omitempty"`
+	// HalfOpenRequests is how many trial detections a half-open circuit
+	// admits. Default 1.
+	HalfOpenRequests int `json:"half_open_requests,omitempty"`
+}
+
+func (c *CircuitBreaker) validate() error {
+	if c.ConsecutiveFailures == 0 && c.ErrorRatio == 0 {
+		return fmt.Errorf("circuit_breaker needs consecutive_failures or error_ratio")
+	}
+	if c.ConsecutiveFailures < 0 || c.MinRequests < 0 || c.HalfOpenRequests < 0 {
+		return fmt.Errorf("circuit_breaker counts must be >= 0")
+	}
+	if c.ErrorRatio < 0 || c.ErrorRatio > 1 {
+		return fmt.Errorf("circuit_breaker error_ratio must be between 0 and 1")
+	}
+	if c.Window < 0 || c.OpenDuration < 0 {
+		return fmt.Errorf("circuit_breaker window and open_duration must be >= 0")
+	}
+	return nil
+}
+
+// circuitState is the state of an engine's circuit breaker.
+type circuitState int32
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+// circuitBucket counts the detections of one slice of the error ratio
+// window.
+type circuitBucket struct {
+	slot     int64 // time slot the counts belong to
+	requests int
+	failures int
+}
+
+// circuitBreaker is the circuit breaker of one engine.
+type circuitBreaker struct {
+	cfg CircuitBreaker // with defaults applied
+	now func() time.Time
+	// onChange, if set, is called with the breaker locked after each state
+	// transition.
+	onChange func(from, to circuitState)
+
+	state atomic.Int32 // circuitState; read without mu on the fast path
+
+	mu          sync.Mutex
+	consecutive int
+	buckets     [circuitBuckets]circuitBucket
+	openedAt    time.Time
+	trials      int // trial detections admitted while half-open
+	successes   int // successful trial detections while half-open
+}
+
+func newCircuitBreaker(cfg CircuitBreaker, onChange func(from, to circuitState)) *circuitBreaker {
+	if cfg.MinRequests == 0 {
+		cfg.MinRequests = defaultCircuitMinRequests
+	}
+	if cfg.Window == 0 {
+		cfg.Window = caddy.Duration(defaultCircuitWindow)
+	}
+	if cfg.OpenDuration == 0 {
+		cfg.OpenDuration = caddy.Duration(defaultCircuitOpenDuration)
+	}
+	if cfg.HalfOpenRequests == 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	return &circuitBreaker{cfg: cfg, now: time.Now, onChange: onChange}
+}
+
+// currentState returns the breaker's state, moving an open circuit whose
+// OpenDuration elapsed to half-open.
+func (b *circuitBreaker) currentState() circuitState {
+	state := circuitState(b.state.Load())
+	if state != circuitOpen {
+		return state
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.halfOpenIfDue()
+	return circuitState(b.state.Load())
+}
+
+// available reports whether the breaker would admit a detection.
+func (b *circuitBreaker) available() bool {
+	switch b.currentState() {
+	case circuitClosed:
+		return true
+	case circuitHalfOpen:
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return circuitState(b.state.Load()) != circuitHalfOpen || b.trials < b.cfg.HalfOpenRequests
+	}
+	return false
+}
+
+// allow admits a detection. While half-open it takes one of the trial
+// slots; the caller must report the outcome with record or cancel.
+func (b *circuitBreaker) allow() bool {
+	if circuitState(b.state.Load()) == circuitClosed {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.halfOpenIfDue()
+	switch circuitState(b.state.Load()) {
+	case circuitClosed:
+		return true
+	case circuitHalfOpen:
+		if b.trials < b.cfg.HalfOpenRequests {
+			b.trials++
+			return true
+		}
+	}
+	return false
+}
+
+// record reports the outcome of an admitted detection.
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch circuitState(b.state.Load()) {
+	case circuitClosed:
+		if failed {
+			b.consecutive++
+		} else {
+			b.consecutive = 0
+		}
+		requests, failures := b.count(failed)
+		if (b.cfg.ConsecutiveFailures > 0 && b.consecutive >= b.cfg.ConsecutiveFailures) ||
+			(b.cfg.ErrorRatio > 0 && requests >= b.cfg.MinRequests &&
+				float64(failures) >= b.cfg.ErrorRatio*float64(requests)) {
+			b.open()
+		}
+	case circuitHalfOpen:
+		if failed {
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			b.setState(circuitClosed)
+		}
+	}
+	// Outcomes arriving while open are from detections admitted before
+	// the circuit opened.
+}
+
+// cancel returns an admitted detection's trial slot without an outcome,
+// e.g. when the client went away.
+func (b *circuitBreaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if circuitState(b.state.Load()) == circuitHalfOpen && b.trials > b.successes {
+		b.trials--
+	}
+}
+
+// reset closes the circuit and forgets its history.
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.setState(circuitClosed)
+	b.consecutive = 0
+	b.buckets = [circuitBuckets]circuitBucket{}
+}
+
+// count adds a detection to the error ratio window and returns the window's
+// totals.
+func (b *circuitBreaker) count(failed bool) (requests, failures int) {
+	width := int64(b.cfg.Window) / circuitBuckets
+	if width < 1 {
+		width = 1
+	}
+	slot := b.now().UnixNano() / width
+	bucket := &b.buckets[slot%circuitBuckets]
+	if bucket.slot != slot {
+		*bucket = circuitBucket{slot: slot}
+	}
+	bucket.requests++
+	if failed {
+		bucket.failures++
+	}
+	for _, bk := range b.buckets {
+		if slot-bk.slot < circuitBuckets {
+			requests += bk.requests
+			failures += bk.failures
+		}
+	}
+	return requests, failures
+}
+
+// open opens the circuit. The caller holds mu.
+func (b *circuitBreaker) open() {
+	b.openedAt = b.now()
+	b.setState(circuitOpen)
+}
+
+// halfOpenIfDue moves an open circuit whose OpenDuration elapsed to
+// half-open. The caller holds mu.
+func (b *circuitBreaker) halfOpenIfDue() {
+	if circuitState(b.state.Load()) == circuitOpen && b.now().Sub(b.openedAt) >= time.Duration(b.cfg.OpenDuration) {
+		b.setState(circuitHalfOpen)
+	}
+}
+
+// setState transitions the circuit and resets the counters of the new
+// state. The caller holds mu.
+func (b *circuitBreaker) setState(to circuitState) {
+	from := circuitState(b.state.Swap(int32(to)))
+	b.trials, b.successes = 0, 0
+	if to == circuitClosed {
+		b.consecutive = 0
+		b.buckets = [circuitBuckets]circuitBucket{}
+	}
+	if from != to && b.onChange != nil {
+		b.onChange(from, to)
+	}
+}
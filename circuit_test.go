@@ -0,0 +1,168 @@
+package caddy_waf_t1k
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestBreaker(cfg CircuitBreaker) (*circuitBreaker, *fakeClock, *[]circuitState) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	var changes []circuitState
+	b := newCircuitBreaker(cfg, func(_, to circuitState) { changes = append(changes, to) })
+	b.now = clock.now
+	return b, clock, &changes
+}
+
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	b, _, _ := newTestBreaker(CircuitBreaker{ConsecutiveFailures: 3})
+	for _, failed := range []bool{true, true, false, true, true} {
+		b.record(failed)
+	}
+	if got := b.currentState(); got != circuitClosed {
+		t.Fatalf("state = %s after interrupted failures, want closed", got)
+	}
+	b.record(true)
+	if got := b.currentState(); got != circuitOpen {
+		t.Fatalf("state = %s after 3 consecutive failures, want open", got)
+	}
+	if b.available() || b.allow() {
+		t.Error("open circuit admitted a detection")
+	}
+}
+
+func TestCircuitBreakerErrorRatio(t *testing.T) {
+	b, clock, _ := newTestBreaker(CircuitBreaker{ErrorRatio: 0.5, MinRequests: 4, Window: caddy.Duration(10 * time.Second)})
+	b.record(true)
+	b.record(true)
+	b.record(true)
+	if got := b.currentState(); got != circuitClosed {
+		t.Fatalf("state = %s below min_requests, want closed", got)
+	}
+
+	// The failures slide out of the window before enough requests arrive.
+	clock.advance(11 * time.Second)
+	for range 3 {
+		b.record(false)
+	}
+	b.record(true)
+	if got := b.currentState(); got != circuitClosed {
+		t.Fatalf("state = %s at 1/4 errors, want closed", got)
+	}
+	b.record(true)
+	b.record(true)
+	if got := b.currentState(); got != circuitOpen {
+		t.Fatalf("state = %s at 3/6 errors, want open", got)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	b, clock, changes := newTestBreaker(CircuitBreaker{
+		ConsecutiveFailures: 1,
+		OpenDuration:        caddy.Duration(30 * time.Second),
+		HalfOpenRequests:    2,
+	})
+	b.record(true)
+	clock.advance(29 * time.Second)
+	if b.available() {
+		t.Fatal("circuit available before open_duration elapsed")
+	}
+	clock.advance(time.Second)
+	if got := b.currentState(); got != circuitHalfOpen {
+		t.Fatalf("state = %s after open_duration, want half_open", got)
+	}
+
+	// Only two trials are admitted at a time.
+	if !b.allow() || !b.allow() {
+		t.Fatal("half-open circuit rejected a trial")
+	}
+	if b.available() || b.allow() {
+		t.Fatal("half-open circuit admitted more than half_open_requests trials")
+	}
+	b.cancel()
+	if !b.allow() {
+		t.Fatal("cancelled trial slot was not returned")
+	}
+
+	b.record(false)
+	if got := b.currentState(); got != circuitHalfOpen {
+		t.Fatalf("state = %s after one of two trials, want half_open", got)
+	}
+	b.record(false)
+	if got := b.currentState(); got != circuitClosed {
+		t.Fatalf("state = %s after successful trials, want closed", got)
+	}
+
+	// A failed trial reopens the circuit.
+	b.record(true)
+	clock.advance(30 * time.Second)
+	if !b.allow() {
+		t.Fatal("half-open circuit rejected a trial")
+	}
+	b.record(true)
+	if got := b.currentState(); got != circuitOpen {
+		t.Fatalf("state = %s after failed trial, want open", got)
+	}
+
+	want := []circuitState{circuitOpen, circuitHalfOpen, circuitClosed, circuitOpen, circuitHalfOpen, circuitOpen}
+	if !slices.Equal(*changes, want) {
+		t.Errorf("state changes = %v, want %v", *changes, want)
+	}
+}
+
+func TestCircuitBreakerValidate(t *testing.T) {
+	for _, cb := range []CircuitBreaker{
+		{},
+		{ConsecutiveFailures: -1},
+		{ErrorRatio: 1.5},
+		{ConsecutiveFailures: 3, HalfOpenRequests: -1},
+		{ConsecutiveFailures: 3, Window: -1},
+	} {
+		if err := cb.validate(); err == nil {
+			t.Errorf("expected error for %+v", cb)
+		}
+	}
+	if err := (&CircuitBreaker{ErrorRatio: 0.5}).validate(); err != nil {
+		t.Errorf("validate: %v", err)
+	}
+}
+
+func TestEngineAvailableUsesCircuitBreaker(t *testing.T) {
+	b, _, _ := newTestBreaker(CircuitBreaker{ConsecutiveFailures: 2})
+	e := &Engine{maxFails: 1, breaker: b}
+	addFailures(e, 1)
+	if !e.Available() {
+		t.Fatal("engine with a closed circuit is unavailable; max_fails should not apply")
+	}
+	e.recordResult(errors.New("connection refused"))
+	e.recordResult(errors.New("read request body: unexpected EOF"))
+	if !e.Available() {
+		t.Fatal("client error counted as engine failure")
+	}
+	e.recordResult(errDetectTimeout)
+	if e.Available() {
+		t.Fatal("engine available with an open circuit")
+	}
+}
+
+func TestEngineForcedUpDoesNotRecordIntoCircuitBreaker(t *testing.T) {
+	b, _, _ := newTestBreaker(CircuitBreaker{ConsecutiveFailures: 1})
+	e := &Engine{breaker: b}
+	e.admin.Store(adminUp)
+	e.recordResult(errDetectTimeout)
+	e.admin.Store(adminAuto)
+	if !e.Available() {
+		t.Fatal("engine unavailable after clearing the up override")
+	}
+	if got := b.currentState(); got != circuitClosed {
+		t.Fatalf("circuit = %v, want closed", got)
+	}
+}
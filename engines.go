@@ -0,0 +1,679 @@
+package caddy_waf_t1k
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/chaitin/t1k-go"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// defaultResolveInterval is how often hostname engine addresses are
+	// re-resolved when resolve_interval is not set.
+	defaultResolveInterval = 30 * time.Second
+
+	// engineRefreshMinInterval is the minimum time between the refreshes
+	// requests trigger when they find no engine available.
+	engineRefreshMinInterval = 5 * time.Second
+
+	// engineRetireDelay is how long a removed engine's pool stays open so
+	// in-flight detections can finish.
+	engineRetireDelay = 30 * time.Second
+)
+
+// engineAddr is a parsed waf_engine_addr entry: "host:port", "tcp/host:port"
+// or "unix//path/to/socket", following caddy.ParseNetworkAddress.
+type engineAddr struct {
+	network string
+	host    string
+	port    string
+	weight  int  // from EngineGroup.Weights; 0 means 1
+	backup  bool // from EngineGroup.BackupEngineAddrs
+}
+
+func parseEngineAddr(addr string) (engineAddr, error) {
+	na, err := caddy.ParseNetworkAddress(addr)
+	if err != nil {
+		return engineAddr{}, err
+	}
+	switch {
+	case na.IsUnixNetwork():
+		if na.Network != "unix" {
+			return engineAddr{}, fmt.Errorf("unsupported network %q, expected unix", na.Network)
+		}
+		if na.Host == "" {
+			return engineAddr{}, fmt.Errorf("missing socket path")
+		}
+		return engineAddr{network: "unix", host: na.Host}, nil
+	case na.Network == "tcp":
+		if na.Host == "" {
+			return engineAddr{}, fmt.Errorf("missing host")
+		}
+		if na.StartPort == 0 || na.PortRangeSize() != 1 {
+			return engineAddr{}, fmt.Errorf("expected a single non-zero port")
+		}
+		return engineAddr{network: "tcp", host: na.Host, port: strconv.FormatUint(uint64(na.StartPort), 10)}, nil
+	default:
+		return engineAddr{}, fmt.Errorf("unsupported network %q, expected tcp or unix", na.Network)
+	}
+}
+
+// isHostname reports whether the address must be resolved through DNS.
+func (a engineAddr) isHostname() bool {
+	return a.network == "tcp" && net.ParseIP(a.host) == nil
+}
+
+// String returns the address used as the engine label: "ip:port" or "unix//path".
+func (a engineAddr) String() string {
+	if a.network == "unix" {
+		return "unix/" + a.host
+	}
+	return net.JoinHostPort(a.host, a.port)
+}
+
+// EngineGroup configures a set of engines: their addresses, connection pools
+// and health checks. Handlers configure their own group inline; named groups
+// of the waf_chaitin app are shared by handlers that reference them.
+type EngineGroup struct {
+	// WAF engine addresses: "ip:port", "hostname:port" or "unix//path/to/socket".
+	// Hostnames get one engine per A/AAAA record and are re-resolved every
+	// ResolveInterval.
+	WafEngineAddrs []string `json:"waf_engine_addrs,omitempty"`
+
+	// Weights maps an entry of WafEngineAddrs to its weight for the weighted
+	// selection policies. A hostname's weight applies to each of its
+	// engines. Engines without a weight, including those from Upstreams,
+	// have weight 1.
+	Weights map[string]int `json:"weights,omitempty"`
+
+	// BackupEngineAddrs are engine addresses, in the same forms as
+	// WafEngineAddrs, that are only selected while no other engine is
+	// available. Weights may also be set for them.
+	BackupEngineAddrs []string `json:"backup_engine_addrs,omitempty"`
+
+	// ResolveInterval is how often hostname engine addresses are re-resolved
+	// and the upstream source is queried. Default 30s.
+	ResolveInterval caddy.Duration `json:"resolve_interval,omitempty"`
+
+	// UpstreamsRaw is a module that provides engine addresses dynamically,
+	// in addition to WafEngineAddrs. Engines whose address stays in the set
+	// keep their pool and health state.
+	UpstreamsRaw json.RawMessage `json:"upstreams,omitempty" caddy:"namespace=http.waf_chaitin.upstreams inline_key=source"`
+
+	Upstreams EngineSource `json:"-"`
+
+	InitialCap  int           `json:"initial_cap,omitempty"`
+	MaxIdle     int           `json:"max_idle,omitempty"`
+	MaxCap      int           `json:"max_cap,omitempty"`
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+
+	HealthFailDuration caddy.Duration `json:"health_fail_duration,omitempty"`
+	HealthMaxFails     int            `json:"health_max_fails,omitempty"`
+
+	// CircuitBreaker, if set, gives each engine a circuit breaker that
+	// replaces the HealthMaxFails check.
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty"`
+
+	// SlowStart is how long an engine's share of requests ramps up
+	// linearly after it becomes available again. 0 disables slow start.
+	SlowStart caddy.Duration `json:"slow_start,omitempty"`
+
+	// HealthInterval enables active health checks: every interval a benign
+	// probe request for HealthURI is sent through each engine and must pass.
+	// Engines failing the probe are marked down until a later probe passes.
+	HealthInterval caddy.Duration `json:"health_interval,omitempty"`
+	// HealthTimeout bounds each probe. Default 5s.
+	HealthTimeout caddy.Duration `json:"health_timeout,omitempty"`
+	// HealthURI is the request URI of the benign probe. Default "/".
+	HealthURI string `json:"health_uri,omitempty"`
+	// HealthMaliciousURI, if set, is the request URI of a second probe that
+	// the engine must block, e.g. "/?id=1%27%20OR%201=1--".
+	HealthMaliciousURI string `json:"health_malicious_uri,omitempty"`
+}
+
+// provision applies defaults.
+func (c *EngineGroup) provision(logger *zap.Logger) {
+	if c.InitialCap == 0 {
+		logger.Info("InitialCap is not set, defaulting to 1")
+		c.InitialCap = 1
+	}
+
+	if c.MaxIdle == 0 {
+		logger.Info("MaxIdle is not set, defaulting to 16")
+		c.MaxIdle = 16
+	}
+
+	if c.MaxCap == 0 {
+		logger.Info("MaxCap is not set, defaulting to 32")
+		c.MaxCap = 32
+	}
+
+	if c.IdleTimeout == time.Duration(0)*time.Second {
+		logger.Info("IdleTimeout is not set, defaulting to 30 seconds")
+		c.IdleTimeout = 30 * time.Second
+	}
+
+	if c.HealthMaxFails == 0 {
+		c.HealthMaxFails = 1
+	}
+}
+
+func (c *EngineGroup) validate() error {
+	for _, addr := range c.BackupEngineAddrs {
+		if slices.Contains(c.WafEngineAddrs, addr) {
+			return fmt.Errorf("engine address %q is both a primary and a backup", addr)
+		}
+	}
+	for addr, weight := range c.Weights {
+		if !slices.Contains(c.WafEngineAddrs, addr) && !slices.Contains(c.BackupEngineAddrs, addr) {
+			return fmt.Errorf("weight for unknown engine address %q", addr)
+		}
+		if weight < 1 {
+			return fmt.Errorf("weight of engine address %q must be >= 1", addr)
+		}
+	}
+	if c.CircuitBreaker != nil {
+		if err := c.CircuitBreaker.validate(); err != nil {
+			return err
+		}
+	}
+	if c.SlowStart < 0 {
+		return fmt.Errorf("slow_start must be >= 0")
+	}
+	if c.ResolveInterval < 0 {
+		return fmt.Errorf("resolve_interval must be >= 0")
+	}
+	if c.HealthInterval < 0 || c.HealthTimeout < 0 {
+		return fmt.Errorf("health_interval and health_timeout must be >= 0")
+	}
+	for _, uri := range []string{c.HealthURI, c.HealthMaliciousURI} {
+		if uri == "" {
+			continue
+		}
+		if !strings.HasPrefix(uri, "/") {
+			return fmt.Errorf("health check URI %q must start with /", uri)
+		}
+		if _, err := url.ParseRequestURI(uri); err != nil {
+			return fmt.Errorf("invalid health check URI %q: %v", uri, err)
+		}
+	}
+	return nil
+}
+
+// engineGroup runs the engines of an EngineGroup: it keeps their pools,
+// re-resolves their addresses, and runs health checks and pool metrics
+// until it is destructed.
+type engineGroup struct {
+	cfg        *EngineGroup
+	instanceID string // waf_instance label of the group's metrics
+	logger     *zap.Logger
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	engines  EnginePool
+	mu       sync.RWMutex
+	updateMu sync.Mutex // serializes updateEngines
+	// weightOf returns the configured weight of a dial address, if known.
+	// It is only called from updateEngines.
+	weightOf func(addr string) int
+	// backupOf reports whether a dial address is a backup engine. It is
+	// only called from updateEngines.
+	backupOf func(addr string) bool
+	// newEngineFn, if set, replaces newEngine (tests only).
+	newEngineFn func(addr string) (*Engine, error)
+	// refreshC wakes the resolver when no engine was available; nil if the
+	// engine set cannot change.
+	refreshC chan struct{}
+}
+
+// newEngineGroup returns a group whose background work stops when parent is
+// done or the group is destructed.
+func newEngineGroup(parent context.Context, cfg *EngineGroup, instanceID string, logger *zap.Logger) *engineGroup {
+	ctx, cancel := context.WithCancel(parent)
+	return &engineGroup{
+		cfg:        cfg,
+		instanceID: instanceID,
+		logger:     logger,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// start applies defaults, loads the upstream source, connects the engines and
+// starts address refreshes, pool metrics and active health checks.
+func (g *engineGroup) start(ctx caddy.Context) error {
+	g.cfg.provision(g.logger)
+
+	addrs := make([]engineAddr, 0, len(g.cfg.WafEngineAddrs)+len(g.cfg.BackupEngineAddrs))
+	for _, addr := range g.cfg.WafEngineAddrs {
+		a, err := parseEngineAddr(addr)
+		if err != nil {
+			return fmt.Errorf("invalid engine address %q: %v", addr, err)
+		}
+		a.weight = g.cfg.Weights[addr]
+		addrs = append(addrs, a)
+	}
+	for _, addr := range g.cfg.BackupEngineAddrs {
+		a, err := parseEngineAddr(addr)
+		if err != nil {
+			return fmt.Errorf("invalid backup engine address %q: %v", addr, err)
+		}
+		a.weight = g.cfg.Weights[addr]
+		a.backup = true
+		addrs = append(addrs, a)
+	}
+	if g.cfg.UpstreamsRaw != nil {
+		mod, err := ctx.LoadModule(g.cfg, "UpstreamsRaw")
+		if err != nil {
+			return fmt.Errorf("loading upstream source module: %v", err)
+		}
+		g.cfg.Upstreams = mod.(EngineSource)
+	}
+	resolver := newEngineResolver(addrs, g.cfg.Upstreams)
+	g.weightOf = resolver.weight
+	g.backupOf = resolver.isBackup
+	dialAddrs, err := resolver.resolve(g.ctx)
+	if err != nil {
+		g.logger.Warn("resolving WAF engine addresses", zap.Error(err))
+	}
+	if err := g.updateEngines(dialAddrs); err != nil {
+		return err
+	}
+	if resolver.needsRefresh() {
+		interval := time.Duration(g.cfg.ResolveInterval)
+		if interval == 0 {
+			interval = defaultResolveInterval
+		}
+		g.startResolver(resolver, interval)
+	}
+
+	registerEngineGroup(g)
+	newMetricsPoolUpdater(g).start()
+	if g.cfg.HealthInterval > 0 {
+		newActiveHealthChecker(g).start()
+	}
+	return nil
+}
+
+// Destruct stops the group's background work and releases its engines.
+func (g *engineGroup) Destruct() error {
+	unregisterEngineGroup(g)
+	g.cancel()
+	for _, engine := range g.current() {
+		if engine != nil {
+			engine.removed.Store(true)
+			engine.release()
+			g.deleteEngineMetrics(engine)
+		}
+	}
+	return nil
+}
+
+// newEngine connects a pool to addr, a literal "ip:port" or "unix//path".
+func (g *engineGroup) newEngine(addr string) (*Engine, error) {
+	pc := &t1k.PoolConfig{
+		InitialCap:  g.cfg.InitialCap,
+		MaxIdle:     g.cfg.MaxIdle,
+		MaxCap:      g.cfg.MaxCap,
+		Factory:     engineFactory(addr),
+		IdleTimeout: g.cfg.IdleTimeout,
+	}
+	pool, err := initDetect(pc)
+	if err != nil {
+		return nil, fmt.Errorf("init detect error for %s: %v", addr, err)
+	}
+	e := &Engine{
+		pool:      pool,
+		addr:      addr,
+		maxFails:  g.cfg.HealthMaxFails,
+		slowStart: time.Duration(g.cfg.SlowStart),
+		// Abandoned detections hold pool connections; beyond max_cap they
+		// would only queue for one.
+		maxAbandoned: int64(g.cfg.MaxCap),
+	}
+	if g.cfg.CircuitBreaker != nil {
+		e.breaker = newCircuitBreaker(*g.cfg.CircuitBreaker, g.circuitChanged(addr))
+	}
+	return e, nil
+}
+
+// circuitChanged returns the state change callback of an engine's circuit
+// breaker.
+func (g *engineGroup) circuitChanged(addr string) func(from, to circuitState) {
+	logger := g.logger.With(zap.String("engine", addr))
+	return func(from, to circuitState) {
+		wafMetrics.engineCircuitState.WithLabelValues(addr, g.instanceID).Set(float64(to))
+		logger.Warn("WAF engine circuit state changed",
+			zap.Stringer("from", from),
+			zap.Stringer("to", to))
+	}
+}
+
+// current returns the engines requests are currently balanced over.
+func (g *engineGroup) current() EnginePool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.engines
+}
+
+// currentEngines returns the engines requests are currently balanced over.
+func (m *CaddyWAF) currentEngines() EnginePool {
+	if m.group == nil {
+		return m.Engines
+	}
+	return m.group.current()
+}
+
+// updateEngines replaces the engine set with one engine per address in addrs.
+// Engines whose address remains keep their pool and health state; removed
+// engines are retired. It returns the first error from creating an engine;
+// addresses that fail are left out and retried on the next update.
+func (g *engineGroup) updateEngines(addrs []string) error {
+	g.updateMu.Lock()
+	defer g.updateMu.Unlock()
+
+	current := make(map[string]*Engine)
+	for _, e := range g.current() {
+		current[e.addr] = e
+	}
+
+	var firstErr error
+	next := make(EnginePool, 0, len(addrs))
+	for _, addr := range addrs {
+		if slices.ContainsFunc(next, func(e *Engine) bool { return e.addr == addr }) {
+			continue
+		}
+		if e, ok := current[addr]; ok {
+			next = append(next, e)
+			delete(current, addr)
+			continue
+		}
+		newEngine := g.newEngine
+		if g.newEngineFn != nil {
+			newEngine = g.newEngineFn
+		}
+		e, err := newEngine(addr)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if g.weightOf != nil {
+			e.weight = g.weightOf(addr)
+		}
+		if g.backupOf != nil {
+			e.backup = g.backupOf(addr)
+		}
+		g.logger.Info("WAF engine added", zap.String("engine", addr), zap.Bool("backup", e.backup))
+		next = append(next, e)
+	}
+
+	g.mu.Lock()
+	g.engines = next
+	g.mu.Unlock()
+
+	for _, e := range current {
+		g.logger.Info("WAF engine removed", zap.String("engine", e.addr))
+		g.retireEngine(e)
+	}
+	return firstErr
+}
+
+// retireEngine drops a removed engine's metrics and releases its pool once
+// in-flight detections had time to finish.
+func (g *engineGroup) retireEngine(e *Engine) {
+	e.removed.Store(true)
+	g.deleteEngineMetrics(e)
+	time.AfterFunc(engineRetireDelay, e.release)
+}
+
+func (g *engineGroup) deleteEngineMetrics(e *Engine) {
+	wafMetrics.enginesHealthy.DeleteLabelValues(e.addr, g.instanceID)
+	wafMetrics.poolIdleConns.DeleteLabelValues(e.addr, g.instanceID)
+	wafMetrics.poolActiveConns.DeleteLabelValues(e.addr, g.instanceID)
+	wafMetrics.poolMaxConns.DeleteLabelValues(e.addr, g.instanceID)
+	wafMetrics.poolWaitingReqs.DeleteLabelValues(e.addr, g.instanceID)
+	wafMetrics.engineCircuitState.DeleteLabelValues(e.addr, g.instanceID)
+}
+
+// engineResolver turns the configured engine addresses into dial addresses,
+// resolving hostnames to one address per A/AAAA record, and adds the
+// addresses of the dynamic upstream source, if any.
+type engineResolver struct {
+	addrs   []engineAddr
+	source  EngineSource
+	lookup  func(ctx context.Context, host string) ([]net.IPAddr, error)
+	timeout time.Duration
+	// minRefresh is the minimum time between refreshes requested through
+	// engineGroup.requestRefresh.
+	minRefresh time.Duration
+	previous   map[string][]string // last successful lookup per hostname
+	weights    map[string]int      // configured weight per dial address, from the last resolve
+	backups    map[string]bool     // backup dial addresses, from the last resolve
+
+	sourcePrevious []string // last successful source addresses
+}
+
+func newEngineResolver(addrs []engineAddr, source EngineSource) *engineResolver {
+	return &engineResolver{
+		addrs:      addrs,
+		source:     source,
+		lookup:     net.DefaultResolver.LookupIPAddr,
+		timeout:    10 * time.Second,
+		minRefresh: engineRefreshMinInterval,
+		previous:   make(map[string][]string),
+		weights:    make(map[string]int),
+		backups:    make(map[string]bool),
+	}
+}
+
+// hasHostnames reports whether any address needs periodic re-resolution.
+func (r *engineResolver) hasHostnames() bool {
+	return slices.ContainsFunc(r.addrs, engineAddr.isHostname)
+}
+
+// needsRefresh reports whether the engine set can change after Provision.
+func (r *engineResolver) needsRefresh() bool {
+	return r.source != nil || r.hasHostnames()
+}
+
+// resolve returns the dial addresses for all configured engines. A hostname
+// that fails to resolve keeps its previous addresses; the lookup errors are
+// returned joined.
+func (r *engineResolver) resolve(ctx context.Context) ([]string, error) {
+	var out []string
+	var errs []error
+	clear(r.weights)
+	clear(r.backups)
+	for _, a := range r.addrs {
+		if !a.isHostname() {
+			out = append(out, a.String())
+			r.setAttrs(a, a.String())
+			continue
+		}
+		key := a.String()
+		lookupCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		ips, err := r.lookup(lookupCtx, a.host)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("resolving %s: %v", a.host, err))
+			out = append(out, r.previous[key]...)
+			r.setAttrs(a, r.previous[key]...)
+			continue
+		}
+		resolved := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			resolved = append(resolved, net.JoinHostPort(ip.IP.String(), a.port))
+		}
+		slices.Sort(resolved)
+		r.previous[key] = resolved
+		out = append(out, resolved...)
+		r.setAttrs(a, resolved...)
+	}
+	if r.source != nil {
+		addrs, err := r.sourceAddrs(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("getting upstreams: %v", err))
+			addrs = r.sourcePrevious
+		}
+		r.sourcePrevious = addrs
+		out = append(out, addrs...)
+	}
+	return out, errors.Join(errs...)
+}
+
+func (r *engineResolver) setAttrs(a engineAddr, dialAddrs ...string) {
+	for _, addr := range dialAddrs {
+		if a.weight != 0 {
+			r.weights[addr] = a.weight
+		}
+		if a.backup {
+			r.backups[addr] = true
+		}
+	}
+}
+
+// weight returns the configured weight of a dial address from the last
+// resolve, or 0 if it has none.
+func (r *engineResolver) weight(addr string) int {
+	return r.weights[addr]
+}
+
+// isBackup reports whether a dial address is a backup engine as of the last
+// resolve.
+func (r *engineResolver) isBackup(addr string) bool {
+	return r.backups[addr]
+}
+
+// sourceAddrs gets the dynamic upstream addresses, normalized. Hostnames are
+// rejected: sources must return addresses that can be dialed as-is.
+func (r *engineResolver) sourceAddrs(ctx context.Context) ([]string, error) {
+	sourceCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	addrs, err := r.source.GetEngineAddrs(sourceCtx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		a, err := parseEngineAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid engine address %q: %v", addr, err)
+		}
+		if a.isHostname() {
+			return nil, fmt.Errorf("invalid engine address %q: expected an IP address or unix socket", addr)
+		}
+		out = append(out, a.String())
+	}
+	return out, nil
+}
+
+// startResolver re-resolves engine addresses every interval, whenever a
+// watching upstream source reports a change, and when requests find no
+// engine available, and applies the result until the group is destructed.
+func (g *engineGroup) startResolver(r *engineResolver, interval time.Duration) {
+	logger := g.logger.Named("resolver")
+	g.refreshC = make(chan struct{}, 1)
+	changed := make(chan struct{}, 1)
+	if w, ok := r.source.(EngineSourceWatcher); ok {
+		w.Watch(g.ctx, func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	}
+	lastRefresh := time.Now()
+	refresh := func() {
+		lastRefresh = time.Now()
+		addrs, err := r.resolve(g.ctx)
+		if err != nil {
+			logger.Warn("resolving WAF engine addresses", zap.Error(err))
+		}
+		if err := g.updateEngines(addrs); err != nil {
+			logger.Error("updating WAF engines", zap.Error(err))
+		}
+	}
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				if c := logger.Check(zapcore.ErrorLevel, "engine resolver panicked"); c != nil {
+					c.Write(
+						zap.Any("error", err),
+						zap.ByteString("stack", debug.Stack()),
+					)
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				refresh()
+			case <-changed:
+				refresh()
+			case <-g.refreshC:
+				if time.Since(lastRefresh) >= r.minRefresh {
+					refresh()
+				}
+			case <-g.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// requestRefresh asks the resolver to re-resolve the engine addresses now,
+// e.g. because a request found no engine available. Requests within
+// engineRefreshMinInterval of the last refresh are dropped.
+func (g *engineGroup) requestRefresh() {
+	if g == nil || g.refreshC == nil {
+		return
+	}
+	select {
+	case g.refreshC <- struct{}{}:
+	default:
+	}
+}
+
+// engineFactory returns the connection factory of a pool for addr, a
+// literal "ip:port" or "unix//path".
+func engineFactory(addr string) t1k.Factory {
+	if path, ok := strings.CutPrefix(addr, "unix/"); ok {
+		return &unixFactory{path: path}
+	}
+	return &t1k.TcpFactory{Addr: addr}
+}
+
+// unixFactory dials an engine's Unix socket directly, so the socket's file
+// permissions decide who can reach the engine.
+type unixFactory struct {
+	path string
+}
+
+func (f *unixFactory) Factory() (net.Conn, error) {
+	return net.Dial("unix", f.path)
+}
+
+func (f *unixFactory) Close(conn net.Conn) error {
+	return conn.Close()
+}
+
+// Interface guards
+var _ t1k.Factory = (*unixFactory)(nil)
@@ -0,0 +1,298 @@
+package caddy_waf_t1k
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/chaitin/t1k-go"
+	"go.uber.org/zap"
+)
+
+func TestParseEngineAddr(t *testing.T) {
+	tests := []struct {
+		addr     string
+		want     string
+		hostname bool
+		wantErr  bool
+	}{
+		{addr: "192.0.2.1:8000", want: "192.0.2.1:8000"},
+		{addr: "tcp/192.0.2.1:8000", want: "192.0.2.1:8000"},
+		{addr: "[2001:db8::1]:8000", want: "[2001:db8::1]:8000"},
+		{addr: "detector.waf.svc.cluster.local:8000", want: "detector.waf.svc.cluster.local:8000", hostname: true},
+		{addr: "unix//run/safeline/detector.sock", want: "unix//run/safeline/detector.sock"},
+		{addr: "192.0.2.1", wantErr: true},
+		{addr: "192.0.2.1:8000-8001", wantErr: true},
+		{addr: "udp/192.0.2.1:8000", wantErr: true},
+		{addr: "unixgram//run/detector.sock", wantErr: true},
+		{addr: ":8000", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseEngineAddr(tt.addr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseEngineAddr(%q) = %v, want error", tt.addr, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseEngineAddr(%q): %v", tt.addr, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("parseEngineAddr(%q) = %q, want %q", tt.addr, got.String(), tt.want)
+		}
+		if got.isHostname() != tt.hostname {
+			t.Errorf("parseEngineAddr(%q).isHostname() = %v, want %v", tt.addr, got.isHostname(), tt.hostname)
+		}
+	}
+}
+
+func mustParseEngineAddrs(t *testing.T, addrs ...string) []engineAddr {
+	t.Helper()
+	out := make([]engineAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		a, err := parseEngineAddr(addr)
+		if err != nil {
+			t.Fatalf("parseEngineAddr(%q): %v", addr, err)
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+func TestEngineResolverResolve(t *testing.T) {
+	records := map[string][]string{"detector.example": {"192.0.2.11", "2001:db8::11"}}
+	var lookupErr error
+	r := newEngineResolver(mustParseEngineAddrs(t, "192.0.2.1:8000", "detector.example:9000", "unix//run/detector.sock"), nil)
+	r.lookup = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		var out []net.IPAddr
+		for _, ip := range records[host] {
+			out = append(out, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return out, nil
+	}
+	if !r.hasHostnames() {
+		t.Fatal("hasHostnames() = false, want true")
+	}
+
+	got, err := r.resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	want := []string{"192.0.2.1:8000", "192.0.2.11:9000", "[2001:db8::11]:9000", "unix//run/detector.sock"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("resolve = %v, want %v", got, want)
+	}
+
+	records["detector.example"] = []string{"192.0.2.12"}
+	got, _ = r.resolve(context.Background())
+	want = []string{"192.0.2.1:8000", "192.0.2.12:9000", "unix//run/detector.sock"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("after record change resolve = %v, want %v", got, want)
+	}
+
+	lookupErr = errors.New("no such host")
+	got, err = r.resolve(context.Background())
+	if err == nil {
+		t.Fatal("expected lookup error")
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("after lookup error resolve = %v, want previous %v", got, want)
+	}
+}
+
+func TestEngineResolverWeights(t *testing.T) {
+	addrs := mustParseEngineAddrs(t, "192.0.2.1:8000", "192.0.2.2:8000", "detector.example:9000")
+	addrs[0].weight = 3
+	addrs[2].weight = 2
+	r := newEngineResolver(addrs, &fakeEngineSource{addrs: []string{"192.0.2.21:8000"}})
+	r.lookup = func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.11")}, {IP: net.ParseIP("192.0.2.12")}}, nil
+	}
+	if _, err := r.resolve(context.Background()); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	for addr, want := range map[string]int{
+		"192.0.2.1:8000":  3,
+		"192.0.2.2:8000":  0,
+		"192.0.2.11:9000": 2,
+		"192.0.2.12:9000": 2,
+		"192.0.2.21:8000": 0,
+	} {
+		if got := r.weight(addr); got != want {
+			t.Errorf("weight(%s) = %d, want %d", addr, got, want)
+		}
+	}
+
+	g := newTestEngineGroup()
+	g.weightOf = r.weight
+	if err := g.updateEngines([]string{"192.0.2.1:8000", "192.0.2.2:8000"}); err != nil {
+		t.Fatalf("updateEngines: %v", err)
+	}
+	if got := g.current()[0].Weight(); got != 3 {
+		t.Errorf("engine weight = %d, want 3", got)
+	}
+	if got := g.current()[1].Weight(); got != 1 {
+		t.Errorf("engine weight = %d, want 1", got)
+	}
+}
+
+func TestEngineGroupValidateWeights(t *testing.T) {
+	for _, cfg := range []EngineGroup{
+		{WafEngineAddrs: []string{"192.0.2.1:8000"}, Weights: map[string]int{"192.0.2.2:8000": 2}},
+		{WafEngineAddrs: []string{"192.0.2.1:8000"}, Weights: map[string]int{"192.0.2.1:8000": 0}},
+		{WafEngineAddrs: []string{"192.0.2.1:8000"}, BackupEngineAddrs: []string{"192.0.2.1:8000"}},
+	} {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+	cfg := EngineGroup{
+		WafEngineAddrs:    []string{"192.0.2.1:8000"},
+		BackupEngineAddrs: []string{"127.0.0.1:8000"},
+		Weights:           map[string]int{"127.0.0.1:8000": 2},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("validate: %v", err)
+	}
+}
+
+func TestEngineResolverBackups(t *testing.T) {
+	addrs := mustParseEngineAddrs(t, "192.0.2.1:8000", "detector.example:9000", "127.0.0.1:8000")
+	addrs[1].backup = true
+	addrs[2].backup = true
+	r := newEngineResolver(addrs, nil)
+	r.lookup = func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.11")}}, nil
+	}
+	got, err := r.resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if want := []string{"192.0.2.1:8000", "192.0.2.11:9000", "127.0.0.1:8000"}; !slices.Equal(got, want) {
+		t.Fatalf("resolve = %v, want %v", got, want)
+	}
+
+	g := newTestEngineGroup()
+	g.backupOf = r.isBackup
+	if err := g.updateEngines(got); err != nil {
+		t.Fatalf("updateEngines: %v", err)
+	}
+	for i, want := range []bool{false, true, true} {
+		if e := g.current()[i]; e.backup != want {
+			t.Errorf("%s backup = %v, want %v", e.addr, e.backup, want)
+		}
+	}
+}
+
+func TestEngineResolverStaticOnly(t *testing.T) {
+	r := newEngineResolver(mustParseEngineAddrs(t, "192.0.2.1:8000", "unix//run/detector.sock"), nil)
+	if r.hasHostnames() {
+		t.Fatal("hasHostnames() = true for literal addresses")
+	}
+}
+
+func newTestEngineGroup() *engineGroup {
+	g := newEngineGroup(context.Background(), &EngineGroup{}, "test", zap.NewNop())
+	g.newEngineFn = func(addr string) (*Engine, error) {
+		if addr == "192.0.2.99:8000" {
+			return nil, errors.New("dial failed")
+		}
+		return &Engine{addr: addr}, nil
+	}
+	return g
+}
+
+func engineAddrs(pool EnginePool) []string {
+	out := make([]string, 0, len(pool))
+	for _, e := range pool {
+		out = append(out, e.addr)
+	}
+	return out
+}
+
+func TestUpdateEnginesKeepsExistingEngines(t *testing.T) {
+	ensureWAFMetrics(t)
+	g := newTestEngineGroup()
+	if err := g.updateEngines([]string{"192.0.2.1:8000", "192.0.2.2:8000"}); err != nil {
+		t.Fatalf("updateEngines: %v", err)
+	}
+	first := g.current()
+	addFailures(first[0], 3)
+
+	if err := g.updateEngines([]string{"192.0.2.1:8000", "192.0.2.3:8000", "192.0.2.3:8000"}); err != nil {
+		t.Fatalf("updateEngines: %v", err)
+	}
+	got := g.current()
+	if want := []string{"192.0.2.1:8000", "192.0.2.3:8000"}; !slices.Equal(engineAddrs(got), want) {
+		t.Fatalf("engines = %v, want %v", engineAddrs(got), want)
+	}
+	if got[0] != first[0] || got[0].Fails() != 3 {
+		t.Error("engine for a remaining address was replaced")
+	}
+}
+
+func TestUpdateEnginesSkipsFailedAddress(t *testing.T) {
+	ensureWAFMetrics(t)
+	g := newTestEngineGroup()
+	err := g.updateEngines([]string{"192.0.2.99:8000", "192.0.2.1:8000"})
+	if err == nil {
+		t.Fatal("expected error for failing address")
+	}
+	if want := []string{"192.0.2.1:8000"}; !slices.Equal(engineAddrs(g.current()), want) {
+		t.Fatalf("engines = %v, want %v", engineAddrs(g.current()), want)
+	}
+}
+
+func TestEngineFactory(t *testing.T) {
+	if f, ok := engineFactory("192.0.2.1:8000").(*t1k.TcpFactory); !ok || f.Addr != "192.0.2.1:8000" {
+		t.Errorf("factory of a TCP address = %#v, want a TcpFactory", engineFactory("192.0.2.1:8000"))
+	}
+
+	path := filepath.Join(t.TempDir(), "engine.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	f := engineFactory("unix/" + path)
+	conn, err := f.Factory()
+	if err != nil {
+		t.Fatalf("dial socket: %v", err)
+	}
+	defer f.Close(conn)
+	if conn.RemoteAddr().Network() != "unix" {
+		t.Errorf("dialed over %s, want unix", conn.RemoteAddr().Network())
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("echo = %q, want ping", buf)
+	}
+}
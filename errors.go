@@ -1,12 +1,14 @@
 package caddy_waf_t1k
 
 import (
+	"errors"
 	"strings"
 )
 
 const (
 	reasonConnectionRefused = "connection_refused"
 	reasonDialTimeout       = "dial_timeout"
+	reasonDetectTimeout     = "detect_timeout"
 	reasonBrokenPipe        = "broken_pipe"
 	reasonMaxActiveReached  = "max_active_reached"
 	reasonPoolClosed        = "pool_closed"
@@ -25,6 +27,8 @@ func classifyConnectionError(err error) string {
 	}
 
 	switch {
+	case errors.Is(err, errDetectTimeout):
+		return reasonDetectTimeout
 	case strings.Contains(msg, "connection refused"):
 		return reasonConnectionRefused
 	case strings.Contains(msg, "i/o timeout"):
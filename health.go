@@ -0,0 +1,230 @@
+package caddy_waf_t1k
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	defaultHealthTimeout = 5 * time.Second
+	defaultHealthURI     = "/"
+
+	// healthProbeHost is the Host header of active health check probes.
+	healthProbeHost = "waf-health-check.invalid"
+)
+
+// activeHealthChecker periodically sends probe requests through each engine
+// and marks engines up or down based on the verdicts.
+type activeHealthChecker struct {
+	engines      func() EnginePool
+	instanceID   string
+	ctx          context.Context
+	logger       *zap.Logger
+	interval     time.Duration
+	timeout      time.Duration
+	uri          string
+	maliciousURI string
+}
+
+func newActiveHealthChecker(g *engineGroup) *activeHealthChecker {
+	timeout := time.Duration(g.cfg.HealthTimeout)
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+	uri := g.cfg.HealthURI
+	if uri == "" {
+		uri = defaultHealthURI
+	}
+	return &activeHealthChecker{
+		engines:      g.current,
+		instanceID:   g.instanceID,
+		ctx:          g.ctx,
+		logger:       g.logger.Named("health"),
+		interval:     time.Duration(g.cfg.HealthInterval),
+		timeout:      timeout,
+		uri:          uri,
+		maliciousURI: g.cfg.HealthMaliciousURI,
+	}
+}
+
+func (c *activeHealthChecker) start() {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				if ce := c.logger.Check(zapcore.ErrorLevel, "active health checker panicked"); ce != nil {
+					ce.Write(
+						zap.Any("error", err),
+						zap.ByteString("stack", debug.Stack()),
+					)
+				}
+			}
+		}()
+
+		c.checkAll()
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.checkAll()
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// checkAll probes all engines concurrently and waits for the results.
+func (c *activeHealthChecker) checkAll() {
+	var wg sync.WaitGroup
+	for _, engine := range c.engines() {
+		wg.Add(1)
+		go func(engine *Engine) {
+			defer wg.Done()
+			c.check(engine)
+		}(engine)
+	}
+	wg.Wait()
+}
+
+// check probes one engine and records the outcome. An engine passing the
+// probe is brought back at once, whatever took it down.
+func (c *activeHealthChecker) check(engine *Engine) {
+	err := c.probe(engine)
+	healthy := err == nil
+	if engine.setHealthy(healthy) {
+		if healthy {
+			c.logger.Info("WAF engine passed active health check, marked up",
+				zap.String("engine", engine.addr))
+		} else {
+			c.logger.Warn("WAF engine failed active health check, marked down",
+				zap.String("engine", engine.addr),
+				zap.Error(err))
+		}
+	}
+
+	// Passive failures and an open circuit would keep an engine that passes
+	// the probe down until their timers expire.
+	if healthy && !engine.available() {
+		engine.resetFailures()
+		if engine.available() {
+			c.logger.Info("WAF engine passed active health check, cleared its failures",
+				zap.String("engine", engine.addr))
+		}
+	}
+
+	gauge := 0.0
+	if engine.Available() {
+		gauge = 1.0
+	}
+	wafMetrics.enginesHealthy.With(prometheus.Labels{"engine": engine.addr, "waf_instance": c.instanceID}).Set(gauge)
+}
+
+// probe sends the benign probe, which must pass, and the malicious probe,
+// if configured, which must be blocked.
+func (c *activeHealthChecker) probe(engine *Engine) error {
+	result, err := detect(engine, newHealthProbe(c.uri), c.timeout)
+	if err != nil {
+		return fmt.Errorf("benign probe: %w", err)
+	}
+	if result.Blocked() {
+		return fmt.Errorf("benign probe %s was blocked", c.uri)
+	}
+
+	if c.maliciousURI == "" {
+		return nil
+	}
+	result, err = detect(engine, newHealthProbe(c.maliciousURI), c.timeout)
+	if err != nil {
+		return fmt.Errorf("malicious probe: %w", err)
+	}
+	if !result.Blocked() {
+		return fmt.Errorf("malicious probe %s was not blocked", c.maliciousURI)
+	}
+	return nil
+}
+
+func newHealthProbe(uri string) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "http://"+healthProbeHost+uri, nil)
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set("User-Agent", "caddy-waf-t1k-health-check")
+	return req
+}
+
+const (
+	// failureBuckets is the number of buckets a passive health window is
+	// split into. Failures expire after health_fail_duration plus at most
+	// one bucket width.
+	failureBuckets = 10
+
+	failureCountBits = 24
+	failureCountMask = 1<<failureCountBits - 1
+	failureSlotMask  = 1<<(64-failureCountBits) - 1
+)
+
+// failureWindow counts an engine's failures over a sliding window, for the
+// passive health check, without locks or timers. Each bucket packs the
+// number of a time slot with the failures counted in it, so the first
+// failure of a new slot resets a stale bucket with a single CAS.
+type failureWindow struct {
+	width   atomic.Int64 // bucket width in nanoseconds; 0 until the first failure
+	buckets [failureBuckets + 1]atomic.Uint64
+}
+
+// add counts a failure at now that expires after window.
+func (w *failureWindow) add(now time.Time, window time.Duration) {
+	width := int64(window) / failureBuckets
+	if width < 1 {
+		width = 1
+	}
+	w.width.Store(width)
+	slot := uint64(now.UnixNano()/width) & failureSlotMask
+	bucket := &w.buckets[slot%uint64(len(w.buckets))]
+	for {
+		old := bucket.Load()
+		next := slot<<failureCountBits | 1
+		if old>>failureCountBits == slot {
+			if old&failureCountMask == failureCountMask {
+				return // saturated; the engine is down either way
+			}
+			next = old + 1
+		}
+		if bucket.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// count returns the failures that have not expired at now.
+func (w *failureWindow) count(now time.Time) int {
+	width := w.width.Load()
+	if width == 0 {
+		return 0
+	}
+	slot := uint64(now.UnixNano()/width) & failureSlotMask
+	n := 0
+	for i := range w.buckets {
+		v := w.buckets[i].Load()
+		if (slot-v>>failureCountBits)&failureSlotMask <= failureBuckets {
+			n += int(v & failureCountMask)
+		}
+	}
+	return n
+}
+
+// reset forgets all failures.
+func (w *failureWindow) reset() {
+	for i := range w.buckets {
+		w.buckets[i].Store(0)
+	}
+}
@@ -0,0 +1,226 @@
+package caddy_waf_t1k
+
+import (
+	"errors"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/chaitin/t1k-go/detection"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func newTestHealthChecker(t *testing.T, engines EnginePool, maliciousURI string) *activeHealthChecker {
+	t.Cleanup(func() {
+		for _, engine := range engines {
+			wafMetrics.enginesHealthy.DeleteLabelValues(engine.addr, "test")
+		}
+	})
+	return &activeHealthChecker{
+		engines:      func() EnginePool { return engines },
+		instanceID:   "test",
+		logger:       zap.NewNop(),
+		timeout:      100 * time.Millisecond,
+		uri:          defaultHealthURI,
+		maliciousURI: maliciousURI,
+	}
+}
+
+// probeEngine blocks requests for blockedURI and fails while failing is set.
+func probeEngine(addr, blockedURI string, failing *atomic.Bool) *Engine {
+	return &Engine{addr: addr, detectFn: func(r *http.Request) (*detection.Result, error) {
+		if failing.Load() {
+			return nil, errors.New("connection refused")
+		}
+		if r.URL.RequestURI() == blockedURI {
+			return &detection.Result{Head: '?'}, nil
+		}
+		return &detection.Result{Head: '.'}, nil
+	}}
+}
+
+func TestActiveHealthCheckMarksDownAndUp(t *testing.T) {
+	ensureWAFMetrics(t)
+	var failing atomic.Bool
+	engine := probeEngine("192.0.2.1:8000", "", &failing)
+	c := newTestHealthChecker(t, EnginePool{engine}, "")
+
+	c.checkAll()
+	if !engine.Available() {
+		t.Fatal("engine passing the probe should be available")
+	}
+
+	failing.Store(true)
+	c.checkAll()
+	if engine.Available() {
+		t.Fatal("engine failing the probe should be unavailable")
+	}
+	if got := testutil.ToFloat64(wafMetrics.enginesHealthy.WithLabelValues(engine.addr, "test")); got != 0 {
+		t.Errorf("engines_healthy = %v, want 0", got)
+	}
+
+	failing.Store(false)
+	c.checkAll()
+	if !engine.Available() {
+		t.Fatal("engine should be available again after a passing probe")
+	}
+	if got := testutil.ToFloat64(wafMetrics.enginesHealthy.WithLabelValues(engine.addr, "test")); got != 1 {
+		t.Errorf("engines_healthy = %v, want 1", got)
+	}
+}
+
+func TestActiveHealthCheckClearsPassiveFailures(t *testing.T) {
+	ensureWAFMetrics(t)
+	var failing atomic.Bool
+	passive := probeEngine("192.0.2.1:8000", "", &failing)
+	passive.maxFails = 1
+	tripped := probeEngine("192.0.2.2:8000", "", &failing)
+	tripped.breaker = newCircuitBreaker(CircuitBreaker{ConsecutiveFailures: 1, OpenDuration: caddy.Duration(time.Hour)}, nil)
+
+	m := &CaddyWAF{EngineGroup: EngineGroup{HealthFailDuration: caddy.Duration(time.Hour)}}
+	m.countFailure(passive)
+	tripped.recordResult(errors.New("connection refused"))
+	if passive.Available() || tripped.Available() {
+		t.Fatal("engines taken down by traffic are available")
+	}
+
+	newTestHealthChecker(t, EnginePool{passive, tripped}, "").checkAll()
+	if !passive.Available() || passive.Fails() != 0 {
+		t.Errorf("engine with passive failures unavailable after a passing probe, fails = %d", passive.Fails())
+	}
+	if !tripped.Available() || tripped.breaker.currentState() != circuitClosed {
+		t.Error("engine with an open circuit unavailable after a passing probe")
+	}
+}
+
+func TestActiveHealthCheckMaliciousProbe(t *testing.T) {
+	ensureWAFMetrics(t)
+	const attack = "/?id=1%27%20OR%201=1--"
+	var failing atomic.Bool
+	detecting := probeEngine("192.0.2.1:8000", attack, &failing)
+	blind := probeEngine("192.0.2.2:8000", "", &failing)
+
+	c := newTestHealthChecker(t, EnginePool{detecting, blind}, attack)
+	c.checkAll()
+	if !detecting.Available() {
+		t.Error("engine blocking the malicious probe should be available")
+	}
+	if blind.Available() {
+		t.Error("engine passing the malicious probe should be unavailable")
+	}
+}
+
+func TestActiveHealthCheckBlockedBenignProbe(t *testing.T) {
+	ensureWAFMetrics(t)
+	var failing atomic.Bool
+	engine := probeEngine("192.0.2.1:8000", defaultHealthURI, &failing)
+	c := newTestHealthChecker(t, EnginePool{engine}, "")
+	c.checkAll()
+	if engine.Available() {
+		t.Error("engine blocking the benign probe should be unavailable")
+	}
+}
+
+func TestActiveHealthCheckTimeout(t *testing.T) {
+	ensureWAFMetrics(t)
+	engine := &Engine{addr: "192.0.2.1:8000", detectFn: func(*http.Request) (*detection.Result, error) {
+		time.Sleep(500 * time.Millisecond)
+		return &detection.Result{Head: '.'}, nil
+	}}
+	c := newTestHealthChecker(t, EnginePool{engine}, "")
+	c.timeout = 20 * time.Millisecond
+	c.checkAll()
+	if engine.Available() {
+		t.Error("engine timing out on the probe should be unavailable")
+	}
+}
+
+func TestValidateHealthURI(t *testing.T) {
+	for _, uri := range []string{"health", "http://example.com/"} {
+		m := &CaddyWAF{EngineGroup: EngineGroup{HealthURI: uri}}
+		if err := m.Validate(); err == nil {
+			t.Errorf("expected error for health_uri %q", uri)
+		}
+	}
+	m := &CaddyWAF{EngineGroup: EngineGroup{HealthURI: "/healthz", HealthMaliciousURI: "/?q=%3Cscript%3E"}}
+	if err := m.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFailureWindowExpiry(t *testing.T) {
+	var w failureWindow
+	start := time.Unix(1700000000, 0)
+	if got := w.count(start); got != 0 {
+		t.Fatalf("count of empty window = %d", got)
+	}
+	w.add(start, time.Second)
+	w.add(start.Add(500*time.Millisecond), time.Second)
+	w.add(start.Add(500*time.Millisecond), time.Second)
+
+	for _, tt := range []struct {
+		at   time.Duration
+		want int
+	}{
+		{at: 500 * time.Millisecond, want: 3},
+		{at: 999 * time.Millisecond, want: 3},
+		{at: 1100 * time.Millisecond, want: 2},
+		{at: 1499 * time.Millisecond, want: 2},
+		{at: 1600 * time.Millisecond, want: 0},
+		{at: time.Hour, want: 0},
+	} {
+		if got := w.count(start.Add(tt.at)); got != tt.want {
+			t.Errorf("count after %v = %d, want %d", tt.at, got, tt.want)
+		}
+	}
+
+	// A bucket reused after the window wrapped starts from zero.
+	w.add(start.Add(1100*time.Millisecond*time.Duration(failureBuckets+1)), time.Second)
+	if got := w.count(start.Add(1100 * time.Millisecond * time.Duration(failureBuckets+1))); got != 1 {
+		t.Errorf("count after wrap = %d, want 1", got)
+	}
+
+	w.reset()
+	if got := w.count(start); got != 0 {
+		t.Errorf("count after reset = %d, want 0", got)
+	}
+}
+
+func TestFailureWindowConcurrentAdds(t *testing.T) {
+	var w failureWindow
+	now := time.Now()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				w.add(now, time.Minute)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := w.count(now); got != 8000 {
+		t.Errorf("count = %d, want 8000", got)
+	}
+}
+
+func TestCountFailureStartsNoGoroutines(t *testing.T) {
+	m := &CaddyWAF{EngineGroup: EngineGroup{HealthFailDuration: caddy.Duration(time.Minute)}}
+	e := &Engine{maxFails: 1}
+	before := runtime.NumGoroutine()
+	for range 10000 {
+		m.countFailure(e)
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Errorf("goroutines grew from %d to %d", before, after)
+	}
+	if got := e.Fails(); got != 10000 {
+		t.Errorf("Fails() = %d, want 10000", got)
+	}
+}
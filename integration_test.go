@@ -140,10 +140,10 @@ func TestIntegrationBodyCapDetectionBlindSpot(t *testing.T) {
 				t.Fatalf("ServeHTTP returned error: %v", err)
 			}
 
-			blocked := rr.Code == http.StatusNotImplemented
+			blocked := rr.Code == http.StatusForbidden
 			if blocked != tc.wantBlocked {
 				if tc.wantBlocked {
-					t.Errorf("%s: expected blocked (HTTP 501), got HTTP %d (next called: %v)",
+					t.Errorf("%s: expected blocked (HTTP 403), got HTTP %d (next called: %v)",
 						tc.desc, rr.Code, nextCalled)
 				} else {
 					t.Errorf("%s: expected passed (next handler called), got HTTP %d (blocked)",
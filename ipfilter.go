@@ -0,0 +1,259 @@
+package caddy_waf_t1k
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// defaultIPListWatchInterval is how often an IP list file is checked for
+// changes by default.
+const defaultIPListWatchInterval = time.Second
+
+// IPList is a list of client IP addresses and CIDR ranges, given inline,
+// read from a file, or both. The file is watched for changes.
+type IPList struct {
+	// Ranges are IP addresses or CIDR ranges. The shortcut private_ranges
+	// stands for all private IPv4 and IPv6 ranges.
+	Ranges []string `json:"ranges,omitempty"`
+
+	// File holds more ranges: either a JSON array of strings, or one range
+	// per line with blank lines and lines starting with "#" ignored.
+	File string `json:"file,omitempty"`
+
+	// WatchInterval is how often the file is checked for changes.
+	// Default 1s.
+	WatchInterval caddy.Duration `json:"watch_interval,omitempty"`
+
+	inline   []netip.Prefix
+	prefixes atomic.Pointer[[]netip.Prefix]
+}
+
+// validate ensures the list configuration is valid.
+func (l *IPList) validate(name string) error {
+	if len(l.Ranges) == 0 && l.File == "" {
+		return fmt.Errorf("%s: ranges or file is required", name)
+	}
+	if l.WatchInterval < 0 {
+		return fmt.Errorf("%s: watch_interval must be >= 0", name)
+	}
+	return nil
+}
+
+// provision parses the inline ranges, loads the file and watches it until
+// ctx is done. A file that fails to reload keeps the previous list.
+func (l *IPList) provision(ctx context.Context, logger *zap.Logger, name string) error {
+	inline, err := parseIPRanges(l.Ranges)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	l.inline = inline
+	if err := l.load(); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if l.File == "" {
+		return nil
+	}
+	go l.watch(ctx, logger, name, l.fileVersion())
+	return nil
+}
+
+// watch reloads the list whenever the file's size or modification time
+// changes from last, until ctx is done.
+func (l *IPList) watch(ctx context.Context, logger *zap.Logger, name, last string) {
+	interval := time.Duration(l.WatchInterval)
+	if interval == 0 {
+		interval = defaultIPListWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		version := l.fileVersion()
+		if version == last {
+			continue
+		}
+		last = version
+		if err := l.load(); err != nil {
+			logger.Error("reloading IP list, keeping the previous ranges",
+				zap.String("list", name),
+				zap.String("file", l.File),
+				zap.Error(err))
+			continue
+		}
+		logger.Info("reloaded IP list",
+			zap.String("list", name),
+			zap.String("file", l.File),
+			zap.Int("ranges", len(*l.prefixes.Load())))
+	}
+}
+
+// fileVersion returns a value that changes when the file is modified.
+func (l *IPList) fileVersion() string {
+	fi, err := os.Stat(l.File)
+	if err != nil {
+		return ""
+	}
+	return fi.ModTime().String() + "/" + strconv.FormatInt(fi.Size(), 10)
+}
+
+// load replaces the list with the inline ranges and those of the file.
+func (l *IPList) load() error {
+	prefixes := l.inline
+	if l.File != "" {
+		data, err := os.ReadFile(l.File)
+		if err != nil {
+			return err
+		}
+		ranges, err := parseAddrList(data)
+		if err != nil {
+			return err
+		}
+		fromFile, err := parseIPRanges(ranges)
+		if err != nil {
+			return fmt.Errorf("%s: %v", l.File, err)
+		}
+		prefixes = append(fromFile, l.inline...)
+	}
+	l.prefixes.Store(&prefixes)
+	return nil
+}
+
+// contains reports whether ip is in the list. IPv4-mapped IPv6 addresses
+// match their IPv4 ranges. An unprovisioned list is empty.
+func (l *IPList) contains(ip netip.Addr) bool {
+	if l == nil {
+		return false
+	}
+	prefixes := l.prefixes.Load()
+	if prefixes == nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range *prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPRanges parses IP addresses and CIDR ranges.
+func parseIPRanges(ranges []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, r := range ranges {
+		if r == "private_ranges" {
+			private, err := parseIPRanges(caddyhttp.PrivateRangesCIDR())
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, private...)
+			continue
+		}
+		if strings.Contains(r, "/") {
+			prefix, err := netip.ParsePrefix(r)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR range %q: %v", r, err)
+			}
+			prefixes = append(prefixes, unmapPrefix(prefix).Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q: %v", r, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// unmapPrefix turns an IPv4-mapped IPv6 range, e.g. ::ffff:10.0.0.0/104,
+// into its IPv4 range, as addresses are unmapped before they are matched.
+// Ranges wider than the IPv4-mapped space are kept.
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if !prefix.Addr().Is4In6() || prefix.Bits() < 96 {
+		return prefix
+	}
+	return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+}
+
+// clientAddr parses the client IP of the request, which is resolved through
+// the server's trusted_proxies.
+func clientAddr(r *http.Request) (netip.Addr, error) {
+	ip, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return ip.WithZone("").Unmap(), nil
+}
+
+// unmarshalIPList parses an IP list from Caddyfile tokens:
+//
+//	allow_ips|deny_ips [<ranges...>] {
+//	    ranges         <ranges...>
+//	    file           <path>
+//	    watch_interval <duration>
+//	}
+//
+// Repeated directives add to the list.
+func unmarshalIPList(d *caddyfile.Dispenser, list *IPList) (*IPList, error) {
+	if list == nil {
+		list = new(IPList)
+	}
+	list.Ranges = append(list.Ranges, d.RemainingArgs()...)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "ranges":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return nil, d.ArgErr()
+			}
+			list.Ranges = append(list.Ranges, args...)
+		case "file":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			if list.File != "" {
+				return nil, d.Err("IP list file already specified")
+			}
+			list.File = d.Val()
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+		case "watch_interval":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid watch_interval value: %v", err)
+			}
+			list.WatchInterval = caddy.Duration(dur)
+		default:
+			return nil, d.Errf("unrecognized IP list option %s", d.Val())
+		}
+	}
+	if _, err := parseIPRanges(list.Ranges); err != nil {
+		return nil, d.Err(err.Error())
+	}
+	if len(list.Ranges) == 0 && list.File == "" {
+		return nil, d.ArgErr()
+	}
+	return list, nil
+}
@@ -0,0 +1,118 @@
+package caddy_waf_t1k
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestIPListContains(t *testing.T) {
+	l := &IPList{Ranges: []string{"192.0.2.0/24", "2001:db8::1", "198.51.100.7", "private_ranges", "::ffff:198.18.0.0/111"}}
+	if err := l.provision(context.Background(), zap.NewNop(), "allow_ips"); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.200", true},
+		{"::ffff:192.0.2.1", true},
+		{"198.19.0.1", true},
+		{"::ffff:198.18.5.5", true},
+		{"198.20.0.1", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"10.1.2.3", true},
+		{"203.0.113.1", false},
+	} {
+		if got := l.contains(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("contains(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if (*IPList)(nil).contains(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("nil list contains an address")
+	}
+}
+
+func TestIPListInvalid(t *testing.T) {
+	for _, l := range []*IPList{
+		{Ranges: []string{"192.0.2.0/33"}},
+		{Ranges: []string{"not-an-ip"}},
+		{File: filepath.Join(t.TempDir(), "missing.txt")},
+	} {
+		if err := l.provision(context.Background(), zap.NewNop(), "deny_ips"); err == nil {
+			t.Errorf("expected error for %+v", l)
+		}
+	}
+	for _, l := range []*IPList{{}, {Ranges: []string{"192.0.2.1"}, WatchInterval: -1}} {
+		if err := l.validate("deny_ips"); err == nil {
+			t.Errorf("expected error for %+v", l)
+		}
+	}
+}
+
+func TestIPListWatchesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(path, []byte("# abusers\n192.0.2.1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := &IPList{Ranges: []string{"203.0.113.0/24"}, File: path, WatchInterval: caddy.Duration(10 * time.Millisecond)}
+	if err := l.provision(ctx, zap.NewNop(), "deny_ips"); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	if !l.contains(netip.MustParseAddr("192.0.2.1")) || !l.contains(netip.MustParseAddr("203.0.113.5")) {
+		t.Fatal("list is missing the file or inline ranges")
+	}
+
+	waitFor := func(ip string, want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for l.contains(netip.MustParseAddr(ip)) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("contains(%s) never became %v", ip, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	if err := os.WriteFile(path, []byte(`["198.51.100.0/24"]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("198.51.100.9", true)
+	if l.contains(netip.MustParseAddr("192.0.2.1")) || !l.contains(netip.MustParseAddr("203.0.113.5")) {
+		t.Error("reload did not replace the file ranges and keep the inline ones")
+	}
+
+	// A broken file keeps the previous list.
+	if err := os.WriteFile(path, []byte("192.0.2.0/99\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !l.contains(netip.MustParseAddr("198.51.100.9")) {
+		t.Error("invalid file replaced the list")
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "[::ffff:192.0.2.1]:1234"
+	if got, err := clientAddr(req); err != nil || got != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("clientAddr = %v, %v; want the unmapped remote address", got, err)
+	}
+	// Behind a trusted proxy the server resolves the client IP.
+	ctx := context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{caddyhttp.ClientIPVarKey: "fe80::1%eth0"})
+	if got, err := clientAddr(req.WithContext(ctx)); err != nil || got != netip.MustParseAddr("fe80::1") {
+		t.Errorf("clientAddr = %v, %v; want the resolved client IP without zone", got, err)
+	}
+}
@@ -2,17 +2,34 @@ package caddy_waf_t1k
 
 import (
 	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
 	weakrand "math/rand/v2"
+	"net"
 	"net/http"
+	"slices"
+	"sync"
 	"sync/atomic"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
 func init() {
 	caddy.RegisterModule(RandomSelection{})
 	caddy.RegisterModule(RoundRobinSelection{})
+	caddy.RegisterModule(FirstSelection{})
+	caddy.RegisterModule(LeastConnSelection{})
+	caddy.RegisterModule(P2CEWMASelection{})
+	caddy.RegisterModule(WeightedRandomSelection{})
+	caddy.RegisterModule(new(WeightedRoundRobinSelection))
+	caddy.RegisterModule(IPHashSelection{})
+	caddy.RegisterModule(URIHashSelection{})
+	caddy.RegisterModule(HeaderHashSelection{})
+	caddy.RegisterModule(CookieHashSelection{})
 }
 
 // LoadBalancing has parameters related to load balancing.
@@ -49,6 +66,30 @@ func excludeEngines(pool EnginePool, tried map[*Engine]struct{}) EnginePool {
 	return out
 }
 
+// engineTiers returns the tiers of engines requests may currently be sent
+// to, in order: the primary engines while any of them is available, then
+// the backup engines. Requests fall through to the backup tier when no
+// primary engine admits them, e.g. while the available primary engines are
+// half-open without a free trial slot. A pool without backup engines is
+// returned as the only tier.
+func engineTiers(pool EnginePool) []EnginePool {
+	if !slices.ContainsFunc(pool, func(e *Engine) bool { return e.backup }) {
+		return []EnginePool{pool}
+	}
+	var primary, backup EnginePool
+	for _, e := range pool {
+		if e.backup {
+			backup = append(backup, e)
+		} else {
+			primary = append(primary, e)
+		}
+	}
+	if !slices.ContainsFunc(primary, (*Engine).Available) {
+		return []EnginePool{backup}
+	}
+	return []EnginePool{primary, backup}
+}
+
 // RandomSelection is a policy that selects
 // an available host at random.
 type RandomSelection struct{}
@@ -130,8 +171,562 @@ func (r *RoundRobinSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// FirstSelection is a policy that selects
+// the first available host, in configuration order.
+type FirstSelection struct{}
+
+// CaddyModule returns the Caddy module information.
+func (FirstSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.waf_chaitin.selection_policies.first",
+		New: func() caddy.Module { return new(FirstSelection) },
+	}
+}
+
+// Select returns an available host, if any.
+func (FirstSelection) Select(pool EnginePool, _ *http.Request, _ http.ResponseWriter) *Engine {
+	for _, host := range pool {
+		if host.Available() {
+			return host
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (r *FirstSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// LeastConnSelection is a policy that selects the available
+// host with the fewest active and waiting detections.
+type LeastConnSelection struct{}
+
+// CaddyModule returns the Caddy module information.
+func (LeastConnSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.waf_chaitin.selection_policies.least_conn",
+		New: func() caddy.Module { return new(LeastConnSelection) },
+	}
+}
+
+// Select selects the available host with the least load. If more than
+// one host has the least load, one of them is chosen at random.
+func (LeastConnSelection) Select(pool EnginePool, _ *http.Request, _ http.ResponseWriter) *Engine {
+	var bestHost *Engine
+	var count int
+	leastLoad := -1
+
+	for _, host := range pool {
+		if !host.Available() {
+			continue
+		}
+		load := host.load()
+		if leastLoad == -1 || load < leastLoad {
+			leastLoad = load
+			count = 0
+		}
+
+		// among hosts with the same least load, perform a reservoir
+		// sample: https://en.wikipedia.org/wiki/Reservoir_sampling
+		if load == leastLoad {
+			count++
+			if weakrand.IntN(count) == 0 { //nolint:gosec
+				bestHost = host
+			}
+		}
+	}
+
+	return bestHost
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (r *LeastConnSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// P2CEWMASelection is a policy that samples two available hosts at random
+// and selects the one with the lower moving average detection latency
+// (power of two choices). Hosts without observed latency are preferred, so
+// new engines receive traffic.
+type P2CEWMASelection struct{}
+
+// CaddyModule returns the Caddy module information.
+func (P2CEWMASelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.waf_chaitin.selection_policies.p2c_ewma",
+		New: func() caddy.Module { return new(P2CEWMASelection) },
+	}
+}
+
+// Select returns an available host, if any.
+func (P2CEWMASelection) Select(pool EnginePool, _ *http.Request, _ http.ResponseWriter) *Engine {
+	available := make([]*Engine, 0, len(pool))
+	for _, host := range pool {
+		if host.Available() {
+			available = append(available, host)
+		}
+	}
+	switch len(available) {
+	case 0:
+		return nil
+	case 1:
+		return available[0]
+	}
+	i := weakrand.IntN(len(available))     //nolint:gosec
+	j := weakrand.IntN(len(available) - 1) //nolint:gosec
+	if j >= i {
+		j++
+	}
+	a, b := available[i], available[j]
+	if b.latency() < a.latency() {
+		return b
+	}
+	return a
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (r *P2CEWMASelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// WeightedRandomSelection is a policy that selects an available
+// host at random, in proportion to its weight.
+type WeightedRandomSelection struct{}
+
+// CaddyModule returns the Caddy module information.
+func (WeightedRandomSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.waf_chaitin.selection_policies.weighted_random",
+		New: func() caddy.Module { return new(WeightedRandomSelection) },
+	}
+}
+
+// Select returns an available host, if any.
+func (WeightedRandomSelection) Select(pool EnginePool, _ *http.Request, _ http.ResponseWriter) *Engine {
+	var selected *Engine
+	var total int
+	for _, host := range pool {
+		if !host.Available() {
+			continue
+		}
+		// weighted reservoir sample of size one
+		weight := host.Weight()
+		total += weight
+		if weakrand.IntN(total) < weight { //nolint:gosec
+			selected = host
+		}
+	}
+	return selected
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (r *WeightedRandomSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// WeightedRoundRobinSelection is a policy that selects available hosts
+// in turn, each as often as its weight, interleaved smoothly as in nginx.
+type WeightedRoundRobinSelection struct {
+	mu      sync.Mutex
+	current map[*Engine]int
+}
+
+// CaddyModule returns the Caddy module information.
+func (*WeightedRoundRobinSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.waf_chaitin.selection_policies.weighted_round_robin",
+		New: func() caddy.Module { return new(WeightedRoundRobinSelection) },
+	}
+}
+
+// Select returns an available host, if any.
+func (r *WeightedRoundRobinSelection) Select(pool EnginePool, _ *http.Request, _ http.ResponseWriter) *Engine {
+	best := r.peek(pool)
+	if best != nil {
+		r.commit(pool, best)
+	}
+	return best
+}
+
+// peek returns the available host the next selection from pool goes to,
+// without advancing the weights.
+func (r *WeightedRoundRobinSelection) peek(pool EnginePool) *Engine {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var best *Engine
+	var bestCurrent int
+	for _, host := range pool {
+		if !host.Available() {
+			continue
+		}
+		current := r.current[host] + host.Weight()
+		if best == nil || current > bestCurrent {
+			best, bestCurrent = host, current
+		}
+	}
+	return best
+}
+
+// commit advances the weights of the available hosts of pool for a
+// selection of chosen.
+func (r *WeightedRoundRobinSelection) commit(pool EnginePool, chosen *Engine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current == nil {
+		r.current = make(map[*Engine]int)
+	}
+	var total int
+	for _, host := range pool {
+		if !host.Available() && host != chosen {
+			continue
+		}
+		weight := host.Weight()
+		r.current[host] += weight
+		total += weight
+	}
+	r.current[chosen] -= total
+
+	// Forget hosts removed from their engine set. Hosts only left out of
+	// this pool, e.g. on a retry, keep their state so the weights hold.
+	if len(r.current) > len(pool) {
+		for host := range r.current {
+			if host.removed.Load() {
+				delete(r.current, host)
+			}
+		}
+	}
+}
+
+// selectionCommitter is implemented by selection policies whose state must
+// only advance for the engine selectEngine settles on, not for the engines
+// it skips because they do not admit the detection.
+type selectionCommitter interface {
+	peek(pool EnginePool) *Engine
+	commit(pool EnginePool, chosen *Engine)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (r *WeightedRoundRobinSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// IPHashSelection is a policy that selects a host
+// based on hashing the client IP of the request. The client IP is the one
+// Caddy determined through its trusted_proxies configuration.
+type IPHashSelection struct{}
+
+// CaddyModule returns the Caddy module information.
+func (IPHashSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.waf_chaitin.selection_policies.ip_hash",
+		New: func() caddy.Module { return new(IPHashSelection) },
+	}
+}
+
+// Select returns an available host, if any.
+func (IPHashSelection) Select(pool EnginePool, req *http.Request, _ http.ResponseWriter) *Engine {
+	return hashEngine(pool, clientIP(req))
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (r *IPHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// URIHashSelection is a policy that selects a
+// host by hashing the request URI.
+type URIHashSelection struct{}
+
+// CaddyModule returns the Caddy module information.
+func (URIHashSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.waf_chaitin.selection_policies.uri_hash",
+		New: func() caddy.Module { return new(URIHashSelection) },
+	}
+}
+
+// Select returns an available host, if any.
+func (URIHashSelection) Select(pool EnginePool, req *http.Request, _ http.ResponseWriter) *Engine {
+	return hashEngine(pool, req.RequestURI)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (r *URIHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// HeaderHashSelection is a policy that selects
+// a host based on a given request header.
+type HeaderHashSelection struct {
+	// The HTTP header field whose value is to be hashed.
+	Field string `json:"field,omitempty"`
+
+	// The fallback policy to use if the header is not present. Defaults to `random`.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.waf_chaitin.selection_policies inline_key=policy"`
+	fallback    Selector
+}
+
+// CaddyModule returns the Caddy module information.
+func (HeaderHashSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.waf_chaitin.selection_policies.header",
+		New: func() caddy.Module { return new(HeaderHashSelection) },
+	}
+}
+
+// Provision sets up the module.
+func (s *HeaderHashSelection) Provision(ctx caddy.Context) error {
+	if s.Field == "" {
+		return fmt.Errorf("header field is required")
+	}
+	fallback, err := loadFallbackPolicy(ctx, s, s.FallbackRaw)
+	if err != nil {
+		return err
+	}
+	s.fallback = fallback
+	return nil
+}
+
+// Select returns an available host, if any.
+func (s HeaderHashSelection) Select(pool EnginePool, req *http.Request, w http.ResponseWriter) *Engine {
+	// The Host header should be obtained from the req.Host field
+	// since net/http removes it from the header map.
+	if s.Field == "Host" && req.Host != "" {
+		return hashEngine(pool, req.Host)
+	}
+
+	val := req.Header.Get(s.Field)
+	if val == "" {
+		return selectFallback(s.fallback, pool, req, w)
+	}
+	return hashEngine(pool, val)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (s *HeaderHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	s.Field = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	fallback, err := unmarshalFallbackPolicy(d)
+	if err != nil {
+		return err
+	}
+	s.FallbackRaw = fallback
+	return nil
+}
+
+// CookieHashSelection is a policy that selects
+// a host based on the value of a request cookie.
+type CookieHashSelection struct {
+	// The name of the cookie whose value is to be hashed.
+	Name string `json:"name,omitempty"`
+
+	// The fallback policy to use if the cookie is not present. Defaults to `random`.
+	FallbackRaw json.RawMessage `json:"fallback,omitempty" caddy:"namespace=http.waf_chaitin.selection_policies inline_key=policy"`
+	fallback    Selector
+}
+
+// CaddyModule returns the Caddy module information.
+func (CookieHashSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.waf_chaitin.selection_policies.cookie",
+		New: func() caddy.Module { return new(CookieHashSelection) },
+	}
+}
+
+// Provision sets up the module.
+func (s *CookieHashSelection) Provision(ctx caddy.Context) error {
+	if s.Name == "" {
+		return fmt.Errorf("cookie name is required")
+	}
+	fallback, err := loadFallbackPolicy(ctx, s, s.FallbackRaw)
+	if err != nil {
+		return err
+	}
+	s.fallback = fallback
+	return nil
+}
+
+// Select returns an available host, if any.
+func (s CookieHashSelection) Select(pool EnginePool, req *http.Request, w http.ResponseWriter) *Engine {
+	cookie, err := req.Cookie(s.Name)
+	if err != nil || cookie.Value == "" {
+		return selectFallback(s.fallback, pool, req, w)
+	}
+	return hashEngine(pool, cookie.Value)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens.
+func (s *CookieHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	s.Name = d.Val()
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	fallback, err := unmarshalFallbackPolicy(d)
+	if err != nil {
+		return err
+	}
+	s.FallbackRaw = fallback
+	return nil
+}
+
+// loadFallbackPolicy loads the fallback policy of a hashing policy;
+// random selection if none is configured.
+func loadFallbackPolicy(ctx caddy.Context, policy any, raw json.RawMessage) (Selector, error) {
+	if raw == nil {
+		return RandomSelection{}, nil
+	}
+	mod, err := ctx.LoadModule(policy, "FallbackRaw")
+	if err != nil {
+		return nil, fmt.Errorf("loading fallback selection policy: %s", err)
+	}
+	return mod.(Selector), nil
+}
+
+// selectFallback selects with the fallback policy of an unprovisioned
+// hashing policy too.
+func selectFallback(fallback Selector, pool EnginePool, req *http.Request, w http.ResponseWriter) *Engine {
+	if fallback == nil {
+		return selectRandomHost(pool)
+	}
+	return fallback.Select(pool, req, w)
+}
+
+// unmarshalFallbackPolicy parses the optional block of a hashing policy:
+//
+//	{
+//	    fallback <policy>
+//	}
+func unmarshalFallbackPolicy(d *caddyfile.Dispenser) (json.RawMessage, error) {
+	var raw json.RawMessage
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "fallback":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			if raw != nil {
+				return nil, d.Err("fallback selection policy already specified")
+			}
+			name := d.Val()
+			modID := "http.waf_chaitin.selection_policies." + name
+			unm, err := caddyfile.UnmarshalModule(d, modID)
+			if err != nil {
+				return nil, err
+			}
+			sel, ok := unm.(Selector)
+			if !ok {
+				return nil, d.Errf("module %s (%T) is not a waf_chaitin.Selector", modID, unm)
+			}
+			raw = caddyconfig.JSONModuleObject(sel, "policy", name, nil)
+		default:
+			return nil, d.Errf("unrecognized option '%s'", d.Val())
+		}
+	}
+	return raw, nil
+}
+
+// clientIP returns the client IP Caddy determined for the request, or the
+// IP of the remote address.
+func clientIP(req *http.Request) string {
+	if ip, ok := caddyhttp.GetVar(req.Context(), caddyhttp.ClientIPVarKey).(string); ok && ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// hashEngine selects an available host for key by weighted rendezvous
+// hashing: each host scores the key and the highest score wins, so when a
+// host comes or goes only the keys it owns move.
+func hashEngine(pool EnginePool, key string) *Engine {
+	var best *Engine
+	var bestScore float64
+	for _, host := range pool {
+		if !host.Available() {
+			continue
+		}
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(host.addr))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(key))
+		// uniform in (0, 1)
+		u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		score := -float64(host.Weight()) / math.Log(u)
+		if best == nil || score > bestScore {
+			best, bestScore = host, score
+		}
+	}
+	return best
+}
+
+// mix64 is the splitmix64 finalizer; it spreads FNV's output over all bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
 // Interface guards
 var (
 	_ Selector = (*RandomSelection)(nil)
 	_ Selector = (*RoundRobinSelection)(nil)
+	_ Selector = (*FirstSelection)(nil)
+	_ Selector = (*LeastConnSelection)(nil)
+	_ Selector = (*P2CEWMASelection)(nil)
+	_ Selector = (*WeightedRandomSelection)(nil)
+	_ Selector = (*WeightedRoundRobinSelection)(nil)
+	_ Selector = (*IPHashSelection)(nil)
+	_ Selector = (*URIHashSelection)(nil)
+	_ Selector = (*HeaderHashSelection)(nil)
+	_ Selector = (*CookieHashSelection)(nil)
+
+	_ caddy.Provisioner = (*HeaderHashSelection)(nil)
+	_ caddy.Provisioner = (*CookieHashSelection)(nil)
+
+	_ selectionCommitter = (*WeightedRoundRobinSelection)(nil)
 )
@@ -1,8 +1,10 @@
 package caddy_waf_t1k
 
 import (
+	"context"
 	"errors"
 	"runtime/debug"
+	"slices"
 	"sync"
 	"time"
 
@@ -24,17 +26,21 @@ var poolEventReasonNames = [poolEventReasons]string{
 }
 
 var wafMetrics = struct {
-	once             sync.Once
-	requestsTotal    *prometheus.CounterVec
-	detectDuration   *prometheus.HistogramVec
-	enginesHealthy   *prometheus.GaugeVec
-	poolIdleConns    *prometheus.GaugeVec
-	poolActiveConns  *prometheus.GaugeVec
-	poolMaxConns     *prometheus.GaugeVec
-	poolWaitingReqs  *prometheus.GaugeVec
-	connectionErrors *prometheus.CounterVec
-	poolEvents       *prometheus.CounterVec
-	oversizeRequests prometheus.Counter
+	once                sync.Once
+	requestsTotal       *prometheus.CounterVec
+	detectDuration      *prometheus.HistogramVec
+	enginesHealthy      *prometheus.GaugeVec
+	engineCircuitState  *prometheus.GaugeVec
+	poolIdleConns       *prometheus.GaugeVec
+	poolActiveConns     *prometheus.GaugeVec
+	poolMaxConns        *prometheus.GaugeVec
+	poolWaitingReqs     *prometheus.GaugeVec
+	connectionErrors    *prometheus.CounterVec
+	poolEvents          *prometheus.CounterVec
+	oversizeRequests    prometheus.Counter
+	bansTotal           *prometheus.CounterVec
+	activeBans          *prometheus.GaugeVec
+	verdictCacheLookups *prometheus.CounterVec
 }{}
 
 func initWAFMetrics(registry *prometheus.Registry) {
@@ -63,6 +69,13 @@ func initWAFMetrics(registry *prometheus.Registry) {
 			Help:      "Health status of WAF engines.",
 		}, []string{"engine", "waf_instance"})
 
+		wafMetrics.engineCircuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "engine_circuit_state",
+			Help:      "Circuit breaker state of WAF engines: 0 closed, 1 open, 2 half-open.",
+		}, []string{"engine", "waf_instance"})
+
 		wafMetrics.poolIdleConns = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: ns,
 			Subsystem: sub,
@@ -111,6 +124,27 @@ func initWAFMetrics(registry *prometheus.Registry) {
 			Name:      "oversize_requests_total",
 			Help:      "Total requests whose body was truncated for WAF detection.",
 		})
+
+		wafMetrics.bansTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "bans_total",
+			Help:      "Total number of clients banned after repeated blocks.",
+		}, []string{"waf_instance"})
+
+		wafMetrics.activeBans = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "active_bans",
+			Help:      "Number of currently banned clients.",
+		}, []string{"waf_instance"})
+
+		wafMetrics.verdictCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "verdict_cache_lookups_total",
+			Help:      "Total number of WAF verdict cache lookups by result.",
+		}, []string{"result"})
 	})
 
 	logger := caddy.Log().Named("waf.metrics")
@@ -121,6 +155,7 @@ func initWAFMetrics(registry *prometheus.Registry) {
 		{name: "requests_total", collector: wafMetrics.requestsTotal},
 		{name: "detect_duration_seconds", collector: wafMetrics.detectDuration},
 		{name: "engines_healthy", collector: wafMetrics.enginesHealthy},
+		{name: "engine_circuit_state", collector: wafMetrics.engineCircuitState},
 		{name: "pool_idle_conns", collector: wafMetrics.poolIdleConns},
 		{name: "pool_active_conns", collector: wafMetrics.poolActiveConns},
 		{name: "pool_max_conns", collector: wafMetrics.poolMaxConns},
@@ -128,6 +163,9 @@ func initWAFMetrics(registry *prometheus.Registry) {
 		{name: "connection_errors_total", collector: wafMetrics.connectionErrors},
 		{name: "pool_events_total", collector: wafMetrics.poolEvents},
 		{name: "oversize_requests_total", collector: wafMetrics.oversizeRequests},
+		{name: "bans_total", collector: wafMetrics.bansTotal},
+		{name: "active_bans", collector: wafMetrics.activeBans},
+		{name: "verdict_cache_lookups_total", collector: wafMetrics.verdictCacheLookups},
 	} {
 		if err := registry.Register(metric.collector); err != nil {
 			var alreadyRegisteredErr prometheus.AlreadyRegisteredError
@@ -150,20 +188,20 @@ type enginePoolEventState struct {
 }
 
 type metricsPoolUpdater struct {
-	engines    EnginePool
+	engines    func() EnginePool
 	instanceID string
-	ctx        caddy.Context
+	ctx        context.Context
 	logger     *zap.Logger
 	eventState map[string]*enginePoolEventState
 }
 
-func newMetricsPoolUpdater(m *CaddyWAF) *metricsPoolUpdater {
+func newMetricsPoolUpdater(g *engineGroup) *metricsPoolUpdater {
 	return &metricsPoolUpdater{
-		engines:    m.Engines,
-		instanceID: m.instanceID,
-		ctx:        m.ctx,
-		logger:     m.logger.Named("waf.metrics"),
-		eventState: make(map[string]*enginePoolEventState, len(m.Engines)),
+		engines:    g.current,
+		instanceID: g.instanceID,
+		ctx:        g.ctx,
+		logger:     g.logger.Named("waf.metrics"),
+		eventState: make(map[string]*enginePoolEventState),
 	}
 }
 
@@ -196,13 +234,22 @@ func (u *metricsPoolUpdater) start() {
 }
 
 func (u *metricsPoolUpdater) update() {
-	for _, engine := range u.engines {
+	engines := u.engines()
+	for addr := range u.eventState {
+		if !slices.ContainsFunc(engines, func(e *Engine) bool { return e.addr == addr }) {
+			delete(u.eventState, addr)
+		}
+	}
+	for _, engine := range engines {
 		healthy := 0.0
 		if engine.Available() {
 			healthy = 1.0
 		}
 		labels := prometheus.Labels{"engine": engine.addr, "waf_instance": u.instanceID}
 		wafMetrics.enginesHealthy.With(labels).Set(healthy)
+		if engine.breaker != nil {
+			wafMetrics.engineCircuitState.With(labels).Set(float64(engine.breaker.currentState()))
+		}
 
 		stats := engine.poolStats()
 		wafMetrics.poolIdleConns.With(labels).Set(float64(stats.IdleConns))
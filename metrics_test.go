@@ -24,6 +24,7 @@ func TestClassifyConnectionError(t *testing.T) {
 		{"client error", errors.New("context canceled"), reasonClientError},
 		{"other engine error", errors.New("something unexpected"), reasonOther},
 		{"nil error", nil, reasonOther},
+		{"detect timeout", errDetectTimeout, reasonDetectTimeout},
 		{"client body connection reset", errors.New("read request body: read tcp 1.2.3.4:443->5.6.7.8:12345: read: connection reset by peer"), reasonClientError},
 		{"engine-side connection reset", errors.New("read tcp 192.0.2.1:56702->198.51.100.10:8000: read: connection reset by peer"), reasonOther},
 	}
@@ -1,32 +1,332 @@
 package caddy_waf_t1k
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/chaitin/t1k-go/detection"
 	"go.uber.org/zap"
 )
 
+// Block response formats, selected from the request's Accept header.
+const (
+	formatHTML = "html"
+	formatJSON = "json"
+	formatText = "text"
+)
+
+// Block actions.
+const (
+	// blockActionRespond writes the block response directly.
+	blockActionRespond = "respond"
+	// blockActionError returns a caddyhttp.HandlerError so handle_errors routes
+	// can render the block page.
+	blockActionError = "error"
+)
+
+// Default status codes for blocked requests and for requests rejected
+// because detection failed with fail_mode closed.
+const (
+	defaultBlockStatus = http.StatusForbidden
+	defaultFailStatus  = http.StatusServiceUnavailable
+)
+
+var formatContentTypes = map[string]string{
+	formatHTML: "text/html; charset=utf-8",
+	formatJSON: "application/json",
+	formatText: "text/plain; charset=utf-8",
+}
+
+const defaultHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Request blocked</title></head>
+<body>
+<h1>Request blocked</h1>
+<p>This request was blocked by the web application firewall.</p>
+<p>Event ID: <code>{{.EventID}}</code></p>
+</body>
+</html>
+`
+
+const defaultJSONTemplate = `{"message":"Intercept illegal requests","event_id":{{json .EventID}}}`
+
+const defaultTextTemplate = `Request blocked by the web application firewall. Event ID: {{.EventID}}
+`
+
+const defaultFailHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Service unavailable</title></head>
+<body>
+<h1>Service unavailable</h1>
+<p>The request could not be inspected by the web application firewall. Please try again later.</p>
+</body>
+</html>
+`
+
+const defaultFailJSONTemplate = `{"message":"Request could not be inspected"}`
+
+const defaultFailTextTemplate = `The request could not be inspected by the web application firewall. Please try again later.
+`
+
+// bodyTemplate is implemented by both text/template and html/template.
+type bodyTemplate interface {
+	Execute(io.Writer, any) error
+}
+
+var templateFuncs = map[string]any{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// defaultBlockTemplates and defaultFailTemplates are the built-in bodies used
+// for formats without a configured template.
+var (
+	defaultBlockTemplates = mustParseBodyTemplates(defaultHTMLTemplate, defaultJSONTemplate, defaultTextTemplate)
+	defaultFailTemplates  = mustParseBodyTemplates(defaultFailHTMLTemplate, defaultFailJSONTemplate, defaultFailTextTemplate)
+)
+
+func mustParseBodyTemplates(html, json, text string) map[string]bodyTemplate {
+	return map[string]bodyTemplate{
+		formatHTML: htmltemplate.Must(htmltemplate.New(formatHTML).Funcs(templateFuncs).Parse(html)),
+		formatJSON: texttemplate.Must(texttemplate.New(formatJSON).Funcs(templateFuncs).Parse(json)),
+		formatText: texttemplate.Must(texttemplate.New(formatText).Funcs(templateFuncs).Parse(text)),
+	}
+}
+
+// parseBodyTemplate parses src as the template for format. HTML bodies use
+// html/template so interpolated values are escaped.
+func parseBodyTemplate(format, src string) (bodyTemplate, error) {
+	switch format {
+	case formatHTML:
+		return htmltemplate.New(format).Funcs(templateFuncs).Parse(src)
+	case formatJSON, formatText:
+		return texttemplate.New(format).Funcs(templateFuncs).Parse(src)
+	default:
+		return nil, fmt.Errorf("unrecognized response format %q, expected %s, %s or %s", format, formatHTML, formatJSON, formatText)
+	}
+}
+
+// BlockResponse configures the response written for intercepted requests:
+// blocked requests, and with fail_mode closed, requests that could not be
+// inspected.
+//
+// Templates are executed with the event ID, request host, path and method as
+// {{.EventID}}, {{.Host}}, {{.Path}} and {{.Method}}. Any Caddy placeholder is
+// available via {{.Placeholder "http.request.uri"}}, and {{json .Value}}
+// renders a value as a JSON literal.
+type BlockResponse struct {
+	// StatusCode is the HTTP status. Default 403 for blocked requests and
+	// 503 for fail-closed requests.
+	StatusCode int `json:"status_code,omitempty"`
+
+	// Templates maps a response format (html, json or text) to an inline
+	// body template. The format is negotiated from the Accept header.
+	Templates map[string]string `json:"templates,omitempty"`
+
+	// TemplateFiles maps a response format to a body template file.
+	// A file takes precedence over an inline template of the same format.
+	TemplateFiles map[string]string `json:"template_files,omitempty"`
+
+	templates map[string]bodyTemplate
+}
+
+// provision parses the configured templates.
+func (b *BlockResponse) provision() error {
+	b.templates = make(map[string]bodyTemplate, len(formatContentTypes))
+	for format, src := range b.Templates {
+		tpl, err := parseBodyTemplate(format, src)
+		if err != nil {
+			return fmt.Errorf("parsing %s template: %v", format, err)
+		}
+		b.templates[format] = tpl
+	}
+	for format, path := range b.TemplateFiles {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading %s template file: %v", format, err)
+		}
+		tpl, err := parseBodyTemplate(format, string(src))
+		if err != nil {
+			return fmt.Errorf("parsing %s template file %s: %v", format, path, err)
+		}
+		b.templates[format] = tpl
+	}
+	return nil
+}
+
+func (b *BlockResponse) validate() error {
+	// 1xx codes are informational: WriteHeader would not send them as the
+	// final response.
+	if b.StatusCode != 0 && (b.StatusCode < 200 || b.StatusCode > 599) {
+		return fmt.Errorf("block response status code %d out of range 200-599", b.StatusCode)
+	}
+	return nil
+}
+
+func (b *BlockResponse) statusCode(fallback int) int {
+	if b == nil || b.StatusCode == 0 {
+		return fallback
+	}
+	return b.StatusCode
+}
+
+func (b *BlockResponse) template(format string, defaults map[string]bodyTemplate) bodyTemplate {
+	if b != nil {
+		if tpl, ok := b.templates[format]; ok {
+			return tpl
+		}
+	}
+	return defaults[format]
+}
+
+// blockTemplateData is the value block response templates are executed with.
+type blockTemplateData struct {
+	EventID    string
+	Host       string
+	Path       string
+	Method     string
+	StatusCode int
+
+	repl *caddy.Replacer
+}
+
+// Placeholder returns the value of a Caddy placeholder such as
+// "http.request.uri", or an empty string if it is unknown.
+func (d blockTemplateData) Placeholder(key string) string {
+	if d.repl == nil {
+		return ""
+	}
+	v, _ := d.repl.GetString(key)
+	return v
+}
+
+// negotiateFormat picks the block response format that best matches the
+// Accept header. Requests without a preference get JSON.
+func negotiateFormat(accept string) string {
+	best, bestQ := formatJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		var format string
+		switch {
+		case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+			format = formatHTML
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			format = formatJSON
+		case mediaType == "text/plain":
+			format = formatText
+		case mediaType == "*/*":
+			format = formatJSON
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// BlockedError is the error returned for blocked requests when the block
+// action is "error". Its event ID is also the handler error's ID, exposed to
+// handle_errors routes as {http.error.id}.
+type BlockedError struct {
+	EventID string
+}
+
+func (e BlockedError) Error() string {
+	if e.EventID == "" {
+		return "request blocked by WAF"
+	}
+	return "request blocked by WAF, event ID " + e.EventID
+}
+
+// ErrFailClosed is the error returned for requests rejected by fail_mode
+// closed when the block action is "error".
+var ErrFailClosed = errors.New("request rejected: WAF detection unavailable")
+
 // redirectIntercept Intercept request
-func (m *CaddyWAF) redirectIntercept(w http.ResponseWriter, result *detection.Result) error {
-	// var tpl *template.Template
-	w.Header().Set("Content-Type", "application/json")
+func (m *CaddyWAF) redirectIntercept(w http.ResponseWriter, r *http.Request, result *detection.Result) error {
 	w.Header().Set("X-Event-ID", result.EventID())
-	w.WriteHeader(http.StatusNotImplemented)
-	BlockMessage := map[string]any{
-		"message":  "Intercept illegal requests",
-		"event_id": result.EventID(),
+	return m.blockIntercept(w, r, result.EventID())
+}
+
+// blockIntercept writes the block response, or returns it as a handler error
+// under block_action error. eventID is empty for requests blocked without
+// detection.
+func (m *CaddyWAF) blockIntercept(w http.ResponseWriter, r *http.Request, eventID string) error {
+	status := m.BlockResponse.statusCode(defaultBlockStatus)
+	if m.BlockAction == blockActionError {
+		herr := caddyhttp.Error(status, BlockedError{EventID: eventID})
+		if eventID != "" {
+			herr.ID = eventID
+		}
+		return herr
+	}
+	m.writeResponse(w, r, m.BlockResponse, status, defaultBlockTemplates, eventID)
+	return nil
+}
+
+// failIntercept rejects a request that could not be inspected under fail_mode closed.
+func (m *CaddyWAF) failIntercept(w http.ResponseWriter, r *http.Request) error {
+	status := m.FailResponse.statusCode(defaultFailStatus)
+	if m.BlockAction == blockActionError {
+		return caddyhttp.Error(status, ErrFailClosed)
 	}
-	blockMessage, err := json.Marshal(BlockMessage)
-	if err != nil {
-		m.logger.Error("failed to marshal block message", zap.Error(err))
+	m.writeResponse(w, r, m.FailResponse, status, defaultFailTemplates, "")
+	return nil
+}
+
+// writeResponse renders resp in the format negotiated from the Accept header,
+// falling back to defaults for formats resp has no template for.
+func (m *CaddyWAF) writeResponse(w http.ResponseWriter, r *http.Request, resp *BlockResponse, status int, defaults map[string]bodyTemplate, eventID string) {
+	format := negotiateFormat(r.Header.Get("Accept"))
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	data := blockTemplateData{
+		EventID:    eventID,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Method:     r.Method,
+		StatusCode: status,
+		repl:       repl,
 	}
-	_, err = w.Write(blockMessage)
-	if err != nil {
+
+	var body bytes.Buffer
+	if err := resp.template(format, defaults).Execute(&body, data); err != nil {
+		m.logger.Error("failed to render response template",
+			zap.String("format", format),
+			zap.Error(err))
+		body.Reset()
+		if err := defaults[format].Execute(&body, data); err != nil {
+			m.logger.Error("failed to render default response", zap.Error(err))
+		}
+	}
+
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	w.WriteHeader(status)
+	if _, err := w.Write(body.Bytes()); err != nil {
 		m.logger.Error("failed to write block message", zap.Error(err))
 	}
-	return nil
-	// tpl, _ = template.New("default_listing").Parse(defaultWafTemplate)
-	// return tpl.Execute(w, result.EventID())
 }
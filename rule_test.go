@@ -0,0 +1,268 @@
+package caddy_waf_t1k
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chaitin/t1k-go/detection"
+	"go.uber.org/zap"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", formatJSON},
+		{"*/*", formatJSON},
+		{"application/json", formatJSON},
+		{"application/problem+json", formatJSON},
+		{"text/plain", formatText},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", formatHTML},
+		{"text/plain;q=0.5, application/json;q=0.9", formatJSON},
+		{"text/html;q=0.1, text/plain", formatText},
+		{"image/png", formatJSON},
+		{"text/html;q=bogus, text/plain;q=0.2", formatText},
+	}
+	for _, tt := range tests {
+		if got := negotiateFormat(tt.accept); got != tt.want {
+			t.Errorf("negotiateFormat(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func blockedResult(eventID string) *detection.Result {
+	return &detection.Result{Head: '?', ExtraBody: []byte("<!-- event_id: " + eventID + " -->")}
+}
+
+func blockedRequest(accept string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/admin?x=1", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	return req
+}
+
+func TestRedirectInterceptDefaults(t *testing.T) {
+	m := &CaddyWAF{logger: zap.NewNop()}
+	result := blockedResult("evt1")
+
+	for _, tt := range []struct {
+		accept      string
+		contentType string
+		contains    string
+	}{
+		{"", "application/json", `"event_id":"evt1"`},
+		{"text/html", "text/html; charset=utf-8", "<code>evt1</code>"},
+		{"text/plain", "text/plain; charset=utf-8", "Event ID: evt1"},
+	} {
+		rr := httptest.NewRecorder()
+		if err := m.redirectIntercept(rr, blockedRequest(tt.accept), result); err != nil {
+			t.Fatalf("redirectIntercept: %v", err)
+		}
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("Accept %q: status = %d, want 403", tt.accept, rr.Code)
+		}
+		if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("Accept %q: Content-Type = %q, want %q", tt.accept, got, tt.contentType)
+		}
+		if got := rr.Header().Get("X-Event-ID"); got != "evt1" {
+			t.Errorf("Accept %q: X-Event-ID = %q, want evt1", tt.accept, got)
+		}
+		if !strings.Contains(rr.Body.String(), tt.contains) {
+			t.Errorf("Accept %q: body %q does not contain %q", tt.accept, rr.Body.String(), tt.contains)
+		}
+	}
+}
+
+func TestRedirectInterceptDefaultJSONIsValid(t *testing.T) {
+	m := &CaddyWAF{logger: zap.NewNop()}
+	rr := httptest.NewRecorder()
+	_ = m.redirectIntercept(rr, blockedRequest("application/json"), blockedResult("abc123"))
+	var body map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("block body is not valid JSON: %v (%q)", err, rr.Body.String())
+	}
+	if body["event_id"] != "abc123" {
+		t.Errorf("event_id = %q, want %q", body["event_id"], "abc123")
+	}
+}
+
+func TestRedirectInterceptCustomTemplates(t *testing.T) {
+	dir := t.TempDir()
+	htmlFile := filepath.Join(dir, "blocked.html")
+	if err := os.WriteFile(htmlFile, []byte(`<p>{{.EventID}} on {{.Host}}{{.Path}}</p>`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := &BlockResponse{
+		StatusCode:    451,
+		Templates:     map[string]string{formatText: `blocked {{.Method}} {{.Placeholder "http.request.uri"}}`},
+		TemplateFiles: map[string]string{formatHTML: htmlFile},
+	}
+	if err := resp.provision(); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	m := &CaddyWAF{logger: zap.NewNop(), BlockResponse: resp}
+	result := blockedResult("evt2")
+
+	rr := httptest.NewRecorder()
+	_ = m.redirectIntercept(rr, blockedRequest("text/html"), result)
+	if rr.Code != 451 {
+		t.Errorf("status = %d, want 451", rr.Code)
+	}
+	if got, want := rr.Body.String(), "<p>evt2 on example.com/admin</p>"; got != want {
+		t.Errorf("html body = %q, want %q", got, want)
+	}
+
+	req := blockedRequest("text/plain")
+	repl := caddy.NewReplacer()
+	repl.Set("http.request.uri", req.RequestURI)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+	rr = httptest.NewRecorder()
+	_ = m.redirectIntercept(rr, req, result)
+	if got, want := rr.Body.String(), "blocked GET http://example.com/admin?x=1"; got != want {
+		t.Errorf("text body = %q, want %q", got, want)
+	}
+
+	// Formats without a configured template fall back to the built-in body.
+	rr = httptest.NewRecorder()
+	_ = m.redirectIntercept(rr, blockedRequest("application/json"), result)
+	if !strings.Contains(rr.Body.String(), `"event_id":"evt2"`) {
+		t.Errorf("json body = %q, want built-in body", rr.Body.String())
+	}
+}
+
+func TestRedirectInterceptEscapesHTML(t *testing.T) {
+	resp := &BlockResponse{Templates: map[string]string{formatHTML: `<p>{{.Path}}</p>`}}
+	if err := resp.provision(); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	m := &CaddyWAF{logger: zap.NewNop(), BlockResponse: resp}
+	req := blockedRequest("text/html")
+	req.URL.Path = "/<script>"
+	rr := httptest.NewRecorder()
+	_ = m.redirectIntercept(rr, req, &detection.Result{Head: '?'})
+	if strings.Contains(rr.Body.String(), "<script>") {
+		t.Errorf("html body not escaped: %q", rr.Body.String())
+	}
+}
+
+func TestBlockResponseProvisionErrors(t *testing.T) {
+	for name, resp := range map[string]*BlockResponse{
+		"unknown format": {Templates: map[string]string{"xml": "<x/>"}},
+		"bad template":   {Templates: map[string]string{formatText: "{{.EventID"}},
+		"missing file":   {TemplateFiles: map[string]string{formatHTML: filepath.Join(t.TempDir(), "missing.html")}},
+	} {
+		if err := resp.provision(); err == nil {
+			t.Errorf("%s: expected provision error", name)
+		}
+	}
+}
+
+func TestValidateBlockResponseStatus(t *testing.T) {
+	for _, tt := range []struct {
+		status  int
+		wantErr bool
+	}{
+		{0, false},
+		{100, true},
+		{199, true},
+		{200, false},
+		{599, false},
+		{600, true},
+		{1000, true},
+	} {
+		m := &CaddyWAF{BlockResponse: &BlockResponse{StatusCode: tt.status}}
+		if err := m.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("status %d: Validate() error = %v, want error %v", tt.status, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRedirectInterceptErrorAction(t *testing.T) {
+	m := &CaddyWAF{
+		logger:        zap.NewNop(),
+		BlockAction:   blockActionError,
+		BlockResponse: &BlockResponse{StatusCode: 418},
+	}
+	rr := httptest.NewRecorder()
+	err := m.redirectIntercept(rr, blockedRequest("text/html"), blockedResult("evt3"))
+
+	var herr caddyhttp.HandlerError
+	if !errors.As(err, &herr) {
+		t.Fatalf("error = %v, want caddyhttp.HandlerError", err)
+	}
+	if herr.StatusCode != 418 {
+		t.Errorf("StatusCode = %d, want 418", herr.StatusCode)
+	}
+	if herr.ID != "evt3" {
+		t.Errorf("ID = %q, want evt3", herr.ID)
+	}
+	var blocked BlockedError
+	if !errors.As(err, &blocked) || blocked.EventID != "evt3" {
+		t.Errorf("error %v does not wrap BlockedError{evt3}", err)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("error action wrote a body: %q", rr.Body.String())
+	}
+	if got := rr.Header().Get("X-Event-ID"); got != "evt3" {
+		t.Errorf("X-Event-ID = %q, want evt3", got)
+	}
+}
+
+func TestRedirectInterceptErrorActionWithoutEventID(t *testing.T) {
+	m := &CaddyWAF{logger: zap.NewNop(), BlockAction: blockActionError}
+	err := m.redirectIntercept(httptest.NewRecorder(), blockedRequest(""), &detection.Result{Head: '?'})
+	var herr caddyhttp.HandlerError
+	if !errors.As(err, &herr) {
+		t.Fatalf("error = %v, want caddyhttp.HandlerError", err)
+	}
+	if herr.StatusCode != defaultBlockStatus {
+		t.Errorf("StatusCode = %d, want %d", herr.StatusCode, defaultBlockStatus)
+	}
+	if herr.ID == "" {
+		t.Error("expected a generated error ID when the engine returned no event ID")
+	}
+}
+
+func TestFailIntercept(t *testing.T) {
+	m := &CaddyWAF{logger: zap.NewNop()}
+	rr := httptest.NewRecorder()
+	if err := m.failIntercept(rr, blockedRequest("text/plain")); err != nil {
+		t.Fatalf("failIntercept: %v", err)
+	}
+	if rr.Code != defaultFailStatus {
+		t.Errorf("status = %d, want %d", rr.Code, defaultFailStatus)
+	}
+	if !strings.Contains(rr.Body.String(), "could not be inspected") {
+		t.Errorf("body = %q, want built-in fail body", rr.Body.String())
+	}
+
+	resp := &BlockResponse{StatusCode: 502, Templates: map[string]string{formatJSON: `{"retry":true}`}}
+	if err := resp.provision(); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	m.FailResponse = resp
+	rr = httptest.NewRecorder()
+	_ = m.failIntercept(rr, blockedRequest("application/json"))
+	if rr.Code != 502 || rr.Body.String() != `{"retry":true}` {
+		t.Errorf("got %d %q, want 502 {\"retry\":true}", rr.Code, rr.Body.String())
+	}
+
+	m.BlockAction = blockActionError
+	err := m.failIntercept(httptest.NewRecorder(), blockedRequest(""))
+	var herr caddyhttp.HandlerError
+	if !errors.As(err, &herr) || herr.StatusCode != 502 || !errors.Is(err, ErrFailClosed) {
+		t.Errorf("error = %v, want HandlerError 502 wrapping ErrFailClosed", err)
+	}
+}
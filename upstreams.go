@@ -0,0 +1,443 @@
+package caddy_waf_t1k
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(AEngineSource{})
+	caddy.RegisterModule(SRVEngineSource{})
+	caddy.RegisterModule(FileEngineSource{})
+}
+
+// defaultFileWatchInterval is how often a file engine source checks its file
+// for changes when watch_interval is not set.
+const defaultFileWatchInterval = time.Second
+
+// EngineSource provides engine addresses dynamically. Modules in the
+// http.waf_chaitin.upstreams namespace implement it.
+//
+// GetEngineAddrs is called every resolve_interval. The returned addresses
+// must be "ip:port" or "unix//path/to/socket".
+type EngineSource interface {
+	GetEngineAddrs(ctx context.Context) ([]string, error)
+}
+
+// EngineSourceWatcher is implemented by sources that can report changes
+// without waiting for the next refresh. Watch calls changed whenever the
+// addresses may have changed, until ctx is done.
+type EngineSourceWatcher interface {
+	Watch(ctx context.Context, changed func())
+}
+
+// newLookupResolver returns a resolver that queries the given "host:port"
+// DNS servers in order, or the system resolver if there are none.
+func newLookupResolver(servers []string) *net.Resolver {
+	if len(servers) == 0 {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			var err error
+			for _, server := range servers {
+				var conn net.Conn
+				if conn, err = d.DialContext(ctx, network, server); err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+}
+
+// unmarshalResolvers parses the arguments of a resolvers subdirective.
+func unmarshalResolvers(d *caddyfile.Dispenser) ([]string, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return nil, d.ArgErr()
+	}
+	for i, server := range args {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			args[i] = net.JoinHostPort(server, "53")
+		}
+	}
+	return args, nil
+}
+
+// AEngineSource gets engine addresses from DNS A/AAAA records, one engine
+// per record.
+type AEngineSource struct {
+	// The domain name to look up.
+	Name string `json:"name,omitempty"`
+
+	// The port of the engines.
+	Port string `json:"port,omitempty"`
+
+	// DNS servers ("host:port") to query instead of the system resolver.
+	Resolvers []string `json:"resolvers,omitempty"`
+
+	resolver *net.Resolver
+}
+
+// CaddyModule returns the Caddy module information.
+func (AEngineSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.waf_chaitin.upstreams.a",
+		New: func() caddy.Module { return new(AEngineSource) },
+	}
+}
+
+// Provision sets up the source.
+func (s *AEngineSource) Provision(_ caddy.Context) error {
+	s.resolver = newLookupResolver(s.Resolvers)
+	return nil
+}
+
+// Validate ensures the source configuration is valid.
+func (s *AEngineSource) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("a upstreams: name is required")
+	}
+	if port, err := strconv.ParseUint(s.Port, 10, 16); err != nil || port == 0 {
+		return fmt.Errorf("a upstreams: invalid port %q", s.Port)
+	}
+	return nil
+}
+
+// GetEngineAddrs returns one "ip:port" address per A/AAAA record.
+func (s *AEngineSource) GetEngineAddrs(ctx context.Context) ([]string, error) {
+	ips, err := s.resolver.LookupIPAddr(ctx, s.Name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.IP.String(), s.Port))
+	}
+	slices.Sort(addrs)
+	return addrs, nil
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	upstreams a [<name> <port>] {
+//	    name      <name>
+//	    port      <port>
+//	    resolvers <servers...>
+//	}
+func (s *AEngineSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume source name
+	if d.NextArg() {
+		s.Name = d.Val()
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		s.Port = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Name = d.Val()
+		case "port":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Port = d.Val()
+		case "resolvers":
+			servers, err := unmarshalResolvers(d)
+			if err != nil {
+				return err
+			}
+			s.Resolvers = append(s.Resolvers, servers...)
+		default:
+			return d.Errf("unrecognized a upstreams option '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// SRVEngineSource gets engine addresses from DNS SRV records. The target and
+// port of each record become an engine; targets are resolved to IPs.
+type SRVEngineSource struct {
+	// The service label, e.g. "t1k". If Service and Proto are empty, Name
+	// is queried directly.
+	Service string `json:"service,omitempty"`
+
+	// The protocol label, e.g. "tcp".
+	Proto string `json:"proto,omitempty"`
+
+	// The domain name, e.g. "safeline.waf.svc.cluster.local".
+	Name string `json:"name,omitempty"`
+
+	// DNS servers ("host:port") to query instead of the system resolver.
+	Resolvers []string `json:"resolvers,omitempty"`
+
+	resolver *net.Resolver
+}
+
+// CaddyModule returns the Caddy module information.
+func (SRVEngineSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.waf_chaitin.upstreams.srv",
+		New: func() caddy.Module { return new(SRVEngineSource) },
+	}
+}
+
+// Provision sets up the source.
+func (s *SRVEngineSource) Provision(_ caddy.Context) error {
+	s.resolver = newLookupResolver(s.Resolvers)
+	return nil
+}
+
+// Validate ensures the source configuration is valid.
+func (s *SRVEngineSource) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("srv upstreams: name is required")
+	}
+	if (s.Service == "") != (s.Proto == "") {
+		return fmt.Errorf("srv upstreams: service and proto must be set together")
+	}
+	return nil
+}
+
+// GetEngineAddrs returns one "ip:port" address per resolved SRV target.
+func (s *SRVEngineSource) GetEngineAddrs(ctx context.Context) ([]string, error) {
+	_, records, err := s.resolver.LookupSRV(ctx, s.Service, s.Proto, s.Name)
+	if err != nil && len(records) == 0 {
+		return nil, err
+	}
+	var addrs []string
+	for _, rec := range records {
+		port := strconv.Itoa(int(rec.Port))
+		target := strings.TrimSuffix(rec.Target, ".")
+		if ip := net.ParseIP(target); ip != nil {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+			continue
+		}
+		ips, err := s.resolver.LookupIPAddr(ctx, target)
+		if err != nil {
+			return nil, fmt.Errorf("resolving SRV target %s: %v", target, err)
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip.IP.String(), port))
+		}
+	}
+	slices.Sort(addrs)
+	return slices.Compact(addrs), nil
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	upstreams srv [<name>] {
+//	    service   <service>
+//	    proto     <proto>
+//	    name      <name>
+//	    resolvers <servers...>
+//	}
+func (s *SRVEngineSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume source name
+	if d.NextArg() {
+		s.Name = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "service":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Service = d.Val()
+		case "proto":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Proto = d.Val()
+		case "name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Name = d.Val()
+		case "resolvers":
+			servers, err := unmarshalResolvers(d)
+			if err != nil {
+				return err
+			}
+			s.Resolvers = append(s.Resolvers, servers...)
+		default:
+			return d.Errf("unrecognized srv upstreams option '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// FileEngineSource reads engine addresses from a file: either a JSON array
+// of strings, or one address per line with blank lines and lines starting
+// with "#" ignored. The file is watched for changes.
+type FileEngineSource struct {
+	// Path of the address file.
+	Path string `json:"path,omitempty"`
+
+	// WatchInterval is how often the file is checked for changes.
+	// Default 1s.
+	WatchInterval caddy.Duration `json:"watch_interval,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (FileEngineSource) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.waf_chaitin.upstreams.file",
+		New: func() caddy.Module { return new(FileEngineSource) },
+	}
+}
+
+// Validate ensures the source configuration is valid.
+func (s *FileEngineSource) Validate() error {
+	if s.Path == "" {
+		return fmt.Errorf("file upstreams: path is required")
+	}
+	if s.WatchInterval < 0 {
+		return fmt.Errorf("file upstreams: watch_interval must be >= 0")
+	}
+	return nil
+}
+
+// GetEngineAddrs reads and parses the address file.
+func (s *FileEngineSource) GetEngineAddrs(_ context.Context) ([]string, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parseAddrList(data)
+}
+
+// Watch calls changed whenever the file's size or modification time changes.
+func (s *FileEngineSource) Watch(ctx context.Context, changed func()) {
+	interval := time.Duration(s.WatchInterval)
+	if interval == 0 {
+		interval = defaultFileWatchInterval
+	}
+	last := s.stat()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if cur := s.stat(); cur != last {
+					last = cur
+					changed()
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stat returns a value that changes when the file is modified.
+func (s *FileEngineSource) stat() string {
+	fi, err := os.Stat(s.Path)
+	if err != nil {
+		return ""
+	}
+	return fi.ModTime().String() + "/" + strconv.FormatInt(fi.Size(), 10)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	upstreams file [<path>] {
+//	    path           <path>
+//	    watch_interval <duration>
+//	}
+func (s *FileEngineSource) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume source name
+	if d.NextArg() {
+		s.Path = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Path = d.Val()
+		case "watch_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid watch_interval value: %v", err)
+			}
+			s.WatchInterval = caddy.Duration(dur)
+		default:
+			return d.Errf("unrecognized file upstreams option '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+// parseAddrList parses a JSON array of addresses or a line list. It is used
+// for engine addresses and IP ranges.
+func parseAddrList(data []byte) ([]string, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var addrs []string
+		if err := json.Unmarshal(trimmed, &addrs); err != nil {
+			return nil, fmt.Errorf("parsing JSON address list: %v", err)
+		}
+		return addrs, nil
+	}
+	var addrs []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	return addrs, sc.Err()
+}
+
+// Interface guards
+var (
+	_ EngineSource          = (*AEngineSource)(nil)
+	_ EngineSource          = (*SRVEngineSource)(nil)
+	_ EngineSource          = (*FileEngineSource)(nil)
+	_ EngineSourceWatcher   = (*FileEngineSource)(nil)
+	_ caddy.Provisioner     = (*AEngineSource)(nil)
+	_ caddy.Validator       = (*AEngineSource)(nil)
+	_ caddy.Provisioner     = (*SRVEngineSource)(nil)
+	_ caddy.Validator       = (*SRVEngineSource)(nil)
+	_ caddy.Validator       = (*FileEngineSource)(nil)
+	_ caddyfile.Unmarshaler = (*AEngineSource)(nil)
+	_ caddyfile.Unmarshaler = (*SRVEngineSource)(nil)
+	_ caddyfile.Unmarshaler = (*FileEngineSource)(nil)
+)
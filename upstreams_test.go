@@ -0,0 +1,249 @@
+package caddy_waf_t1k
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestParseEngineAddrList(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "json", data: ` ["192.0.2.1:8000", "unix//run/detector.sock"]`, want: []string{"192.0.2.1:8000", "unix//run/detector.sock"}},
+		{name: "lines", data: "# detectors\n192.0.2.1:8000\n\n  192.0.2.2:8000  \n", want: []string{"192.0.2.1:8000", "192.0.2.2:8000"}},
+		{name: "empty", data: "", want: nil},
+		{name: "bad json", data: `["192.0.2.1:8000",`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAddrList([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseAddrList = %v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseAddrList: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("parseAddrList = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileEngineSourceWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "engines.txt")
+	if err := os.WriteFile(path, []byte("192.0.2.1:8000\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := &FileEngineSource{Path: path, WatchInterval: caddy.Duration(10 * time.Millisecond)}
+	got, err := s.GetEngineAddrs(context.Background())
+	if err != nil {
+		t.Fatalf("GetEngineAddrs: %v", err)
+	}
+	if want := []string{"192.0.2.1:8000"}; !slices.Equal(got, want) {
+		t.Fatalf("GetEngineAddrs = %v, want %v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	s.Watch(ctx, func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	if err := os.WriteFile(path, []byte("192.0.2.1:8000\n192.0.2.2:8000\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("file change was not reported")
+	}
+	got, _ = s.GetEngineAddrs(context.Background())
+	if want := []string{"192.0.2.1:8000", "192.0.2.2:8000"}; !slices.Equal(got, want) {
+		t.Fatalf("GetEngineAddrs after change = %v, want %v", got, want)
+	}
+}
+
+type fakeEngineSource struct {
+	addrs []string
+	err   error
+}
+
+func (s *fakeEngineSource) GetEngineAddrs(context.Context) ([]string, error) {
+	return s.addrs, s.err
+}
+
+func TestEngineResolverSource(t *testing.T) {
+	source := &fakeEngineSource{addrs: []string{"192.0.2.11:8000", "tcp/192.0.2.12:8000"}}
+	r := newEngineResolver(mustParseEngineAddrs(t, "192.0.2.1:8000"), source)
+	if !r.needsRefresh() {
+		t.Fatal("needsRefresh() = false with an upstream source")
+	}
+
+	got, err := r.resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	want := []string{"192.0.2.1:8000", "192.0.2.11:8000", "192.0.2.12:8000"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("resolve = %v, want %v", got, want)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		source fakeEngineSource
+	}{
+		{name: "source error", source: fakeEngineSource{err: errors.New("lookup failed")}},
+		{name: "hostname", source: fakeEngineSource{addrs: []string{"detector.example:8000"}}},
+		{name: "invalid", source: fakeEngineSource{addrs: []string{"192.0.2.13"}}},
+	} {
+		*source = tt.source
+		got, err := r.resolve(context.Background())
+		if err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: resolve = %v, want previous %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestEngineGroupRequestRefresh(t *testing.T) {
+	ensureWAFMetrics(t)
+	for _, tt := range []struct {
+		name       string
+		minRefresh time.Duration
+		want       []string
+	}{
+		{name: "refreshed", want: []string{"192.0.2.2:8000"}},
+		{name: "too soon", minRefresh: time.Hour, want: []string{"192.0.2.1:8000"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestEngineGroup()
+			t.Cleanup(g.cancel)
+			source := &fakeEngineSource{addrs: []string{"192.0.2.1:8000"}}
+			r := newEngineResolver(nil, source)
+			r.minRefresh = tt.minRefresh
+			addrs, _ := r.resolve(context.Background())
+			if err := g.updateEngines(addrs); err != nil {
+				t.Fatalf("updateEngines: %v", err)
+			}
+			g.startResolver(r, time.Hour)
+
+			source.addrs = []string{"192.0.2.2:8000"}
+			g.requestRefresh()
+			deadline := time.Now().Add(200 * time.Millisecond)
+			for time.Now().Before(deadline) && !slices.Equal(engineAddrs(g.current()), tt.want) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			time.Sleep(20 * time.Millisecond)
+			if got := engineAddrs(g.current()); !slices.Equal(got, tt.want) {
+				t.Errorf("engines = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamSourceValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  caddy.Validator
+		wantErr bool
+	}{
+		{name: "a ok", source: &AEngineSource{Name: "detector.example", Port: "8000"}},
+		{name: "a no name", source: &AEngineSource{Port: "8000"}, wantErr: true},
+		{name: "a bad port", source: &AEngineSource{Name: "detector.example", Port: "http"}, wantErr: true},
+		{name: "srv ok", source: &SRVEngineSource{Service: "t1k", Proto: "tcp", Name: "waf.example"}},
+		{name: "srv name only", source: &SRVEngineSource{Name: "_t1k._tcp.waf.example"}},
+		{name: "srv service without proto", source: &SRVEngineSource{Service: "t1k", Name: "waf.example"}, wantErr: true},
+		{name: "file no path", source: &FileEngineSource{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		err := tt.source.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileUpstreams(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "a inline",
+			input: "upstreams a detector.example 8000",
+			want:  `{"name":"detector.example","port":"8000","source":"a"}`,
+		},
+		{
+			name: "a block",
+			input: `upstreams a {
+				name detector.example
+				port 8000
+				resolvers 192.0.2.53 192.0.2.54:5353
+			}`,
+			want: `{"name":"detector.example","port":"8000","resolvers":["192.0.2.53:53","192.0.2.54:5353"],"source":"a"}`,
+		},
+		{
+			name: "srv",
+			input: `upstreams srv {
+				service t1k
+				proto tcp
+				name waf.example
+			}`,
+			want: `{"name":"waf.example","proto":"tcp","service":"t1k","source":"srv"}`,
+		},
+		{
+			name: "file",
+			input: `upstreams file /etc/caddy/engines.txt {
+				watch_interval 5s
+			}`,
+			want: `{"path":"/etc/caddy/engines.txt","source":"file","watch_interval":5000000000}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := caddyfile.NewTestDispenser("waf_chaitin {\n" + tt.input + "\n}")
+			var m CaddyWAF
+			if err := m.UnmarshalCaddyfile(d); err != nil {
+				t.Fatalf("UnmarshalCaddyfile: %v", err)
+			}
+			if string(m.UpstreamsRaw) != tt.want {
+				t.Fatalf("UpstreamsRaw = %s, want %s", m.UpstreamsRaw, tt.want)
+			}
+		})
+	}
+
+	for _, input := range []string{
+		"upstreams",
+		"upstreams dns detector.example",
+		"upstreams a detector.example",
+		"upstreams file /a /b",
+		"upstreams a x 1\nupstreams file /a",
+	} {
+		d := caddyfile.NewTestDispenser("waf_chaitin {\n" + input + "\n}")
+		if err := new(CaddyWAF).UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
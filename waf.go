@@ -2,9 +2,16 @@ package caddy_waf_t1k
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	weakrand "math/rand/v2"
 	"net/http"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -29,47 +36,260 @@ func init() {
 // waf_chaitin directive is provisioned many times.
 var instanceSeq int64
 
+// Prefixes of the instance IDs of handlers' own engines and of shared engine
+// groups, so a group name never collides with a handler's sequence number.
+const (
+	instancePrefixInline = "inline:"
+	instancePrefixGroup  = "group:"
+)
+
 // maxBodySizeLimit is the largest allowed MaxBodySize. It leaves headroom so
 // prepareDetectionRequest's io.LimitReader(body, m.MaxBodySize+1) cannot
 // overflow int64.
 const maxBodySizeLimit = 1<<63 - 2
 
+// Detection modes.
+const (
+	// modeBlock rejects requests the engine flags as attacks.
+	modeBlock = "block"
+	// modeMonitor logs and counts flagged requests but still passes them on.
+	modeMonitor = "monitor"
+	// modeBypass passes requests on without detection.
+	modeBypass = "bypass"
+)
+
+const (
+	// latencyEWMAWeight is the weight of the newest sample in an engine's
+	// moving average detection latency.
+	latencyEWMAWeight = 0.3
+	// latencyDecay is the time constant with which the moving average
+	// decays towards zero while an engine receives no traffic.
+	latencyDecay = 10 * time.Second
+)
+
+// Fail modes, applied when a request cannot be inspected.
+const (
+	// failModeOpen passes uninspected requests to the next handler.
+	failModeOpen = "open"
+	// failModeClosed rejects uninspected requests with FailResponse.
+	failModeClosed = "closed"
+)
+
 // Engine wraps a t1k.ChannelPool with per-engine health state.
 type Engine struct {
 	pool     *t1k.ChannelPool
 	addr     string
-	fails    int64 // atomic: unexpired failure count
 	maxFails int
+	weight   int  // 0 means 1
+	backup   bool // only selected while no primary engine is available
+	// failures holds the passive health check's unexpired failures.
+	failures failureWindow
+	// removed is set once the engine left its group's engine set.
+	removed atomic.Bool
+	// admin is the admin API override of the engine's availability.
+	admin atomic.Int32
+	// inFlight is the number of detections the engine is running, so a
+	// drained engine reports when it is idle.
+	inFlight atomic.Int64
+	// abandoned is the number of timed-out detections still running;
+	// maxAbandoned, if set, bounds it (see detect).
+	abandoned    atomic.Int64
+	maxAbandoned int64
+	// healthDown is set while the engine fails active health checks.
+	healthDown atomic.Bool
+	// breaker, if set, replaces the maxFails check.
+	breaker *circuitBreaker
+	// slowStart is how long the engine's share of selections ramps up
+	// after it recovers; 0 disables slow start.
+	slowStart time.Duration
+	// down is set while the engine is unavailable, for slow start;
+	// recoveredAt is when it last became available (unix nanoseconds).
+	down        atomic.Bool
+	recoveredAt atomic.Int64
+	// latencyEWMA holds the float64 bits of the moving average detection
+	// latency in seconds, as of latencyAt (unix nanoseconds); 0 until the
+	// first sample.
+	latencyEWMA atomic.Uint64
+	latencyAt   atomic.Int64
 	// detectFn, if set, replaces pool.DetectHttpRequest (tests only).
 	detectFn func(*http.Request) (*detection.Result, error)
+	// statsFn, if set, replaces pool.Stats (tests only).
+	statsFn func() t1k.PoolStats
 }
 
 func (e *Engine) DetectHttpRequest(r *http.Request) (*detection.Result, error) {
+	e.inFlight.Add(1)
+	defer e.inFlight.Add(-1)
 	if e.detectFn != nil {
 		return e.detectFn(r)
 	}
 	return e.pool.DetectHttpRequest(r)
 }
 
+// Fails returns the engine's unexpired failures.
 func (e *Engine) Fails() int {
-	return int(atomic.LoadInt64(&e.fails))
+	return e.failures.count(time.Now())
 }
 
-func (e *Engine) countFail(delta int) {
-	atomic.AddInt64(&e.fails, int64(delta))
+// Weight returns the engine's weight for the weighted selection policies.
+func (e *Engine) Weight() int {
+	if e.weight < 1 {
+		return 1
+	}
+	return e.weight
+}
+
+// setHealthy records an active health check result and reports whether it
+// changed the engine's state.
+func (e *Engine) setHealthy(healthy bool) bool {
+	return e.healthDown.Swap(!healthy) == healthy
 }
 
+// Available reports whether the engine may be selected.
 func (e *Engine) Available() bool {
+	available := e.available()
+	if e.slowStart > 0 {
+		// A half-open circuit admits trials only; the ramp starts once it
+		// closes.
+		e.trackRecovery(available && (e.breaker == nil || e.breaker.currentState() == circuitClosed))
+	}
+	return available
+}
+
+// drained reports whether the engine is drained and has no detections left
+// in flight.
+func (e *Engine) drained() bool {
+	return e.admin.Load() == adminDrain && e.inFlight.Load() == 0
+}
+
+func (e *Engine) available() bool {
+	switch e.admin.Load() {
+	case adminDrain, adminDown:
+		return false
+	case adminUp:
+		return true
+	}
+	if e.healthDown.Load() {
+		return false
+	}
+	if e.breaker != nil {
+		return e.breaker.available()
+	}
 	if e.maxFails <= 0 {
 		return true
 	}
 	return e.Fails() < e.maxFails
 }
 
+// resetFailures forgets the engine's failures and closes its circuit.
+func (e *Engine) resetFailures() {
+	e.failures.reset()
+	if e.breaker != nil {
+		e.breaker.reset()
+	}
+}
+
+// trackRecovery records when the engine comes back up, for slow start.
+func (e *Engine) trackRecovery(up bool) {
+	if !up {
+		e.down.Store(true)
+		return
+	}
+	if e.down.Load() && e.down.CompareAndSwap(true, false) {
+		e.recoveredAt.Store(time.Now().UnixNano())
+	}
+}
+
+// slowStartFactor returns the share, from 0 to 1, of its selections the
+// engine accepts at now. It ramps up linearly over slowStart after the
+// engine recovered and is 1 otherwise.
+func (e *Engine) slowStartFactor(now time.Time) float64 {
+	if e.slowStart <= 0 || e.down.Load() {
+		return 1
+	}
+	since := now.Sub(time.Unix(0, e.recoveredAt.Load()))
+	if since >= e.slowStart {
+		return 1
+	}
+	return max(float64(since), 0) / float64(e.slowStart)
+}
+
+// allow admits a detection on a selected engine. An engine whose circuit is
+// half-open admits only a limited number of trial detections.
+func (e *Engine) allow() bool {
+	return e.breaker == nil || e.admin.Load() == adminUp || e.breaker.allow()
+}
+
+// recordResult reports the outcome of an admitted detection to the circuit
+// breaker. Errors that are not the engine's fault release a half-open
+// trial slot without counting. Results of an engine forced up through the
+// admin API are not recorded, so that clearing the override does not find
+// the circuit opened behind it.
+func (e *Engine) recordResult(err error) {
+	if e.breaker == nil || e.admin.Load() == adminUp {
+		return
+	}
+	switch {
+	case err == nil:
+		e.breaker.record(false)
+	case isEngineError(err):
+		e.breaker.record(true)
+	default:
+		e.breaker.cancel()
+	}
+}
+
 func (e *Engine) poolStats() t1k.PoolStats {
+	if e.statsFn != nil {
+		return e.statsFn()
+	}
 	return e.pool.Stats()
 }
 
+// observeLatency folds a detection latency into the engine's moving average.
+func (e *Engine) observeLatency(d time.Duration) {
+	sample := d.Seconds()
+	for {
+		old := e.latencyEWMA.Load()
+		avg := sample
+		if old != 0 {
+			avg = latencyEWMAWeight*sample + (1-latencyEWMAWeight)*e.decayedLatency(old)
+		}
+		if e.latencyEWMA.CompareAndSwap(old, math.Float64bits(avg)) {
+			e.latencyAt.Store(time.Now().UnixNano())
+			return
+		}
+	}
+}
+
+// latency returns the moving average detection latency, or 0 if no
+// detection has been observed. The average decays while the engine gets no
+// traffic, so a slow engine is eventually sampled again.
+func (e *Engine) latency() time.Duration {
+	return time.Duration(e.decayedLatency(e.latencyEWMA.Load()) * float64(time.Second))
+}
+
+func (e *Engine) decayedLatency(bits uint64) float64 {
+	avg := math.Float64frombits(bits)
+	if idle := time.Since(time.Unix(0, e.latencyAt.Load())); idle > 0 {
+		avg *= math.Exp(-idle.Seconds() / latencyDecay.Seconds())
+	}
+	return avg
+}
+
+// load is the number of detections using or waiting for a pool connection.
+func (e *Engine) load() int {
+	stats := e.poolStats()
+	return int(stats.ActiveConns) + int(stats.WaitingReqs)
+}
+
+// release closes the engine's pool.
+func (e *Engine) release() {
+	if e.pool != nil {
+		e.pool.Release()
+	}
+}
+
 type EnginePool []*Engine
 
 // CaddyWAF implements an HTTP handler for WAF.
@@ -79,25 +299,112 @@ type CaddyWAF struct {
 
 	instanceID string // app-lifetime-unique id for the prometheus waf_instance label
 
-	WafEngineAddrs []string `json:"waf_engine_addrs,omitempty"` // WAF Engine address, expects a URL or IP address
+	// EngineGroup configures the handler's own engines. It must be empty
+	// when Group is set.
+	EngineGroup
+
+	// Group is the name of an engine group of the waf_chaitin app to use
+	// instead of the handler's own engines. Handlers using the same group
+	// share its connection pools, health state and metrics.
+	Group string `json:"engine_group,omitempty"`
 
-	// Multiple WAF engine pools
-	Engines EnginePool
+	// Engines is the engine set of handlers that were not provisioned
+	// (tests only); provisioned handlers use their engine group's.
+	Engines EnginePool `json:"-"`
+	group   *engineGroup
 
 	// Load balancing distributes load/requests between backends.
 	LoadBalancing *LoadBalancing `json:"load_balancing,omitempty"`
 
-	InitialCap  int           `json:"initial_cap,omitempty"`
-	MaxIdle     int           `json:"max_idle,omitempty"`
-	MaxCap      int           `json:"max_cap,omitempty"`
-	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
-
 	// MaxBodySize limits the number of request-body bytes sent to the detection engine;
 	// the full body is still forwarded downstream. A value of 0 preserves unlimited detection.
 	MaxBodySize int64 `json:"max_body_size,omitempty"`
 
-	HealthFailDuration caddy.Duration `json:"health_fail_duration,omitempty"`
-	HealthMaxFails     int            `json:"health_max_fails,omitempty"`
+	// Name identifies the handler in the admin API, which switches the mode
+	// of handlers by name, and namespaces its shared bans. Unlike instance
+	// IDs, names are stable across config reloads, so mode overrides of a
+	// name persist. Handlers may share a name to be switched together and
+	// to share bans.
+	Name string `json:"name,omitempty"`
+
+	// Mode is "block" (default), "monitor" or "bypass". In monitor mode
+	// requests the engine would block are logged and counted, then passed
+	// through. In bypass mode requests are passed through without detection.
+	// The admin API can override the mode at runtime.
+	Mode string `json:"mode,omitempty"`
+
+	// SkipRaw is a list of request matcher sets. Requests matching any of
+	// them are passed through without detection and counted as the skipped
+	// action, e.g. static assets or health checks.
+	SkipRaw caddyhttp.RawMatcherSets `json:"skip,omitempty" caddy:"namespace=http.matchers"`
+	skip    caddyhttp.MatcherSets
+
+	// AllowIPs lists clients whose requests are passed through without
+	// detection and counted as the allowed action.
+	AllowIPs *IPList `json:"allow_ips,omitempty"`
+
+	// DenyIPs lists clients whose requests get the block response without
+	// detection and are counted as the denied action. It takes precedence
+	// over AllowIPs. Client IPs are resolved through the server's
+	// trusted_proxies.
+	DenyIPs *IPList `json:"deny_ips,omitempty"`
+
+	// BanThreshold bans a client for BanDuration once it has been blocked
+	// BanThreshold times within BanWindow. Requests of banned clients get
+	// the block response without detection and are counted as the banned
+	// action. At most 100. Default 0 (no bans).
+	BanThreshold int `json:"ban_threshold,omitempty"`
+
+	// BanWindow is the sliding window blocks are counted in. Default 1m.
+	BanWindow caddy.Duration `json:"ban_window,omitempty"`
+
+	// BanDuration is how long a client stays banned. Default 10m.
+	BanDuration caddy.Duration `json:"ban_duration,omitempty"`
+
+	// BanKey identifies the client bans apply to and may contain
+	// placeholders, e.g. "{http.request.header.X-Api-Key}". Requests whose
+	// key is empty are not tracked. Default is the client IP.
+	BanKey string `json:"ban_key,omitempty"`
+
+	// BanSyncInterval shares bans through Caddy's storage when set: new
+	// bans are stored at once, and bans issued elsewhere are loaded every
+	// interval. Handlers of the same Name, which is required, share their
+	// bans across Caddy instances using the same storage backend. Expired
+	// bans are deleted from storage. Default 0 (bans are local to the
+	// handler).
+	BanSyncInterval caddy.Duration `json:"ban_sync_interval,omitempty"`
+	bans            *banTracker
+
+	// VerdictCache caches detection verdicts of identical requests, so
+	// repeated requests skip the engine. Default nil (no cache).
+	VerdictCache *VerdictCache `json:"verdict_cache,omitempty"`
+
+	// BlockResponse configures the status code and body written for blocked
+	// requests. Defaults to 403 with a built-in HTML, JSON or text body.
+	BlockResponse *BlockResponse `json:"block_response,omitempty"`
+
+	// BlockAction is either "respond" (default), which writes BlockResponse,
+	// or "error", which returns a handler error with BlockResponse's status
+	// code so the site's handle_errors routes produce the block page.
+	BlockAction string `json:"block_action,omitempty"`
+
+	// DetectTimeout bounds a single detect attempt. A timed-out attempt counts
+	// as an engine failure and may be retried on another engine. Default 0 (no limit).
+	DetectTimeout caddy.Duration `json:"detect_timeout,omitempty"`
+
+	// DetectBudget bounds all detect attempts of a request, including
+	// load_balancing.retries. Default 0 (no limit).
+	DetectBudget caddy.Duration `json:"detect_budget,omitempty"`
+
+	// FailMode decides what happens to a request that could not be inspected
+	// because no engine was available, every attempt failed, or a deadline
+	// expired: "open" (default) passes it on, "closed" rejects it with
+	// FailResponse and counts it as the failclosed action.
+	FailMode string `json:"fail_mode,omitempty"`
+
+	// FailResponse configures the response for fail-closed requests.
+	// Defaults to 503 with a built-in HTML, JSON or text body.
+	FailResponse *BlockResponse `json:"fail_response,omitempty"`
 }
 
 // CaddyModule returns the Caddy module information.
@@ -121,31 +428,14 @@ func initDetect(pc *t1k.PoolConfig) (*t1k.ChannelPool, error) {
 func (m *CaddyWAF) Provision(ctx caddy.Context) error {
 	m.logger = ctx.Logger(m)
 	m.ctx = ctx
-	m.instanceID = strconv.FormatInt(atomic.AddInt64(&instanceSeq, 1), 10)
+	m.instanceID = instancePrefixInline + strconv.FormatInt(atomic.AddInt64(&instanceSeq, 1), 10)
 	m.logger.Info("Provisioning WAF plugin instance")
 
-	if len(m.WafEngineAddrs) == 0 {
+	if m.Group == "" && len(m.WafEngineAddrs) == 0 && m.UpstreamsRaw == nil {
 		return fmt.Errorf("WAF configuration error: no engine addresses specified")
 	}
-
-	if m.InitialCap == 0 {
-		m.logger.Info("InitialCap is not set, defaulting to 1")
-		m.InitialCap = 1
-	}
-
-	if m.MaxIdle == 0 {
-		m.logger.Info("MaxIdle is not set, defaulting to 16")
-		m.MaxIdle = 16
-	}
-
-	if m.MaxCap == 0 {
-		m.logger.Info("MaxCap is not set, defaulting to 32")
-		m.MaxCap = 32
-	}
-
-	if m.IdleTimeout == time.Duration(0)*time.Second {
-		m.logger.Info("IdleTimeout is not set, defaulting to 30 seconds")
-		m.IdleTimeout = 30 * time.Second
+	if m.Group != "" && !reflect.ValueOf(m.EngineGroup).IsZero() {
+		return fmt.Errorf("WAF configuration error: engine_group %q cannot be combined with engine settings", m.Group)
 	}
 
 	if m.LoadBalancing != nil && m.LoadBalancing.SelectionPolicyRaw != nil {
@@ -164,35 +454,94 @@ func (m *CaddyWAF) Provision(ctx caddy.Context) error {
 		m.LoadBalancing.SelectionPolicy = RandomSelection{}
 	}
 
-	if m.HealthMaxFails == 0 {
-		m.HealthMaxFails = 1
+	if m.Mode == "" {
+		m.Mode = modeBlock
 	}
 
-	// Initialize multiple engines
-	m.Engines = make(EnginePool, len(m.WafEngineAddrs))
-	for i, addr := range m.WafEngineAddrs {
-		pc := &t1k.PoolConfig{
-			InitialCap:  m.InitialCap,
-			MaxIdle:     m.MaxIdle,
-			MaxCap:      m.MaxCap,
-			Factory:     &t1k.TcpFactory{Addr: addr},
-			IdleTimeout: m.IdleTimeout,
+	if m.AllowIPs != nil {
+		if err := m.AllowIPs.provision(ctx, m.logger, "allow_ips"); err != nil {
+			return err
+		}
+	}
+	if m.DenyIPs != nil {
+		if err := m.DenyIPs.provision(ctx, m.logger, "deny_ips"); err != nil {
+			return err
 		}
+	}
 
-		engine, err := initDetect(pc)
+	if m.VerdictCache != nil {
+		m.VerdictCache.provision()
+	}
+
+	if m.SkipRaw != nil {
+		mods, err := ctx.LoadModule(m, "SkipRaw")
 		if err != nil {
-			return fmt.Errorf("init detect error for %s: %v", addr, err)
+			return fmt.Errorf("loading skip matchers: %v", err)
 		}
-		m.Engines[i] = &Engine{
-			pool:     engine,
-			addr:     addr,
-			maxFails: m.HealthMaxFails,
+		if err := m.skip.FromInterface(mods); err != nil {
+			return fmt.Errorf("loading skip matchers: %v", err)
 		}
 	}
-	m.logger.Info("WAF plugin instance Provisioned")
+
+	if m.BlockAction == "" {
+		m.BlockAction = blockActionRespond
+	}
+
+	if m.BlockResponse == nil {
+		m.BlockResponse = new(BlockResponse)
+	}
+	if err := m.BlockResponse.provision(); err != nil {
+		return fmt.Errorf("loading block response: %v", err)
+	}
+
+	if m.FailMode == "" {
+		m.FailMode = failModeOpen
+	}
+
+	if m.FailResponse == nil {
+		m.FailResponse = new(BlockResponse)
+	}
+	if err := m.FailResponse.provision(); err != nil {
+		return fmt.Errorf("loading fail response: %v", err)
+	}
 
 	initWAFMetrics(ctx.GetMetricsRegistry())
-	newMetricsPoolUpdater(m).start()
+
+	if m.Group != "" {
+		app, err := ctx.AppIfConfigured("waf_chaitin")
+		if err != nil {
+			return fmt.Errorf("WAF configuration error: engine_group %q requires the waf_chaitin app: %v", m.Group, err)
+		}
+		group, ok := app.(*App).groups[m.Group]
+		if !ok {
+			return fmt.Errorf("WAF configuration error: unknown engine_group %q", m.Group)
+		}
+		m.group = group
+		m.instanceID = group.instanceID
+	} else {
+		m.group = newEngineGroup(ctx, &m.EngineGroup, m.instanceID, m.logger)
+		if err := m.group.start(ctx); err != nil {
+			m.group.Destruct()
+			m.group = nil
+			return err
+		}
+	}
+	if m.BanThreshold > 0 {
+		m.bans = newBanTracker(m.BanThreshold, time.Duration(m.BanWindow), time.Duration(m.BanDuration), m.instanceID, m.logger)
+		if m.BanSyncInterval > 0 {
+			m.bans.storage = ctx.Storage()
+			m.bans.storagePrefix = banStorageDir(m.Name)
+			m.bans.syncInterval = time.Duration(m.BanSyncInterval)
+		}
+		m.bans.start(ctx)
+	}
+	registerHandler(m)
+	if mode := m.currentMode(); mode != m.Mode {
+		m.logger.Warn("WAF mode overridden through the admin API",
+			zap.String("configured", m.Mode),
+			zap.String("mode", mode))
+	}
+	m.logger.Info("WAF plugin instance Provisioned")
 
 	return nil
 }
@@ -205,6 +554,61 @@ func (m *CaddyWAF) Validate() error {
 	if m.MaxBodySize < 0 || m.MaxBodySize > maxBodySizeLimit {
 		return fmt.Errorf("max_body_size must be between 0 and %d", maxBodySizeLimit)
 	}
+	switch m.Mode {
+	case "", modeBlock, modeMonitor, modeBypass:
+	default:
+		return fmt.Errorf("unrecognized mode %q", m.Mode)
+	}
+	if err := m.EngineGroup.validate(); err != nil {
+		return err
+	}
+	if m.AllowIPs != nil {
+		if err := m.AllowIPs.validate("allow_ips"); err != nil {
+			return err
+		}
+	}
+	if m.DenyIPs != nil {
+		if err := m.DenyIPs.validate("deny_ips"); err != nil {
+			return err
+		}
+	}
+	if m.VerdictCache != nil {
+		if err := m.VerdictCache.validate(); err != nil {
+			return err
+		}
+	}
+	if m.BanThreshold < 0 || m.BanWindow < 0 || m.BanDuration < 0 || m.BanSyncInterval < 0 {
+		return fmt.Errorf("ban_threshold, ban_window, ban_duration and ban_sync_interval must be >= 0")
+	}
+	if m.BanThreshold > maxBanThreshold {
+		return fmt.Errorf("ban_threshold must be <= %d", maxBanThreshold)
+	}
+	if m.BanSyncInterval > 0 && m.Name == "" {
+		return fmt.Errorf("ban_sync_interval requires name, which namespaces the shared bans")
+	}
+	if m.DetectTimeout < 0 || m.DetectBudget < 0 {
+		return fmt.Errorf("detect_timeout and detect_budget must be >= 0")
+	}
+	switch m.BlockAction {
+	case "", blockActionRespond, blockActionError:
+	default:
+		return fmt.Errorf("unrecognized block_action %q", m.BlockAction)
+	}
+	if m.BlockResponse != nil {
+		if err := m.BlockResponse.validate(); err != nil {
+			return err
+		}
+	}
+	switch m.FailMode {
+	case "", failModeOpen, failModeClosed:
+	default:
+		return fmt.Errorf("unrecognized fail_mode %q", m.FailMode)
+	}
+	if m.FailResponse != nil {
+		if err := m.FailResponse.validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -217,42 +621,198 @@ func (b *recombinedBody) Close() error {
 	return b.closer.Close()
 }
 
-func (m *CaddyWAF) prepareDetectionRequest(r *http.Request) (func() *http.Request, error) {
-	if m.MaxBodySize == 0 || r.Body == nil || (r.ContentLength >= 0 && r.ContentLength <= m.MaxBodySize) {
-		return func() *http.Request { return r }, nil
+// prepareDetectionRequest returns a constructor for the request sent to the
+// engine, the body sent if it was buffered, and whether the body was
+// truncated to MaxBodySize.
+//
+// The body is buffered when it may exceed MaxBodySize, when buffer is set
+// for the verdict cache key, and always when a detect deadline is
+// configured: a timed-out detection keeps running in the background and
+// must not consume the body the next handler reads. For the same reason,
+// the request is then deep-copied, so the next handler may modify its
+// headers and URL while the detection still reads them.
+func (m *CaddyWAF) prepareDetectionRequest(r *http.Request, buffer bool) (func() *http.Request, []byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		if m.hasDetectDeadline() {
+			return func() *http.Request { return r.Clone(r.Context()) }, nil, false, nil
+		}
+		return func() *http.Request { return r }, nil, false, nil
+	}
+	withinCap := m.MaxBodySize == 0 || (r.ContentLength >= 0 && r.ContentLength <= m.MaxBodySize)
+	if withinCap && !m.hasDetectDeadline() && !buffer {
+		return func() *http.Request { return r }, nil, false, nil
 	}
 
 	body := r.Body
-	buffered, err := io.ReadAll(io.LimitReader(body, m.MaxBodySize+1))
+	reader := io.Reader(body)
+	if m.MaxBodySize > 0 {
+		reader = io.LimitReader(body, m.MaxBodySize+1)
+	}
+	buffered, err := io.ReadAll(reader)
 	r.Body = &recombinedBody{
 		Reader: io.MultiReader(bytes.NewReader(buffered), body),
 		closer: body,
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, false, err
 	}
 
 	detectBody := buffered
-	if int64(len(detectBody)) > m.MaxBodySize {
+	truncated := m.MaxBodySize > 0 && int64(len(detectBody)) > m.MaxBodySize
+	if truncated {
 		detectBody = detectBody[:m.MaxBodySize]
 		wafMetrics.oversizeRequests.Inc()
 	}
 
 	return func() *http.Request {
-		detectRequest := new(http.Request)
-		*detectRequest = *r
+		var detectRequest *http.Request
+		if m.hasDetectDeadline() {
+			detectRequest = r.Clone(r.Context())
+		} else {
+			detectRequest = new(http.Request)
+			*detectRequest = *r
+		}
 		detectRequest.Body = io.NopCloser(bytes.NewReader(detectBody))
 		detectRequest.ContentLength = int64(len(detectBody))
 		detectRequest.GetBody = nil
 		return detectRequest
-	}, nil
+	}, detectBody, truncated, nil
+}
+
+// errDetectTimeout is returned for a detect attempt that exceeded its deadline.
+var errDetectTimeout = errors.New("WAF detection timed out")
+
+func (m *CaddyWAF) hasDetectDeadline() bool {
+	return m.DetectTimeout > 0 || m.DetectBudget > 0
+}
+
+// attemptTimeout returns how long the next detect attempt may take, or 0 for
+// no limit. It reports false once the detect budget ending at budgetEnd is spent.
+func (m *CaddyWAF) attemptTimeout(budgetEnd time.Time) (time.Duration, bool) {
+	timeout := time.Duration(m.DetectTimeout)
+	if !budgetEnd.IsZero() {
+		remaining := time.Until(budgetEnd)
+		if remaining <= 0 {
+			return 0, false
+		}
+		if timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+	return timeout, true
+}
+
+type detectOutcome struct {
+	result *detection.Result
+	err    error
+}
+
+// detect runs a detect attempt on engine. With a non-zero timeout it returns
+// errDetectTimeout once the timeout elapses, and the abandoned attempt keeps
+// its goroutine and pool connection until the engine answers or the
+// connection fails. While an engine has maxAbandoned such attempts, e.g.
+// during a stall, further attempts fail with errDetectTimeout at once
+// rather than pile up.
+func detect(engine *Engine, req *http.Request, timeout time.Duration) (*detection.Result, error) {
+	if timeout == 0 {
+		return engine.DetectHttpRequest(req)
+	}
+	if engine.maxAbandoned > 0 && engine.abandoned.Load() >= engine.maxAbandoned {
+		return nil, errDetectTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	// state is detectRunning until the attempt either finishes or is
+	// abandoned; an abandoned attempt is uncounted when it finishes.
+	var state atomic.Int32
+	done := make(chan detectOutcome, 1)
+	go func() {
+		result, err := engine.DetectHttpRequest(req)
+		if !state.CompareAndSwap(detectRunning, detectFinished) {
+			engine.abandoned.Add(-1)
+		}
+		done <- detectOutcome{result: result, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case out := <-done:
+		return out.result, out.err
+	case <-timer.C:
+		engine.abandoned.Add(1)
+		if !state.CompareAndSwap(detectRunning, detectAbandoned) {
+			// The attempt finished just now.
+			engine.abandoned.Add(-1)
+			out := <-done
+			return out.result, out.err
+		}
+		return nil, errDetectTimeout
+	}
+}
+
+// States of a detect attempt with a timeout.
+const (
+	detectRunning int32 = iota
+	detectFinished
+	detectAbandoned
+)
+
+// Placeholders set on the request's replacer for downstream handlers and logs.
+const (
+	placeholderAction           = "http.waf.action"
+	placeholderEventID          = "http.waf.event_id"
+	placeholderEngine           = "http.waf.engine"
+	placeholderDetectDuration   = "http.waf.detect_duration"
+	placeholderDetectDurationMs = "http.waf.detect_duration_ms"
+	placeholderBodyTruncated    = "http.waf.body_truncated"
+)
+
+func setPlaceholder(repl *caddy.Replacer, key string, value any) {
+	if repl != nil {
+		repl.Set(key, value)
+	}
+}
+
+// recordAction counts the request under action and exposes it as {http.waf.action}.
+func recordAction(repl *caddy.Replacer, action string) {
+	wafMetrics.requestsTotal.WithLabelValues(action).Inc()
+	setPlaceholder(repl, placeholderAction, action)
+}
+
+// banKey returns the key the request's blocks and bans are tracked by.
+func (m *CaddyWAF) banKey(r *http.Request, repl *caddy.Replacer) string {
+	if m.BanKey == "" || repl == nil {
+		return clientIP(r)
+	}
+	return repl.ReplaceAll(m.BanKey, "")
+}
+
+// skipRequest reports whether r matches a skip matcher set. Requests whose
+// matchers fail, e.g. on a malformed expression input, are inspected.
+func (m *CaddyWAF) skipRequest(r *http.Request) bool {
+	if len(m.skip) == 0 {
+		return false
+	}
+	match, err := m.skip.AnyMatchWithError(r)
+	if err != nil {
+		m.logger.Warn("matching skip matchers",
+			zap.String("path", r.URL.Path),
+			zap.String("method", r.Method),
+			zap.Error(err))
+		return false
+	}
+	return match
 }
 
 // ServeHTTP processes incoming HTTP requests by utilizing the Caddy WAF engine to detect
 // potential threats. If a request is identified as malicious, it redirects the request to
 // an intercept handler. Otherwise, it passes the request to the next handler in the chain.
-// The method handles detection errors and enforces a timeout for the detection process,
-// logging relevant information in each case.
+// The method handles detection errors and enforces the detect_timeout and detect_budget
+// deadlines for the detection process, logging relevant information in each case.
 func (m *CaddyWAF) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	retries := 0
 	if m.LoadBalancing != nil {
@@ -260,49 +820,140 @@ func (m *CaddyWAF) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyh
 	}
 	maxAttempts := 1 + retries
 	tried := make(map[*Engine]struct{})
+	engines := m.currentEngines()
+	repl, _ := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	mode := m.currentMode()
+	if mode == modeBypass {
+		recordAction(repl, "bypassed")
+		return next.ServeHTTP(w, r)
+	}
+	if m.AllowIPs != nil || m.DenyIPs != nil {
+		if ip, err := clientAddr(r); err != nil {
+			m.logger.Warn("parsing client IP for allow_ips and deny_ips",
+				zap.String("remote_addr", r.RemoteAddr),
+				zap.Error(err))
+		} else if m.DenyIPs.contains(ip) {
+			if mode == modeMonitor {
+				m.logger.Warn("request from denied client, passed through in monitor mode",
+					zap.String("client_ip", ip.String()),
+					zap.String("request", r.Host),
+					zap.String("path", r.URL.Path),
+					zap.String("method", r.Method))
+				recordAction(repl, "monitored")
+				return next.ServeHTTP(w, r)
+			}
+			recordAction(repl, "denied")
+			return m.blockIntercept(w, r, "")
+		} else if m.AllowIPs.contains(ip) {
+			recordAction(repl, "allowed")
+			return next.ServeHTTP(w, r)
+		}
+	}
+	var banKey string
+	if m.bans != nil {
+		banKey = m.banKey(r, repl)
+		if banKey != "" && m.bans.banned(banKey) {
+			if mode == modeMonitor {
+				m.logger.Warn("request from banned client, passed through in monitor mode",
+					zap.String("key", banKey),
+					zap.String("request", r.Host),
+					zap.String("path", r.URL.Path),
+					zap.String("method", r.Method))
+				recordAction(repl, "monitored")
+				return next.ServeHTTP(w, r)
+			}
+			recordAction(repl, "banned")
+			return m.blockIntercept(w, r, "")
+		}
+	}
+	if m.skipRequest(r) {
+		recordAction(repl, "skipped")
+		return next.ServeHTTP(w, r)
+	}
 
-	newDetectionRequest, err := m.prepareDetectionRequest(r)
+	cacheable := m.VerdictCache.cacheable(r)
+	newDetectionRequest, body, truncated, err := m.prepareDetectionRequest(r, cacheable)
+	setPlaceholder(repl, placeholderBodyTruncated, truncated)
 	if err != nil {
 		m.logger.Warn("reading request body for detection",
 			zap.String("request", r.Host),
 			zap.String("path", r.URL.Path),
 			zap.String("method", r.Method),
 			zap.Error(err))
-		wafMetrics.requestsTotal.WithLabelValues("error").Inc()
-		return next.ServeHTTP(w, r)
+		return m.clientFailed(w, r, next, repl, err)
+	}
+
+	var cacheKey [sha256.Size]byte
+	if cacheable {
+		cacheKey = m.VerdictCache.key(r, body)
+		if result, ok := m.VerdictCache.get(cacheKey); ok {
+			wafMetrics.verdictCacheLookups.WithLabelValues("hit").Inc()
+			return m.serveVerdict(w, r, next, repl, mode, banKey, nil, result)
+		}
+		wafMetrics.verdictCacheLookups.WithLabelValues("miss").Inc()
+	}
+
+	var budgetEnd time.Time
+	if m.DetectBudget > 0 {
+		budgetEnd = time.Now().Add(time.Duration(m.DetectBudget))
 	}
+	var lastErr error
 
 	for attempt := 0; attempt < maxAttempts; attempt++ {
-		candidates := excludeEngines(m.Engines, tried)
-		engine := m.LoadBalancing.SelectionPolicy.Select(candidates, r, w)
+		timeout, ok := m.attemptTimeout(budgetEnd)
+		if !ok {
+			m.logger.Error("WAF detect budget exhausted",
+				zap.String("path", r.URL.Path),
+				zap.String("method", r.Method),
+				zap.Int("tried", len(tried)))
+			return m.detectFailed(w, r, next, repl, "timeout")
+		}
+
+		var engine *Engine
+		for _, tier := range engineTiers(engines) {
+			if engine = m.selectEngine(excludeEngines(tier, tried), r, w); engine != nil {
+				break
+			}
+		}
 		if engine == nil {
+			// The engine set may be stale, e.g. after replicas moved.
+			m.group.requestRefresh()
 			if len(tried) == 0 {
-				m.logger.Warn("all WAF engines unavailable, request passed through",
+				m.logger.Warn("all WAF engines unavailable",
 					zap.String("path", r.URL.Path),
 					zap.String("method", r.Method))
-				wafMetrics.requestsTotal.WithLabelValues("failopen").Inc()
-			} else {
-				m.logger.Error("no remaining WAF engines after detect failures, request passed through",
-					zap.String("path", r.URL.Path),
-					zap.String("method", r.Method),
-					zap.Int("tried", len(tried)))
-				wafMetrics.requestsTotal.WithLabelValues("error").Inc()
+				return m.detectFailed(w, r, next, repl, "failopen")
 			}
-			return next.ServeHTTP(w, r)
+			m.logger.Error("no remaining WAF engines after detect failures",
+				zap.String("path", r.URL.Path),
+				zap.String("method", r.Method),
+				zap.Int("tried", len(tried)))
+			return m.detectFailed(w, r, next, repl, failureAction(lastErr))
 		}
 
 		start := time.Now()
-		result, err := engine.DetectHttpRequest(newDetectionRequest())
-		wafMetrics.detectDuration.WithLabelValues(engine.addr).Observe(time.Since(start).Seconds())
+		result, err := detect(engine, newDetectionRequest(), timeout)
+		elapsed := time.Since(start)
+		if err != nil && r.Context().Err() != nil {
+			err = fmt.Errorf("%w: %w", errClientGone, err)
+		}
+		engine.recordResult(err)
+		wafMetrics.detectDuration.WithLabelValues(engine.addr).Observe(elapsed.Seconds())
+		if err == nil || errors.Is(err, errDetectTimeout) {
+			engine.observeLatency(elapsed)
+		}
+		setPlaceholder(repl, placeholderEngine, engine.addr)
+		setPlaceholder(repl, placeholderDetectDuration, elapsed)
+		setPlaceholder(repl, placeholderDetectDurationMs, elapsed.Seconds()*1e3)
 
 		if err == nil {
-			if result.Blocked() {
-				wafMetrics.requestsTotal.WithLabelValues("blocked").Inc()
-				return m.redirectIntercept(w, result)
+			if cacheable {
+				m.VerdictCache.put(cacheKey, result)
 			}
-			wafMetrics.requestsTotal.WithLabelValues("passed").Inc()
-			return next.ServeHTTP(w, r)
+			return m.serveVerdict(w, r, next, repl, mode, banKey, engine, result)
 		}
+		lastErr = err
 
 		recordConnectionError(engine.addr, m.instanceID, classifyConnectionError(err))
 
@@ -312,8 +963,7 @@ func (m *CaddyWAF) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyh
 				zap.String("path", r.URL.Path),
 				zap.String("method", r.Method),
 				zap.Error(err))
-			wafMetrics.requestsTotal.WithLabelValues("error").Inc()
-			return next.ServeHTTP(w, r)
+			return m.clientFailed(w, r, next, repl, err)
 		}
 
 		m.logger.Error("DetectHttpRequest engine error",
@@ -323,42 +973,160 @@ func (m *CaddyWAF) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyh
 			zap.String("method", r.Method),
 			zap.Int("attempt", attempt+1),
 			zap.Int("max_attempts", maxAttempts),
+			zap.Duration("timeout", timeout),
 			zap.Error(err))
 		m.countFailure(engine)
 		tried[engine] = struct{}{}
 
 		// More attempts allowed and at least one untried engine may remain.
-		if attempt+1 < maxAttempts && len(excludeEngines(m.Engines, tried)) > 0 {
+		if attempt+1 < maxAttempts && slices.ContainsFunc(engineTiers(engines), func(tier EnginePool) bool {
+			return len(excludeEngines(tier, tried)) > 0
+		}) {
 			m.logger.Warn("retrying detect on another WAF engine",
 				zap.String("failed_engine", engine.addr),
 				zap.Int("attempt", attempt+1))
 			continue
 		}
 
-		wafMetrics.requestsTotal.WithLabelValues("error").Inc()
-		return next.ServeHTTP(w, r)
+		return m.detectFailed(w, r, next, repl, failureAction(err))
 	}
 
-	wafMetrics.requestsTotal.WithLabelValues("error").Inc()
+	return m.detectFailed(w, r, next, repl, failureAction(lastErr))
+}
+
+// serveVerdict blocks or passes on a request by the engine's verdict.
+// engine is nil for verdicts from the verdict cache.
+func (m *CaddyWAF) serveVerdict(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, repl *caddy.Replacer, mode, banKey string, engine *Engine, result *detection.Result) error {
+	setPlaceholder(repl, placeholderEventID, result.EventID())
+	if result.Blocked() {
+		if mode == modeMonitor {
+			source := "cache"
+			if engine != nil {
+				source = engine.addr
+			}
+			m.logger.Warn("request would be blocked, passed through in monitor mode",
+				zap.String("event_id", result.EventID()),
+				zap.String("engine", source),
+				zap.String("request", r.Host),
+				zap.String("path", r.URL.Path),
+				zap.String("method", r.Method))
+			recordAction(repl, "monitored")
+			return next.ServeHTTP(w, r)
+		}
+		if banKey != "" {
+			m.bans.recordBlock(banKey)
+		}
+		recordAction(repl, "blocked")
+		return m.redirectIntercept(w, r, result)
+	}
+	recordAction(repl, "passed")
 	return next.ServeHTTP(w, r)
 }
 
+// selectEngine selects an engine from pool with the selection policy,
+// skipping engines that do not admit the detection. An engine in slow start
+// accepts a selection with the probability of its slow start factor, so its
+// share ramps up under every policy; when no other engine is left, it is
+// used anyway. A selectionCommitter policy only advances its state for the
+// engine selected, over the engines that were not skipped.
+func (m *CaddyWAF) selectEngine(pool EnginePool, r *http.Request, w http.ResponseWriter) *Engine {
+	policy := m.LoadBalancing.SelectionPolicy
+	committer, _ := policy.(selectionCommitter)
+	selected := func(pool EnginePool, engine *Engine) *Engine {
+		if committer != nil {
+			committer.commit(pool, engine)
+		}
+		return engine
+	}
+	var ramping *Engine
+	for {
+		var engine *Engine
+		if committer != nil {
+			engine = committer.peek(pool)
+		} else {
+			engine = policy.Select(pool, r, w)
+		}
+		if engine == nil {
+			if ramping != nil && ramping.allow() {
+				return selected(append(slices.Clip(pool), ramping), ramping)
+			}
+			return nil
+		}
+		if f := engine.slowStartFactor(time.Now()); f < 1 && weakrand.Float64() >= f { //nolint:gosec
+			if ramping == nil {
+				ramping = engine
+			}
+		} else if engine.allow() {
+			return selected(pool, engine)
+		}
+		pool = excludeEngines(pool, map[*Engine]struct{}{engine: {}})
+	}
+}
+
+// detectFailed handles a request that could not be inspected. It is counted
+// under action and passed on, unless fail_mode is closed.
+func (m *CaddyWAF) detectFailed(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, repl *caddy.Replacer, action string) error {
+	if m.FailMode != failModeClosed {
+		recordAction(repl, action)
+		return next.ServeHTTP(w, r)
+	}
+	m.logger.Warn("request rejected, WAF detection unavailable in fail_mode closed",
+		zap.String("request", r.Host),
+		zap.String("path", r.URL.Path),
+		zap.String("method", r.Method),
+		zap.String("reason", action))
+	recordAction(repl, "failclosed")
+	return m.failIntercept(w, r)
+}
+
+// statusClientClosedRequest is the non-standard status of requests whose
+// client went away, as used by nginx and Caddy's reverse_proxy.
+const statusClientClosedRequest = 499
+
+// clientFailed handles a request that could not be inspected because of the
+// client: its body could not be read or it went away. It is counted as the
+// error action and passed on, unless fail_mode is closed; it is then counted
+// as failclosed and rejected as a bad request rather than as unavailable
+// detection.
+func (m *CaddyWAF) clientFailed(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, repl *caddy.Replacer, err error) error {
+	if m.FailMode != failModeClosed {
+		recordAction(repl, "error")
+		return next.ServeHTTP(w, r)
+	}
+	recordAction(repl, "failclosed")
+	if r.Context().Err() != nil {
+		return caddyhttp.Error(statusClientClosedRequest, err)
+	}
+	return caddyhttp.Error(http.StatusBadRequest, err)
+}
+
+// failureAction is the action label for a request whose last detect attempt
+// failed with err.
+func failureAction(err error) string {
+	if errors.Is(err, errDetectTimeout) {
+		return "timeout"
+	}
+	return "error"
+}
+
 // Cleans up the WAF plugin instance by closing the WAF engine and logging the cleanup process.
 func (m *CaddyWAF) Cleanup() error {
-	for _, engine := range m.Engines {
-		if engine != nil {
-			engine.pool.Release()
-			wafMetrics.enginesHealthy.DeleteLabelValues(engine.addr, m.instanceID)
-			wafMetrics.poolIdleConns.DeleteLabelValues(engine.addr, m.instanceID)
-			wafMetrics.poolActiveConns.DeleteLabelValues(engine.addr, m.instanceID)
-			wafMetrics.poolMaxConns.DeleteLabelValues(engine.addr, m.instanceID)
-			wafMetrics.poolWaitingReqs.DeleteLabelValues(engine.addr, m.instanceID)
-		}
+	unregisterHandler(m)
+	if m.bans != nil {
+		m.bans.close()
+	}
+	// Shared engine groups are released by the waf_chaitin app.
+	if m.group != nil && m.Group == "" {
+		m.group.Destruct()
 	}
 	m.logger.Info("Cleaning up WAF plugin instance")
 	return nil
 }
 
+// errClientGone wraps the detect errors of requests whose client went away
+// during detection; they are not the engine's fault.
+var errClientGone = errors.New("client disconnected")
+
 var clientErrorPatterns = []string{
 	// Body() client read errors (unexpected EOF / H2 CANCEL / H3 QUIC / connection reset, etc.).
 	// Engine-side TCP resets lack this prefix, so they count as engine errors and enter passive health checks.
@@ -374,6 +1142,9 @@ var clientErrorPatterns = []string{
 }
 
 func isEngineError(err error) bool {
+	if errors.Is(err, errClientGone) || errors.Is(err, context.Canceled) {
+		return false
+	}
 	msg := err.Error()
 	for _, pattern := range clientErrorPatterns {
 		if strings.Contains(msg, pattern) {
@@ -385,15 +1156,13 @@ func isEngineError(err error) bool {
 
 func (m *CaddyWAF) countFailure(engine *Engine) {
 	failDuration := time.Duration(m.HealthFailDuration)
+	if m.group != nil {
+		failDuration = time.Duration(m.group.cfg.HealthFailDuration)
+	}
 	if failDuration == 0 {
 		return
 	}
-	engine.countFail(1)
-	go func() {
-		timer := time.NewTimer(failDuration)
-		<-timer.C
-		engine.countFail(-1)
-	}()
+	engine.failures.add(time.Now(), failDuration)
 }
 
 // Interface guards
@@ -2,11 +2,16 @@ package caddy_waf_t1k
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -14,6 +19,7 @@ import (
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chaitin/t1k-go"
 	"github.com/chaitin/t1k-go/detection"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
@@ -46,6 +52,8 @@ func TestIsEngineError(t *testing.T) {
 		{"client body unexpected EOF is client error", errors.New("read request body: unexpected EOF"), false},
 		{"client body stream cancel is client error", errors.New("read request body: stream error: stream ID 1; CANCEL"), false},
 		{"engine-side unexpected EOF stays engine error", errors.New("unexpected EOF"), true},
+		{"wrapped context canceled is client error", fmt.Errorf("detect: %w", context.Canceled), false},
+		{"engine error after the client went away is client error", fmt.Errorf("%w: %w", errClientGone, errors.New("write: broken pipe")), false},
 	}
 
 	for _, tt := range tests {
@@ -61,7 +69,7 @@ func TestIsEngineError(t *testing.T) {
 func TestEngineAvailable(t *testing.T) {
 	t.Run("always available when maxFails is 0", func(t *testing.T) {
 		e := &Engine{maxFails: 0}
-		atomic.StoreInt64(&e.fails, 100)
+		addFailures(e, 100)
 		if !e.Available() {
 			t.Error("expected Available() = true when maxFails is 0")
 		}
@@ -69,7 +77,7 @@ func TestEngineAvailable(t *testing.T) {
 
 	t.Run("available when fails below threshold", func(t *testing.T) {
 		e := &Engine{maxFails: 3}
-		atomic.StoreInt64(&e.fails, 2)
+		addFailures(e, 2)
 		if !e.Available() {
 			t.Error("expected Available() = true when fails < maxFails")
 		}
@@ -77,7 +85,7 @@ func TestEngineAvailable(t *testing.T) {
 
 	t.Run("unavailable when fails at threshold", func(t *testing.T) {
 		e := &Engine{maxFails: 3}
-		atomic.StoreInt64(&e.fails, 3)
+		addFailures(e, 3)
 		if e.Available() {
 			t.Error("expected Available() = false when fails >= maxFails")
 		}
@@ -85,36 +93,43 @@ func TestEngineAvailable(t *testing.T) {
 
 	t.Run("unavailable when fails above threshold", func(t *testing.T) {
 		e := &Engine{maxFails: 3}
-		atomic.StoreInt64(&e.fails, 5)
+		addFailures(e, 5)
 		if e.Available() {
 			t.Error("expected Available() = false when fails > maxFails")
 		}
 	})
 }
 
-func TestEngineCountFail(t *testing.T) {
+// addFailures counts n unexpired failures of e.
+func addFailures(e *Engine, n int) {
+	for range n {
+		e.failures.add(time.Now(), time.Minute)
+	}
+}
+
+func TestEngineFails(t *testing.T) {
 	e := &Engine{}
 
-	e.countFail(1)
+	addFailures(e, 1)
 	if got := e.Fails(); got != 1 {
-		t.Errorf("after countFail(1): Fails() = %d, want 1", got)
+		t.Errorf("after one failure: Fails() = %d, want 1", got)
 	}
 
-	e.countFail(1)
+	addFailures(e, 1)
 	if got := e.Fails(); got != 2 {
-		t.Errorf("after second countFail(1): Fails() = %d, want 2", got)
+		t.Errorf("after two failures: Fails() = %d, want 2", got)
 	}
 
-	e.countFail(-1)
-	if got := e.Fails(); got != 1 {
-		t.Errorf("after countFail(-1): Fails() = %d, want 1", got)
+	e.resetFailures()
+	if got := e.Fails(); got != 0 {
+		t.Errorf("after resetFailures: Fails() = %d, want 0", got)
 	}
 }
 
 func TestSelectRandomHostSkipsUnhealthy(t *testing.T) {
 	healthy := &Engine{addr: "healthy", maxFails: 1}
 	unhealthy := &Engine{addr: "unhealthy", maxFails: 1}
-	atomic.StoreInt64(&unhealthy.fails, 1)
+	addFailures(unhealthy, 1)
 
 	pool := []*Engine{unhealthy, healthy}
 
@@ -132,8 +147,8 @@ func TestSelectRandomHostSkipsUnhealthy(t *testing.T) {
 func TestSelectRandomHostReturnsNilWhenAllUnhealthy(t *testing.T) {
 	e1 := &Engine{addr: "e1", maxFails: 1}
 	e2 := &Engine{addr: "e2", maxFails: 1}
-	atomic.StoreInt64(&e1.fails, 1)
-	atomic.StoreInt64(&e2.fails, 1)
+	addFailures(e1, 1)
+	addFailures(e2, 1)
 
 	got := selectRandomHost([]*Engine{e1, e2})
 	if got != nil {
@@ -144,7 +159,7 @@ func TestSelectRandomHostReturnsNilWhenAllUnhealthy(t *testing.T) {
 func TestRoundRobinSkipsUnhealthy(t *testing.T) {
 	healthy := &Engine{addr: "healthy", maxFails: 1}
 	unhealthy := &Engine{addr: "unhealthy", maxFails: 1}
-	atomic.StoreInt64(&unhealthy.fails, 1)
+	addFailures(unhealthy, 1)
 
 	rr := &RoundRobinSelection{}
 	pool := EnginePool{unhealthy, healthy}
@@ -163,8 +178,8 @@ func TestRoundRobinSkipsUnhealthy(t *testing.T) {
 func TestRoundRobinReturnsNilWhenAllUnhealthy(t *testing.T) {
 	e1 := &Engine{addr: "e1", maxFails: 1}
 	e2 := &Engine{addr: "e2", maxFails: 1}
-	atomic.StoreInt64(&e1.fails, 1)
-	atomic.StoreInt64(&e2.fails, 1)
+	addFailures(e1, 1)
+	addFailures(e2, 1)
 
 	rr := &RoundRobinSelection{}
 	got := rr.Select(EnginePool{e1, e2}, nil, nil)
@@ -202,7 +217,7 @@ func TestSelectRandomHostEmptyPool(t *testing.T) {
 }
 
 func TestCountFailureDisabledWhenZeroDuration(t *testing.T) {
-	m := &CaddyWAF{HealthFailDuration: 0}
+	m := &CaddyWAF{EngineGroup: EngineGroup{HealthFailDuration: 0}}
 	e := &Engine{maxFails: 1}
 
 	m.countFailure(e)
@@ -213,7 +228,7 @@ func TestCountFailureDisabledWhenZeroDuration(t *testing.T) {
 }
 
 func TestCountFailureIncrementsAndDecrements(t *testing.T) {
-	m := &CaddyWAF{HealthFailDuration: caddy.Duration(100 * time.Millisecond)}
+	m := &CaddyWAF{EngineGroup: EngineGroup{HealthFailDuration: caddy.Duration(100 * time.Millisecond)}}
 	e := &Engine{maxFails: 3}
 
 	m.countFailure(e)
@@ -235,7 +250,7 @@ func TestCountFailureIncrementsAndDecrements(t *testing.T) {
 }
 
 func TestCountFailureEngineBecomesAvailableAfterExpiry(t *testing.T) {
-	m := &CaddyWAF{HealthFailDuration: caddy.Duration(100 * time.Millisecond)}
+	m := &CaddyWAF{EngineGroup: EngineGroup{HealthFailDuration: caddy.Duration(100 * time.Millisecond)}}
 	e := &Engine{maxFails: 1}
 
 	m.countFailure(e)
@@ -258,6 +273,575 @@ func TestRoundRobinEmptyPool(t *testing.T) {
 	}
 }
 
+// loadedEngine returns an engine whose pool reports the given active
+// connections and waiting requests.
+func loadedEngine(addr string, active, waiting int) *Engine {
+	return &Engine{addr: addr, statsFn: func() t1k.PoolStats {
+		return t1k.PoolStats{ActiveConns: active, WaitingReqs: waiting}
+	}}
+}
+
+func TestLeastConnPicksLeastLoaded(t *testing.T) {
+	busy := loadedEngine("192.0.2.1:8000", 4, 0)
+	queued := loadedEngine("192.0.2.2:8000", 1, 5)
+	idle := loadedEngine("192.0.2.3:8000", 2, 0)
+
+	lc := LeastConnSelection{}
+	for range 10 {
+		if got := lc.Select(EnginePool{busy, queued, idle}, nil, nil); got != idle {
+			t.Fatalf("expected %s, got %v", idle.addr, got)
+		}
+	}
+}
+
+func TestLeastConnSkipsUnhealthy(t *testing.T) {
+	unhealthy := loadedEngine("192.0.2.1:8000", 0, 0)
+	unhealthy.maxFails = 1
+	addFailures(unhealthy, 1)
+	healthy := loadedEngine("192.0.2.2:8000", 8, 0)
+
+	lc := LeastConnSelection{}
+	if got := lc.Select(EnginePool{unhealthy, healthy}, nil, nil); got != healthy {
+		t.Fatalf("expected %s, got %v", healthy.addr, got)
+	}
+	healthy.maxFails = 1
+	addFailures(healthy, 1)
+	if got := lc.Select(EnginePool{unhealthy, healthy}, nil, nil); got != nil {
+		t.Fatalf("expected nil when all unhealthy, got %v", got)
+	}
+	if got := lc.Select(EnginePool{}, nil, nil); got != nil {
+		t.Fatal("expected nil for empty pool")
+	}
+}
+
+func TestLeastConnBreaksTiesRandomly(t *testing.T) {
+	e1 := loadedEngine("192.0.2.1:8000", 1, 0)
+	e2 := loadedEngine("192.0.2.2:8000", 0, 1)
+	e3 := loadedEngine("192.0.2.3:8000", 3, 0)
+
+	lc := LeastConnSelection{}
+	counts := map[*Engine]int{}
+	for range 200 {
+		counts[lc.Select(EnginePool{e1, e2, e3}, nil, nil)]++
+	}
+	if counts[e1] == 0 || counts[e2] == 0 {
+		t.Errorf("tied engines should both be selected, got e1=%d e2=%d", counts[e1], counts[e2])
+	}
+	if counts[e3] != 0 {
+		t.Errorf("busier engine selected %d times", counts[e3])
+	}
+}
+
+func TestEngineObserveLatency(t *testing.T) {
+	e := &Engine{}
+	if got := e.latency(); got != 0 {
+		t.Fatalf("latency before samples = %v, want 0", got)
+	}
+	e.observeLatency(100 * time.Millisecond)
+	if got := e.latency(); got > 100*time.Millisecond || got < 99*time.Millisecond {
+		t.Fatalf("latency after first sample = %v, want 100ms", got)
+	}
+	e.observeLatency(200 * time.Millisecond)
+	want := time.Duration((latencyEWMAWeight*0.2 + (1-latencyEWMAWeight)*0.1) * float64(time.Second))
+	if got := e.latency(); got < want-time.Millisecond || got > want {
+		t.Fatalf("latency after second sample = %v, want %v", got, want)
+	}
+}
+
+func TestEngineLatencyDecaysWhileIdle(t *testing.T) {
+	e := &Engine{}
+	e.observeLatency(100 * time.Millisecond)
+	e.latencyAt.Store(time.Now().Add(-latencyDecay).UnixNano())
+	want := time.Duration(math.Round(float64(100*time.Millisecond) / math.E))
+	if got := e.latency(); got < want-time.Millisecond || got > want+time.Millisecond {
+		t.Fatalf("latency after one decay period = %v, want %v", got, want)
+	}
+}
+
+func TestP2CEWMAPrefersFasterEngine(t *testing.T) {
+	fast := &Engine{addr: "192.0.2.1:8000"}
+	fast.observeLatency(5 * time.Millisecond)
+	slow := &Engine{addr: "192.0.2.2:8000"}
+	slow.observeLatency(50 * time.Millisecond)
+
+	p := P2CEWMASelection{}
+	for range 20 {
+		if got := p.Select(EnginePool{slow, fast}, nil, nil); got != fast {
+			t.Fatalf("expected %s, got %v", fast.addr, got)
+		}
+	}
+}
+
+func TestP2CEWMANeverPicksSlowestOfThree(t *testing.T) {
+	e1 := &Engine{addr: "192.0.2.1:8000"}
+	e1.observeLatency(5 * time.Millisecond)
+	e2 := &Engine{addr: "192.0.2.2:8000"}
+	e2.observeLatency(10 * time.Millisecond)
+	e3 := &Engine{addr: "192.0.2.3:8000"}
+	e3.observeLatency(50 * time.Millisecond)
+
+	p := P2CEWMASelection{}
+	counts := map[*Engine]int{}
+	for range 300 {
+		counts[p.Select(EnginePool{e1, e2, e3}, nil, nil)]++
+	}
+	if counts[e3] != 0 {
+		t.Errorf("slowest engine selected %d times", counts[e3])
+	}
+	if counts[e1] <= counts[e2] {
+		t.Errorf("fastest engine selected %d times, second %d", counts[e1], counts[e2])
+	}
+}
+
+func TestP2CEWMASkipsUnhealthy(t *testing.T) {
+	unhealthy := &Engine{addr: "192.0.2.1:8000", maxFails: 1}
+	addFailures(unhealthy, 1)
+	healthy := &Engine{addr: "192.0.2.2:8000"}
+	healthy.observeLatency(time.Second)
+
+	p := P2CEWMASelection{}
+	if got := p.Select(EnginePool{unhealthy, healthy}, nil, nil); got != healthy {
+		t.Fatalf("expected %s, got %v", healthy.addr, got)
+	}
+	if got := p.Select(EnginePool{unhealthy}, nil, nil); got != nil {
+		t.Fatalf("expected nil when all unhealthy, got %v", got)
+	}
+}
+
+func TestServeHTTPRecordsEngineLatency(t *testing.T) {
+	ensureWAFMetrics(t)
+	e := &Engine{addr: "192.0.2.1:8000", detectFn: func(*http.Request) (*detection.Result, error) {
+		time.Sleep(10 * time.Millisecond)
+		return &detection.Result{Head: '.'}, nil
+	}}
+	m := newTestWAF(EnginePool{e}, 0)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	_ = m.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if got := e.latency(); got < 10*time.Millisecond {
+		t.Fatalf("latency = %v, want >= 10ms", got)
+	}
+}
+
+func TestEngineWeightDefaultsToOne(t *testing.T) {
+	if got := (&Engine{}).Weight(); got != 1 {
+		t.Errorf("Weight() = %d, want 1", got)
+	}
+	if got := (&Engine{weight: 3}).Weight(); got != 3 {
+		t.Errorf("Weight() = %d, want 3", got)
+	}
+}
+
+func TestWeightedRandomDistribution(t *testing.T) {
+	heavy := &Engine{addr: "192.0.2.1:8000", weight: 3}
+	light := &Engine{addr: "192.0.2.2:8000"}
+	down := &Engine{addr: "192.0.2.3:8000", weight: 10, maxFails: 1}
+	addFailures(down, 1)
+
+	wr := WeightedRandomSelection{}
+	counts := map[*Engine]int{}
+	const n = 4000
+	for range n {
+		counts[wr.Select(EnginePool{heavy, light, down}, nil, nil)]++
+	}
+	if counts[down] != 0 {
+		t.Errorf("unavailable engine selected %d times", counts[down])
+	}
+	// expect 3:1, allow generous slack
+	if ratio := float64(counts[heavy]) / float64(counts[light]); ratio < 2.4 || ratio > 3.8 {
+		t.Errorf("heavy:light = %d:%d, want about 3:1", counts[heavy], counts[light])
+	}
+	if got := wr.Select(EnginePool{down}, nil, nil); got != nil {
+		t.Errorf("expected nil when all unhealthy, got %v", got)
+	}
+}
+
+func TestWeightedRoundRobinSequence(t *testing.T) {
+	a := &Engine{addr: "192.0.2.1:8000", weight: 3}
+	b := &Engine{addr: "192.0.2.2:8000"}
+	pool := EnginePool{a, b}
+
+	wrr := &WeightedRoundRobinSelection{}
+	want := []*Engine{a, a, b, a, a, a, b, a}
+	for i, w := range want {
+		if got := wrr.Select(pool, nil, nil); got != w {
+			t.Fatalf("selection %d: got %s, want %s", i, got.addr, w.addr)
+		}
+	}
+}
+
+func TestWeightedRoundRobinSkipsUnhealthyAndForgetsRemoved(t *testing.T) {
+	a := &Engine{addr: "192.0.2.1:8000", weight: 2}
+	b := &Engine{addr: "192.0.2.2:8000", maxFails: 1}
+	addFailures(b, 1)
+
+	wrr := &WeightedRoundRobinSelection{}
+	for range 4 {
+		if got := wrr.Select(EnginePool{a, b}, nil, nil); got != a {
+			t.Fatalf("expected %s, got %v", a.addr, got)
+		}
+	}
+	c := &Engine{addr: "192.0.2.3:8000"}
+	a.removed.Store(true)
+	wrr.Select(EnginePool{c}, nil, nil)
+	if _, ok := wrr.current[a]; ok {
+		t.Error("state of removed engine was kept")
+	}
+	if got := wrr.Select(EnginePool{b}, nil, nil); got != nil {
+		t.Errorf("expected nil when all unhealthy, got %v", got)
+	}
+}
+
+func TestWeightedRoundRobinKeepsWeightsWhileEngineExcluded(t *testing.T) {
+	a := &Engine{addr: "192.0.2.1:8000", weight: 3}
+	b := &Engine{addr: "192.0.2.2:8000"}
+	c := &Engine{addr: "192.0.2.3:8000"}
+
+	wrr := &WeightedRoundRobinSelection{}
+	wrr.Select(EnginePool{a, b, c}, nil, nil)
+	excludedState := wrr.current[c]
+	// c is excluded from selection, e.g. while its circuit admits no trial.
+	counts := make(map[*Engine]int)
+	for range 400 {
+		counts[wrr.Select(EnginePool{a, b}, nil, nil)]++
+	}
+	if counts[a] != 300 || counts[b] != 100 {
+		t.Errorf("a:b = %d:%d, want 300:100", counts[a], counts[b])
+	}
+	if got, ok := wrr.current[c]; !ok || got != excludedState {
+		t.Errorf("state of excluded engine = %d (kept %v), want %d", got, ok, excludedState)
+	}
+}
+
+func TestSelectEngineWeightedRoundRobinKeepsRatioWhileSkipping(t *testing.T) {
+	a := &Engine{addr: "192.0.2.1:8000", weight: 3}
+	c := &Engine{addr: "192.0.2.2:8000"}
+	down := &Engine{addr: "192.0.2.3:8000", weight: 5}
+	down.admin.Store(adminDown)
+	// ramping has just started its slow start, so selectEngine skips it
+	// every time the policy selects it.
+	ramping := &Engine{addr: "192.0.2.4:8000", weight: 4, slowStart: time.Hour}
+	ramping.recoveredAt.Store(time.Now().Add(time.Hour).UnixNano())
+
+	m := newTestWAF(EnginePool{a, c, down, ramping}, 0)
+	m.LoadBalancing.SelectionPolicy = &WeightedRoundRobinSelection{}
+	counts := make(map[*Engine]int)
+	for range 400 {
+		counts[m.selectEngine(EnginePool{a, c, down, ramping}, nil, nil)]++
+	}
+	if counts[a] != 300 || counts[c] != 100 {
+		t.Errorf("a:c = %d:%d (others %d), want 300:100", counts[a], counts[c], 400-counts[a]-counts[c])
+	}
+}
+
+func TestFirstSelection(t *testing.T) {
+	a := &Engine{addr: "192.0.2.1:8000", maxFails: 1}
+	b := &Engine{addr: "192.0.2.2:8000"}
+	c := &Engine{addr: "192.0.2.3:8000"}
+	pool := EnginePool{a, b, c}
+	if got := (FirstSelection{}).Select(pool, nil, nil); got != a {
+		t.Fatalf("expected %s, got %v", a.addr, got)
+	}
+	addFailures(a, 1)
+	if got := (FirstSelection{}).Select(pool, nil, nil); got != b {
+		t.Fatalf("expected %s, got %v", b.addr, got)
+	}
+	if got := (FirstSelection{}).Select(EnginePool{a}, nil, nil); got != nil {
+		t.Errorf("expected nil when all unhealthy, got %v", got)
+	}
+}
+
+func TestEngineTiers(t *testing.T) {
+	p1 := &Engine{addr: "192.0.2.1:8000", maxFails: 1}
+	p2 := &Engine{addr: "192.0.2.2:8000", maxFails: 1}
+	b1 := &Engine{addr: "127.0.0.1:8000", backup: true}
+	pool := EnginePool{p1, b1, p2}
+
+	if got := engineTiers(EnginePool{p1, p2}); len(got) != 1 || !slices.Equal(got[0], EnginePool{p1, p2}) {
+		t.Errorf("without backups: got %v", got)
+	}
+	if got := engineTiers(pool); len(got) != 2 || !slices.Equal(got[0], EnginePool{p1, p2}) || !slices.Equal(got[1], EnginePool{b1}) {
+		t.Errorf("primaries available: got %v", got)
+	}
+	addFailures(p1, 1)
+	if got := engineTiers(pool); len(got) != 2 || !slices.Equal(got[0], EnginePool{p1, p2}) {
+		t.Errorf("one primary available: got %v", got)
+	}
+	p2.healthDown.Store(true)
+	if got := engineTiers(pool); len(got) != 1 || !slices.Equal(got[0], EnginePool{b1}) {
+		t.Errorf("primaries down: got %v", got)
+	}
+}
+
+func TestServeHTTPUsesBackupOnlyWhenPrimariesDown(t *testing.T) {
+	ensureWAFMetrics(t)
+	var backupCalls atomic.Int32
+	primary := &Engine{addr: "192.0.2.1:8000", maxFails: 1, detectFn: func(*http.Request) (*detection.Result, error) {
+		return nil, errors.New("connection refused")
+	}}
+	backup := &Engine{addr: "127.0.0.1:8000", backup: true, detectFn: func(*http.Request) (*detection.Result, error) {
+		backupCalls.Add(1)
+		return &detection.Result{Head: '.'}, nil
+	}}
+	m := newTestWAF(EnginePool{backup, primary}, 1)
+	m.HealthFailDuration = caddy.Duration(time.Minute)
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+
+	// The primary is tried first although the backup comes first in the
+	// pool; its failure marks it down, so the retry goes to the backup.
+	if err := m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), next); err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if primary.Fails() != 1 || backupCalls.Load() != 1 {
+		t.Fatalf("primary fails = %d, backup calls = %d, want 1 and 1", primary.Fails(), backupCalls.Load())
+	}
+
+	primary.failures.reset()
+	primary.detectFn = func(*http.Request) (*detection.Result, error) { return &detection.Result{Head: '.'}, nil }
+	for range 3 {
+		_ = m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), next)
+	}
+	if got := backupCalls.Load(); got != 1 {
+		t.Errorf("backup calls = %d after primary recovered, want 1", got)
+	}
+}
+
+func TestServeHTTPSkipsEngineWithoutTrialSlot(t *testing.T) {
+	ensureWAFMetrics(t)
+	b, clock, _ := newTestBreaker(CircuitBreaker{ConsecutiveFailures: 1, OpenDuration: caddy.Duration(time.Second)})
+	var trialCalls int
+	trial := &Engine{addr: "192.0.2.1:8000", breaker: b, detectFn: func(*http.Request) (*detection.Result, error) {
+		trialCalls++
+		return &detection.Result{Head: '.'}, nil
+	}}
+	other := &Engine{addr: "192.0.2.2:8000", detectFn: func(*http.Request) (*detection.Result, error) {
+		return &detection.Result{Head: '.'}, nil
+	}}
+	b.record(true)
+	clock.advance(time.Second)
+	// Another request holds the only trial slot.
+	if !trial.allow() {
+		t.Fatal("half-open circuit rejected a trial")
+	}
+
+	m := newTestWAF(EnginePool{trial, other}, 0)
+	m.LoadBalancing.SelectionPolicy = FirstSelection{}
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	_ = m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), next)
+	if trialCalls != 0 {
+		t.Fatalf("half-open engine got %d detections beyond its trial slot", trialCalls)
+	}
+
+	b.record(false)
+	_ = m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), next)
+	if trialCalls != 1 {
+		t.Fatalf("closed engine got %d detections, want 1", trialCalls)
+	}
+}
+
+func TestServeHTTPFallsThroughToBackupWithoutTrialSlot(t *testing.T) {
+	ensureWAFMetrics(t)
+	b, clock, _ := newTestBreaker(CircuitBreaker{ConsecutiveFailures: 1, OpenDuration: caddy.Duration(time.Second)})
+	var primaryCalls, backupCalls atomic.Int32
+	primary := &Engine{addr: "192.0.2.1:8000", breaker: b, detectFn: func(*http.Request) (*detection.Result, error) {
+		primaryCalls.Add(1)
+		return &detection.Result{Head: '.'}, nil
+	}}
+	backup := &Engine{addr: "127.0.0.1:8000", backup: true, detectFn: func(*http.Request) (*detection.Result, error) {
+		backupCalls.Add(1)
+		return &detection.Result{Head: '.'}, nil
+	}}
+	b.record(true)
+	clock.advance(time.Second)
+	// Another request holds the primary's only trial slot.
+	if !primary.allow() {
+		t.Fatal("half-open circuit rejected a trial")
+	}
+
+	m := newTestWAF(EnginePool{primary, backup}, 0)
+	m.FailMode = failModeClosed
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	rec := httptest.NewRecorder()
+	if err := m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil), next); err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if primaryCalls.Load() != 0 || backupCalls.Load() != 1 {
+		t.Fatalf("primary calls = %d, backup calls = %d, want 0 and 1", primaryCalls.Load(), backupCalls.Load())
+	}
+}
+func TestSlowStartTracksRecovery(t *testing.T) {
+	e := &Engine{addr: "192.0.2.1:8000", slowStart: 10 * time.Second}
+	now := time.Now()
+	if !e.Available() || e.slowStartFactor(now) != 1 {
+		t.Fatal("new engine should start at its full share")
+	}
+	e.healthDown.Store(true)
+	if e.Available() {
+		t.Fatal("engine available while down")
+	}
+	e.healthDown.Store(false)
+	if !e.Available() {
+		t.Fatal("engine unavailable after recovering")
+	}
+	if f := e.slowStartFactor(time.Now()); f > 0.1 {
+		t.Errorf("factor right after recovery = %v, want about 0", f)
+	}
+	e.recoveredAt.Store(now.Add(-5 * time.Second).UnixNano())
+	if f := e.slowStartFactor(now); math.Abs(f-0.5) > 1e-9 {
+		t.Errorf("factor halfway = %v, want 0.5", f)
+	}
+	if f := e.slowStartFactor(now.Add(5 * time.Second)); f != 1 {
+		t.Errorf("factor after slow_start = %v, want 1", f)
+	}
+
+	// The ramp starts when a half-open circuit closes, not when it admits
+	// trials.
+	b := newCircuitBreaker(CircuitBreaker{ConsecutiveFailures: 1, OpenDuration: caddy.Duration(time.Nanosecond)}, nil)
+	e = &Engine{slowStart: 10 * time.Second, breaker: b}
+	b.record(true)
+	time.Sleep(time.Millisecond)
+	if !e.Available() || e.slowStartFactor(time.Now()) != 1 {
+		t.Fatal("half-open engine should admit its trial without ramping")
+	}
+	b.allow()
+	b.record(false)
+	e.Available()
+	if f := e.slowStartFactor(time.Now()); f > 0.1 {
+		t.Errorf("factor after circuit closed = %v, want about 0", f)
+	}
+}
+
+func TestSelectEngineSlowStart(t *testing.T) {
+	ramping := &Engine{addr: "192.0.2.1:8000", slowStart: time.Hour}
+	ramping.down.Store(true)
+	ramping.Available()
+	other := &Engine{addr: "192.0.2.2:8000"}
+	m := newTestWAF(nil, 0)
+
+	for range 100 {
+		if got := m.selectEngine(EnginePool{ramping, other}, nil, nil); got != other {
+			t.Fatalf("selected %v, want %s while %s just recovered", got, other.addr, ramping.addr)
+		}
+	}
+	if got := m.selectEngine(EnginePool{ramping}, nil, nil); got != ramping {
+		t.Fatalf("selected %v, want the ramping engine when it is the only one", got)
+	}
+
+	// Halfway through, the random policy gives it half of its full share.
+	ramping.recoveredAt.Store(time.Now().Add(-30 * time.Minute).UnixNano())
+	m.LoadBalancing.SelectionPolicy = RandomSelection{}
+	n := 0
+	for range 4000 {
+		if m.selectEngine(EnginePool{ramping, other}, nil, nil) == ramping {
+			n++
+		}
+	}
+	if share := float64(n) / 4000; share < 0.2 || share > 0.3 {
+		t.Errorf("ramping engine share = %v, want about 0.25", share)
+	}
+}
+
+func hashPool(n int) EnginePool {
+	pool := make(EnginePool, n)
+	for i := range pool {
+		pool[i] = &Engine{addr: fmt.Sprintf("192.0.2.%d:8000", i+1)}
+	}
+	return pool
+}
+
+func TestHashEngineIsStableAndMinimallyDisruptive(t *testing.T) {
+	pool := hashPool(5)
+	keys := make([]string, 1000)
+	owner := make(map[string]*Engine, len(keys))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("198.51.100.%d-%d", i%256, i)
+		owner[keys[i]] = hashEngine(pool, keys[i])
+		if again := hashEngine(pool, keys[i]); again != owner[keys[i]] {
+			t.Fatalf("key %s mapped to %s, then %s", keys[i], owner[keys[i]].addr, again.addr)
+		}
+	}
+
+	// Removing an engine only moves the keys it owned.
+	removed := pool[2]
+	smaller := slices.Delete(slices.Clone(pool), 2, 3)
+	for _, key := range keys {
+		got := hashEngine(smaller, key)
+		if owner[key] != removed && got != owner[key] {
+			t.Fatalf("key %s moved from %s to %s after removing %s", key, owner[key].addr, got.addr, removed.addr)
+		}
+	}
+
+	// An unavailable engine's keys move; the others stay.
+	removed.maxFails = 1
+	addFailures(removed, 1)
+	for _, key := range keys {
+		got := hashEngine(pool, key)
+		if got == removed || (owner[key] != removed && got != owner[key]) {
+			t.Fatalf("key %s mapped to %s with %s down", key, got.addr, removed.addr)
+		}
+	}
+}
+
+func TestHashEngineHonorsWeights(t *testing.T) {
+	pool := hashPool(2)
+	pool[0].weight = 3
+	counts := map[*Engine]int{}
+	for i := range 4000 {
+		counts[hashEngine(pool, strconv.Itoa(i))]++
+	}
+	if ratio := float64(counts[pool[0]]) / float64(counts[pool[1]]); ratio < 2.4 || ratio > 3.8 {
+		t.Errorf("weighted:unweighted = %d:%d, want about 3:1", counts[pool[0]], counts[pool[1]])
+	}
+	if hashEngine(EnginePool{}, "x") != nil {
+		t.Error("expected nil for empty pool")
+	}
+}
+
+func TestHashPolicies(t *testing.T) {
+	pool := hashPool(8)
+	newReq := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/a?b=c", nil)
+		req.RemoteAddr = "198.51.100.7:4321"
+		req.Header.Set("X-User", "alice")
+		req.AddCookie(&http.Cookie{Name: "sid", Value: "s3cr3t"})
+		return req
+	}
+
+	tests := []struct {
+		name   string
+		policy Selector
+		want   *Engine
+	}{
+		{"ip_hash", IPHashSelection{}, hashEngine(pool, "198.51.100.7")},
+		{"uri_hash", URIHashSelection{}, hashEngine(pool, "/a?b=c")},
+		{"header", HeaderHashSelection{Field: "X-User"}, hashEngine(pool, "alice")},
+		{"header host", HeaderHashSelection{Field: "Host"}, hashEngine(pool, "example.com")},
+		{"cookie", CookieHashSelection{Name: "sid"}, hashEngine(pool, "s3cr3t")},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Select(pool, newReq(), nil); got != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.name, got, tt.want.addr)
+		}
+	}
+
+	// The client IP determined through trusted proxies takes precedence.
+	req := newReq()
+	ctx := context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{caddyhttp.ClientIPVarKey: "203.0.113.9"})
+	if got, want := (IPHashSelection{}).Select(pool, req.WithContext(ctx), nil), hashEngine(pool, "203.0.113.9"); got != want {
+		t.Errorf("ip_hash with client IP: got %v, want %s", got, want.addr)
+	}
+
+	// Missing keys use the fallback policy.
+	first := &RoundRobinSelection{robin: ^uint32(0)}
+	if got := (HeaderHashSelection{Field: "X-Missing", fallback: first}).Select(pool, newReq(), nil); got != pool[0] {
+		t.Errorf("header fallback: got %v, want %s", got, pool[0].addr)
+	}
+	if got := (CookieHashSelection{Name: "missing", fallback: first}).Select(pool, newReq(), nil); got != pool[1] {
+		t.Errorf("cookie fallback: got %v, want %s", got, pool[1].addr)
+	}
+}
+
 func TestValidateRejectsNegativeRetries(t *testing.T) {
 	m := &CaddyWAF{LoadBalancing: &LoadBalancing{Retries: -1}}
 	if err := m.Validate(); err == nil {
@@ -321,7 +905,6 @@ func newTestWAF(engines EnginePool, retries int) *CaddyWAF {
 			SelectionPolicy: &RoundRobinSelection{robin: ^uint32(0)},
 			Retries:         retries,
 		},
-		HealthFailDuration: 0,
 	}
 }
 
@@ -465,6 +1048,856 @@ func TestServeHTTPRetrySkipsTriedEngine(t *testing.T) {
 	}
 }
 
+func TestServeHTTPBlockModeIntercepts(t *testing.T) {
+	ensureWAFMetrics(t)
+	engine := &Engine{addr: "192.0.2.1:8000", maxFails: 0, detectFn: func(*http.Request) (*detection.Result, error) {
+		return &detection.Result{Head: '?'}, nil
+	}}
+	m := newTestWAF(EnginePool{engine}, 0)
+	m.Mode = modeBlock
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	rr := httptest.NewRecorder()
+	before := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("blocked"))
+	nextCalled := false
+	if err := m.ServeHTTP(rr, req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		nextCalled = true
+		return nil
+	})); err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if nextCalled {
+		t.Fatal("blocked request reached next handler")
+	}
+	if got := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("blocked")); got != before+1 {
+		t.Errorf("blocked request count = %v, want %v", got, before+1)
+	}
+}
+
+func TestServeHTTPMonitorModePassesBlocked(t *testing.T) {
+	ensureWAFMetrics(t)
+	engine := &Engine{addr: "192.0.2.1:8000", maxFails: 0, detectFn: func(*http.Request) (*detection.Result, error) {
+		return &detection.Result{Head: '?'}, nil
+	}}
+	m := newTestWAF(EnginePool{engine}, 0)
+	m.Mode = modeMonitor
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	rr := httptest.NewRecorder()
+	beforeBlocked := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("blocked"))
+	beforeMonitored := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("monitored"))
+	nextCalled := false
+	if err := m.ServeHTTP(rr, req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		nextCalled = true
+		return nil
+	})); err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if !nextCalled {
+		t.Fatal("expected monitor mode to call next")
+	}
+	if rr.Header().Get("X-Event-ID") != "" {
+		t.Error("monitor mode wrote block response headers")
+	}
+	if got := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("monitored")); got != beforeMonitored+1 {
+		t.Errorf("monitored request count = %v, want %v", got, beforeMonitored+1)
+	}
+	if got := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("blocked")); got != beforeBlocked {
+		t.Errorf("blocked request count = %v, want %v", got, beforeBlocked)
+	}
+}
+
+func TestValidateBanThresholdLimit(t *testing.T) {
+	for _, tt := range []struct {
+		threshold int
+		valid     bool
+	}{{0, true}, {maxBanThreshold, true}, {maxBanThreshold + 1, false}, {10000, false}} {
+		m := &CaddyWAF{BanThreshold: tt.threshold}
+		if err := m.Validate(); (err == nil) != tt.valid {
+			t.Errorf("ban_threshold %d: Validate() = %v, want valid %v", tt.threshold, err, tt.valid)
+		}
+	}
+}
+
+func TestValidateBanSyncRequiresName(t *testing.T) {
+	m := &CaddyWAF{BanThreshold: 5, BanSyncInterval: caddy.Duration(10 * time.Second)}
+	if err := m.Validate(); err == nil {
+		t.Fatal("expected error for ban_sync_interval without name")
+	}
+	m.Name = "shop"
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+}
+
+func TestValidateMode(t *testing.T) {
+	for _, mode := range []string{"", modeBlock, modeMonitor, modeBypass} {
+		m := &CaddyWAF{Mode: mode}
+		if err := m.Validate(); err != nil {
+			t.Errorf("mode %q: unexpected error: %v", mode, err)
+		}
+	}
+	m := &CaddyWAF{Mode: "observe"}
+	if err := m.Validate(); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
+
+func TestServeHTTPModeOverride(t *testing.T) {
+	ensureWAFMetrics(t)
+	t.Cleanup(func() { modeOverrides.Store(nil) })
+	var calls atomic.Int32
+	e := &Engine{addr: "192.0.2.1:8000", detectFn: func(*http.Request) (*detection.Result, error) {
+		calls.Add(1)
+		return &detection.Result{Head: '?'}, nil
+	}}
+	m := newTestWAF(EnginePool{e}, 0)
+	m.Mode = modeBlock
+	m.BlockResponse = new(BlockResponse)
+	if err := m.BlockResponse.provision(); err != nil {
+		t.Fatal(err)
+	}
+	var nextCalled bool
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		nextCalled = true
+		return nil
+	})
+	beforeBypassed := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("bypassed"))
+
+	setModeOverride("", modeBypass)
+	req, repl := newReplacerRequest(http.MethodGet, "/", nil)
+	if err := m.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatalf("ServeHTTP: %v", err)
+	}
+	if !nextCalled || calls.Load() != 0 {
+		t.Fatalf("bypass: next called = %v, detections = %d; want next without detection", nextCalled, calls.Load())
+	}
+	if got, _ := repl.GetString(placeholderAction); got != "bypassed" {
+		t.Errorf("action = %q, want bypassed", got)
+	}
+	if got := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("bypassed")); got != beforeBypassed+1 {
+		t.Errorf("bypassed request count = %v, want %v", got, beforeBypassed+1)
+	}
+
+	// A name override takes precedence over the one of all handlers.
+	m.Name = "mode-serve"
+	setModeOverride(m.Name, modeMonitor)
+	nextCalled = false
+	req, _ = newReplacerRequest(http.MethodGet, "/", nil)
+	_ = m.ServeHTTP(httptest.NewRecorder(), req, next)
+	if !nextCalled || calls.Load() != 1 {
+		t.Fatalf("monitor: next called = %v, detections = %d; want both", nextCalled, calls.Load())
+	}
+
+	setModeOverride("", modeConfig)
+	nextCalled = false
+	rec := httptest.NewRecorder()
+	req, _ = newReplacerRequest(http.MethodGet, "/", nil)
+	_ = m.ServeHTTP(rec, req, next)
+	if nextCalled || rec.Code != http.StatusForbidden {
+		t.Errorf("config: next called = %v, status %d; want the request blocked", nextCalled, rec.Code)
+	}
+}
+
+type errMatcher struct{}
+
+func (errMatcher) MatchWithError(*http.Request) (bool, error) {
+	return false, errors.New("matcher failed")
+}
+
+func TestServeHTTPSkip(t *testing.T) {
+	ensureWAFMetrics(t)
+	var calls atomic.Int32
+	e := &Engine{addr: "192.0.2.1:8000", detectFn: func(*http.Request) (*detection.Result, error) {
+		calls.Add(1)
+		return &detection.Result{Head: '.'}, nil
+	}}
+	m := newTestWAF(EnginePool{e}, 0)
+	m.skip = caddyhttp.MatcherSets{
+		{caddyhttp.MatchPath{"/static/*"}},
+		{caddyhttp.MatchMethod{"OPTIONS"}, caddyhttp.MatchPath{"/api"}},
+		{errMatcher{}},
+	}
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	beforeSkipped := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("skipped"))
+
+	for _, tt := range []struct {
+		method, target string
+		skipped        bool
+	}{
+		{http.MethodGet, "/static/app.js", true},
+		{http.MethodOptions, "/api", true},
+		{http.MethodGet, "/api", false},
+		{http.MethodGet, "/", false},
+	} {
+		calls.Store(0)
+		req, repl := newReplacerRequest(tt.method, tt.target, nil)
+		if err := m.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+			t.Fatalf("%s %s: ServeHTTP: %v", tt.method, tt.target, err)
+		}
+		if skipped := calls.Load() == 0; skipped != tt.skipped {
+			t.Errorf("%s %s: skipped = %v, want %v", tt.method, tt.target, skipped, tt.skipped)
+		}
+		if action, _ := repl.GetString(placeholderAction); (action == "skipped") != tt.skipped {
+			t.Errorf("%s %s: action = %q", tt.method, tt.target, action)
+		}
+	}
+	if got := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("skipped")); got != beforeSkipped+2 {
+		t.Errorf("skipped request count = %v, want %v", got, beforeSkipped+2)
+	}
+}
+
+func TestServeHTTPIPLists(t *testing.T) {
+	ensureWAFMetrics(t)
+	var calls atomic.Int32
+	e := &Engine{addr: "192.0.2.1:8000", detectFn: func(*http.Request) (*detection.Result, error) {
+		calls.Add(1)
+		return &detection.Result{Head: '.'}, nil
+	}}
+	m := newTestWAF(EnginePool{e}, 0)
+	m.Mode = modeBlock
+	m.BlockResponse = new(BlockResponse)
+	if err := m.BlockResponse.provision(); err != nil {
+		t.Fatal(err)
+	}
+	m.AllowIPs = &IPList{Ranges: []string{"10.0.0.0/8"}}
+	m.DenyIPs = &IPList{Ranges: []string{"203.0.113.0/24", "10.6.6.6"}}
+	for _, l := range []*IPList{m.AllowIPs, m.DenyIPs} {
+		if err := l.provision(context.Background(), zap.NewNop(), "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+
+	for _, tt := range []struct {
+		mode, remote, clientIP string
+		action                 string
+		status                 int
+	}{
+		{modeBlock, "203.0.113.9:1234", "", "denied", http.StatusForbidden},
+		{modeMonitor, "203.0.113.9:1234", "", "monitored", http.StatusNoContent},
+		{modeBlock, "10.1.2.3:1234", "", "allowed", http.StatusNoContent},
+		{modeBlock, "10.6.6.6:1234", "", "denied", http.StatusForbidden},
+		{modeBlock, "192.0.2.50:1234", "", "passed", http.StatusNoContent},
+		// The client IP resolved through trusted proxies is used instead
+		// of the proxy's address.
+		{modeBlock, "10.1.2.3:1234", "203.0.113.9", "denied", http.StatusForbidden},
+	} {
+		m.Mode = tt.mode
+		calls.Store(0)
+		req, repl := newReplacerRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.clientIP != "" {
+			req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{caddyhttp.ClientIPVarKey: tt.clientIP}))
+		}
+		before := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues(tt.action))
+		rec := httptest.NewRecorder()
+		if err := m.ServeHTTP(rec, req, next); err != nil {
+			t.Fatalf("%s from %s: ServeHTTP: %v", tt.mode, tt.remote, err)
+		}
+		if rec.Code != tt.status {
+			t.Errorf("%s from %s: status = %d, want %d", tt.mode, tt.remote, rec.Code, tt.status)
+		}
+		if action, _ := repl.GetString(placeholderAction); action != tt.action {
+			t.Errorf("%s from %s: action = %q, want %q", tt.mode, tt.remote, action, tt.action)
+		}
+		if got := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues(tt.action)); got != before+1 {
+			t.Errorf("%s from %s: %s count = %v, want %v", tt.mode, tt.remote, tt.action, got, before+1)
+		}
+		if detected := calls.Load() > 0; detected != (tt.action == "passed") {
+			t.Errorf("%s from %s: detected = %v", tt.mode, tt.remote, detected)
+		}
+	}
+}
+
+func TestServeHTTPBans(t *testing.T) {
+	ensureWAFMetrics(t)
+	var calls atomic.Int32
+	e := &Engine{addr: "192.0.2.1:8000", detectFn: func(*http.Request) (*detection.Result, error) {
+		calls.Add(1)
+		return &detection.Result{Head: '?'}, nil
+	}}
+	m := newTestWAF(EnginePool{e}, 0)
+	m.Mode = modeBlock
+	m.BlockResponse = new(BlockResponse)
+	if err := m.BlockResponse.provision(); err != nil {
+		t.Fatal(err)
+	}
+	m.BanKey = "{http.request.header.X-Api-Key}"
+	m.bans = newBanTracker(2, time.Minute, time.Minute, "ban-serve", zap.NewNop())
+	t.Cleanup(m.bans.close)
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	serve := func(apiKey string) (*httptest.ResponseRecorder, string) {
+		t.Helper()
+		req, repl := newReplacerRequest(http.MethodGet, "/", nil)
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		repl.Set("http.request.header.X-Api-Key", apiKey)
+		rec := httptest.NewRecorder()
+		if err := m.ServeHTTP(rec, req, next); err != nil {
+			t.Fatalf("ServeHTTP: %v", err)
+		}
+		action, _ := repl.GetString(placeholderAction)
+		return rec, action
+	}
+	beforeBanned := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("banned"))
+
+	for range 2 {
+		if _, action := serve("scanner"); action != "blocked" {
+			t.Fatalf("action = %q, want blocked", action)
+		}
+	}
+	calls.Store(0)
+	rec, action := serve("scanner")
+	if action != "banned" || rec.Code != http.StatusForbidden || calls.Load() != 0 {
+		t.Fatalf("banned client: action %q, status %d, %d detections; want banned, 403 without detection", action, rec.Code, calls.Load())
+	}
+	if rec.Header().Get("X-Event-ID") != "" {
+		t.Errorf("X-Event-ID = %q for a request blocked without detection", rec.Header().Get("X-Event-ID"))
+	}
+	if got := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("banned")); got != beforeBanned+1 {
+		t.Errorf("banned request count = %v, want %v", got, beforeBanned+1)
+	}
+
+	// Requests with an empty key are not tracked.
+	for range 3 {
+		if _, action := serve(""); action != "blocked" {
+			t.Fatalf("action = %q for an empty key, want blocked", action)
+		}
+	}
+	if _, action := serve("other"); action != "blocked" {
+		t.Errorf("action = %q for another key, want blocked", action)
+	}
+}
+
+func TestServeHTTPVerdictCache(t *testing.T) {
+	ensureWAFMetrics(t)
+	var calls atomic.Int32
+	var fail atomic.Bool
+	e := &Engine{addr: "192.0.2.1:8000", detectFn: func(r *http.Request) (*detection.Result, error) {
+		calls.Add(1)
+		if fail.Load() {
+			return nil, errors.New("read request body: unexpected EOF")
+		}
+		if strings.Contains(r.URL.RawQuery, "attack") {
+			return &detection.Result{Head: '?'}, nil
+		}
+		return &detection.Result{Head: '.'}, nil
+	}}
+	m := newTestWAF(EnginePool{e}, 0)
+	m.Mode = modeBlock
+	m.BlockResponse = new(BlockResponse)
+	if err := m.BlockResponse.provision(); err != nil {
+		t.Fatal(err)
+	}
+	m.VerdictCache = &VerdictCache{Methods: []string{http.MethodGet, http.MethodPost}}
+	m.VerdictCache.provision()
+	var nextBody string
+	next := caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+		b, err := io.ReadAll(r.Body)
+		nextBody = string(b)
+		return err
+	})
+	serve := func(method, target, body string) string {
+		t.Helper()
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		req, repl := newReplacerRequest(method, target, reader)
+		if err := m.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+			t.Fatalf("%s %s: ServeHTTP: %v", method, target, err)
+		}
+		action, _ := repl.GetString(placeholderAction)
+		return action
+	}
+	hits := func() float64 { return testutil.ToFloat64(wafMetrics.verdictCacheLookups.WithLabelValues("hit")) }
+	misses := func() float64 { return testutil.ToFloat64(wafMetrics.verdictCacheLookups.WithLabelValues("miss")) }
+	beforeHits, beforeMisses := hits(), misses()
+
+	for _, tt := range []struct {
+		method, target, body string
+		action               string
+		detections           int32
+	}{
+		{http.MethodGet, "/poll", "", "passed", 1},
+		{http.MethodGet, "/poll", "", "passed", 1},
+		{http.MethodGet, "/?q=attack", "", "blocked", 2},
+		{http.MethodGet, "/?q=attack", "", "blocked", 2},
+		{http.MethodPost, "/graphql", "{a}", "passed", 3},
+		{http.MethodPost, "/graphql", "{a}", "passed", 3},
+		{http.MethodPost, "/graphql", "{b}", "passed", 4},
+		{http.MethodPut, "/poll", "", "passed", 5},
+		{http.MethodPut, "/poll", "", "passed", 6},
+	} {
+		if action := serve(tt.method, tt.target, tt.body); action != tt.action {
+			t.Errorf("%s %s %q: action = %q, want %q", tt.method, tt.target, tt.body, action, tt.action)
+		}
+		if got := calls.Load(); got != tt.detections {
+			t.Errorf("%s %s %q: %d detections, want %d", tt.method, tt.target, tt.body, got, tt.detections)
+		}
+	}
+	if nextBody != "" {
+		t.Errorf("next handler read body %q for a body-less request", nextBody)
+	}
+	serve(http.MethodPost, "/graphql", "{a}")
+	if nextBody != "{a}" {
+		t.Errorf("next handler read body %q after a cache hit, want {a}", nextBody)
+	}
+	if got := hits() - beforeHits; got != 4 {
+		t.Errorf("cache hits = %v, want 4", got)
+	}
+	if got := misses() - beforeMisses; got != 4 {
+		t.Errorf("cache misses = %v, want 4", got)
+	}
+
+	// Failed detections are not cached.
+	fail.Store(true)
+	serve(http.MethodGet, "/new", "")
+	fail.Store(false)
+	calls.Store(0)
+	if serve(http.MethodGet, "/new", ""); calls.Load() != 1 {
+		t.Error("failed detection was cached")
+	}
+}
+
+func newReplacerRequest(method, target string, body io.Reader) (*http.Request, *caddy.Replacer) {
+	req := httptest.NewRequest(method, target, body)
+	repl := caddy.NewReplacer()
+	return req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)), repl
+}
+
+func TestServeHTTPSetsPlaceholders(t *testing.T) {
+	ensureWAFMetrics(t)
+	for _, tt := range []struct {
+		name       string
+		result     *detection.Result
+		err        error
+		wantAction string
+		wantEvent  string
+		wantEngine bool
+	}{
+		{name: "passed", result: &detection.Result{Head: '.'}, wantAction: "passed", wantEngine: true},
+		{name: "blocked", result: &detection.Result{Head: '?', ExtraBody: []byte("<!-- event_id: abc123 -->")}, wantAction: "blocked", wantEvent: "abc123", wantEngine: true},
+		{name: "engine error", err: errors.New("connection refused"), wantAction: "error", wantEngine: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &Engine{addr: "192.0.2.1:8000", maxFails: 0, detectFn: func(*http.Request) (*detection.Result, error) {
+				return tt.result, tt.err
+			}}
+			m := newTestWAF(EnginePool{engine}, 0)
+			req, repl := newReplacerRequest(http.MethodGet, "http://example.com/", nil)
+			_ = m.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+
+			if got, _ := repl.GetString(placeholderAction); got != tt.wantAction {
+				t.Errorf("%s = %q, want %q", placeholderAction, got, tt.wantAction)
+			}
+			if got, _ := repl.GetString(placeholderEventID); got != tt.wantEvent {
+				t.Errorf("%s = %q, want %q", placeholderEventID, got, tt.wantEvent)
+			}
+			if got, _ := repl.GetString(placeholderEngine); got != engine.addr {
+				t.Errorf("%s = %q, want %q", placeholderEngine, got, engine.addr)
+			}
+			if _, ok := repl.Get(placeholderDetectDuration); !ok {
+				t.Errorf("%s not set", placeholderDetectDuration)
+			}
+			if got, _ := repl.Get(placeholderBodyTruncated); got != false {
+				t.Errorf("%s = %v, want false", placeholderBodyTruncated, got)
+			}
+		})
+	}
+}
+
+func TestServeHTTPPlaceholdersFailOpenAndTruncation(t *testing.T) {
+	ensureWAFMetrics(t)
+	down := &Engine{addr: "192.0.2.1:8000", maxFails: 1}
+	addFailures(down, 1)
+	m := newTestWAF(EnginePool{down}, 0)
+	m.MaxBodySize = 2
+
+	req, repl := newReplacerRequest(http.MethodPost, "http://example.com/", strings.NewReader("abcdef"))
+	_ = m.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if got, _ := repl.GetString(placeholderAction); got != "failopen" {
+		t.Errorf("%s = %q, want failopen", placeholderAction, got)
+	}
+	if got, _ := repl.Get(placeholderBodyTruncated); got != true {
+		t.Errorf("%s = %v, want true", placeholderBodyTruncated, got)
+	}
+	if _, ok := repl.Get(placeholderEngine); ok {
+		t.Errorf("%s set although no engine was selected", placeholderEngine)
+	}
+}
+
+func slowEngine(addr string, delay time.Duration, calls *atomic.Int32) *Engine {
+	return &Engine{addr: addr, maxFails: 0, detectFn: func(*http.Request) (*detection.Result, error) {
+		calls.Add(1)
+		time.Sleep(delay)
+		return &detection.Result{Head: '.'}, nil
+	}}
+}
+
+func TestServeHTTPDetectTimeoutRetriesAndCountsFailure(t *testing.T) {
+	ensureWAFMetrics(t)
+	var slowCalls, fastCalls atomic.Int32
+	slow := slowEngine("192.0.2.1:8000", 500*time.Millisecond, &slowCalls)
+	slow.maxFails = 5
+	fast := slowEngine("192.0.2.2:8000", 0, &fastCalls)
+
+	m := newTestWAF(EnginePool{slow, fast}, 1)
+	m.DetectTimeout = caddy.Duration(20 * time.Millisecond)
+	m.HealthFailDuration = caddy.Duration(time.Minute)
+
+	req, repl := newReplacerRequest(http.MethodGet, "http://example.com/", nil)
+	start := time.Now()
+	_ = m.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("ServeHTTP took %v, detect timeout not enforced", elapsed)
+	}
+	if slowCalls.Load() != 1 || fastCalls.Load() != 1 {
+		t.Fatalf("calls = slow %d, fast %d, want 1 each", slowCalls.Load(), fastCalls.Load())
+	}
+	if got := slow.Fails(); got != 1 {
+		t.Errorf("timed-out engine Fails() = %d, want 1", got)
+	}
+	if got, _ := repl.GetString(placeholderAction); got != "passed" {
+		t.Errorf("action = %q, want passed", got)
+	}
+}
+
+func TestServeHTTPDetectTimeoutFailsOpenWithTimeoutAction(t *testing.T) {
+	ensureWAFMetrics(t)
+	var calls atomic.Int32
+	m := newTestWAF(EnginePool{slowEngine("192.0.2.1:8000", 500*time.Millisecond, &calls)}, 0)
+	m.DetectTimeout = caddy.Duration(20 * time.Millisecond)
+
+	before := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("timeout"))
+	nextCalled := false
+	_ = m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil), caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		nextCalled = true
+		return nil
+	}))
+	if !nextCalled {
+		t.Fatal("expected fail-open after timeout")
+	}
+	if got := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("timeout")); got != before+1 {
+		t.Errorf("timeout request count = %v, want %v", got, before+1)
+	}
+}
+
+func TestServeHTTPDetectBudgetSharedByRetries(t *testing.T) {
+	ensureWAFMetrics(t)
+	var calls atomic.Int32
+	e1 := slowEngine("192.0.2.1:8000", 500*time.Millisecond, &calls)
+	e2 := slowEngine("192.0.2.2:8000", 500*time.Millisecond, &calls)
+	e3 := slowEngine("192.0.2.3:8000", 500*time.Millisecond, &calls)
+	m := newTestWAF(EnginePool{e1, e2, e3}, 2)
+	m.DetectTimeout = caddy.Duration(30 * time.Millisecond)
+	m.DetectBudget = caddy.Duration(50 * time.Millisecond)
+
+	req, repl := newReplacerRequest(http.MethodGet, "http://example.com/", nil)
+	start := time.Now()
+	_ = m.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("ServeHTTP took %v, detect budget not enforced", elapsed)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("Detect calls = %d, want 2 within the budget", got)
+	}
+	if got, _ := repl.GetString(placeholderAction); got != "timeout" {
+		t.Errorf("action = %q, want timeout", got)
+	}
+}
+
+func TestServeHTTPDetectTimeoutDetachesBody(t *testing.T) {
+	ensureWAFMetrics(t)
+	body := "payload"
+	var detectedRequest *http.Request
+	var detected []byte
+	engine := &Engine{addr: "192.0.2.1:8000", maxFails: 0, detectFn: func(r *http.Request) (*detection.Result, error) {
+		detectedRequest = r
+		detected = readAndRestoreBody(t, r)
+		return &detection.Result{Head: '.'}, nil
+	}}
+	m := newTestWAF(EnginePool{engine}, 0)
+	m.DetectTimeout = caddy.Duration(time.Second)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader(body))
+	var downstream []byte
+	_ = m.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+		downstream = readAndRestoreBody(t, r)
+		return nil
+	}))
+	if detectedRequest == req {
+		t.Error("detection shared the original request body despite detect_timeout")
+	}
+	if string(detected) != body || string(downstream) != body {
+		t.Errorf("detected = %q, downstream = %q, want %q for both", detected, downstream, body)
+	}
+}
+
+// TestServeHTTPDetectTimeoutDetachesHeaders is meant to run with -race: the
+// timed-out detection keeps reading the request while the next handler
+// modifies it.
+func TestServeHTTPDetectTimeoutDetachesHeaders(t *testing.T) {
+	ensureWAFMetrics(t)
+	for _, body := range []string{"", "payload"} {
+		done := make(chan struct{})
+		engine := &Engine{addr: "192.0.2.1:8000", maxFails: 0, detectFn: func(r *http.Request) (*detection.Result, error) {
+			defer close(done)
+			deadline := time.Now().Add(100 * time.Millisecond)
+			for time.Now().Before(deadline) {
+				for field := range r.Header {
+					_ = r.Header.Get(field)
+				}
+				_ = r.URL.String()
+			}
+			return &detection.Result{Head: '.'}, nil
+		}}
+		m := newTestWAF(EnginePool{engine}, 0)
+		m.DetectTimeout = caddy.Duration(10 * time.Millisecond)
+
+		req, repl := newReplacerRequest(http.MethodPost, "http://example.com/upload", strings.NewReader(body))
+		req.Header.Set("X-Forwarded-For", "192.0.2.10")
+		_ = m.ServeHTTP(httptest.NewRecorder(), req, caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+			for i := range 1000 {
+				r.Header.Set("X-Upstream-"+strconv.Itoa(i%10), "value")
+				r.Header.Del("X-Forwarded-For")
+				r.URL.Path = "/rewritten"
+			}
+			return nil
+		}))
+		<-done
+		if got, _ := repl.GetString(placeholderAction); got != "timeout" {
+			t.Errorf("body %q: action = %q, want timeout", body, got)
+		}
+	}
+}
+
+func TestDetectBoundsAbandonedAttempts(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	e := &Engine{addr: "192.0.2.1:8000", maxAbandoned: 2, detectFn: func(*http.Request) (*detection.Result, error) {
+		calls.Add(1)
+		<-release
+		return &detection.Result{Head: '.'}, nil
+	}}
+	for range 4 {
+		if _, err := detect(e, httptest.NewRequest(http.MethodGet, "/", nil), 10*time.Millisecond); !errors.Is(err, errDetectTimeout) {
+			t.Fatalf("detect error = %v, want errDetectTimeout", err)
+		}
+	}
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("engine got %d detections while stalled, want 2", got)
+	}
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for e.abandoned.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d abandoned attempts still counted after they finished", e.abandoned.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := detect(e, httptest.NewRequest(http.MethodGet, "/", nil), time.Second); err != nil {
+		t.Fatalf("detect after the stall: %v", err)
+	}
+}
+
+func TestValidateRejectsNegativeDetectTimeout(t *testing.T) {
+	for _, m := range []*CaddyWAF{
+		{DetectTimeout: caddy.Duration(-time.Second)},
+		{DetectBudget: caddy.Duration(-time.Second)},
+	} {
+		if err := m.Validate(); err == nil {
+			t.Error("expected error for negative detect deadline")
+		}
+	}
+}
+
+func TestServeHTTPFailClosed(t *testing.T) {
+	ensureWAFMetrics(t)
+	down := &Engine{addr: "192.0.2.1:8000", maxFails: 1}
+	addFailures(down, 1)
+	refused := &Engine{addr: "192.0.2.2:8000", maxFails: 0, detectFn: func(*http.Request) (*detection.Result, error) {
+		return nil, errors.New("connection refused")
+	}}
+	var slowCalls atomic.Int32
+
+	for _, tt := range []struct {
+		name    string
+		engines EnginePool
+		timeout time.Duration
+	}{
+		{name: "no engine available", engines: EnginePool{down}},
+		{name: "engine error", engines: EnginePool{refused}},
+		{name: "detect timeout", engines: EnginePool{slowEngine("192.0.2.3:8000", 500*time.Millisecond, &slowCalls)}, timeout: 20 * time.Millisecond},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestWAF(tt.engines, 0)
+			m.FailMode = failModeClosed
+			m.DetectTimeout = caddy.Duration(tt.timeout)
+
+			req, repl := newReplacerRequest(http.MethodGet, "http://example.com/pay", nil)
+			rr := httptest.NewRecorder()
+			before := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("failclosed"))
+			nextCalled := false
+			if err := m.ServeHTTP(rr, req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				nextCalled = true
+				return nil
+			})); err != nil {
+				t.Fatalf("ServeHTTP: %v", err)
+			}
+			if nextCalled {
+				t.Fatal("fail_mode closed passed the request on")
+			}
+			if rr.Code != defaultFailStatus {
+				t.Errorf("status = %d, want %d", rr.Code, defaultFailStatus)
+			}
+			if got, _ := repl.GetString(placeholderAction); got != "failclosed" {
+				t.Errorf("action = %q, want failclosed", got)
+			}
+			if got := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("failclosed")); got != before+1 {
+				t.Errorf("failclosed request count = %v, want %v", got, before+1)
+			}
+		})
+	}
+}
+
+func TestServeHTTPFailClosedClientErrors(t *testing.T) {
+	ensureWAFMetrics(t)
+	newEngine := func(detectFn func(*http.Request) (*detection.Result, error)) *Engine {
+		return &Engine{
+			addr:     "192.0.2.1:8000",
+			maxFails: 1,
+			breaker:  newCircuitBreaker(CircuitBreaker{ConsecutiveFailures: 1}, nil),
+			detectFn: detectFn,
+		}
+	}
+
+	unreadable, _ := newReplacerRequest(http.MethodPost, "http://example.com/pay", nil)
+	unreadable.Body = &partialErrorBody{body: []byte("abc")}
+	unreadable.ContentLength = -1
+
+	gone, _ := newReplacerRequest(http.MethodGet, "http://example.com/pay", nil)
+	ctx, cancel := context.WithCancel(gone.Context())
+	gone = gone.WithContext(ctx)
+
+	for _, tt := range []struct {
+		name       string
+		req        *http.Request
+		engine     *Engine
+		wantStatus int
+	}{
+		{
+			name: "body read error",
+			req:  unreadable,
+			engine: newEngine(func(*http.Request) (*detection.Result, error) {
+				return &detection.Result{Head: '.'}, nil
+			}),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "client went away",
+			req:  gone,
+			engine: newEngine(func(*http.Request) (*detection.Result, error) {
+				cancel()
+				return nil, errors.New("write: broken pipe")
+			}),
+			wantStatus: statusClientClosedRequest,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestWAF(EnginePool{tt.engine}, 0)
+			m.FailMode = failModeClosed
+			m.MaxBodySize = 4
+			m.HealthFailDuration = caddy.Duration(time.Minute)
+
+			before := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("failclosed"))
+			nextCalled := false
+			err := m.ServeHTTP(httptest.NewRecorder(), tt.req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				nextCalled = true
+				return nil
+			}))
+			if nextCalled {
+				t.Fatal("fail_mode closed passed the uninspected request on")
+			}
+			var herr caddyhttp.HandlerError
+			if !errors.As(err, &herr) || herr.StatusCode != tt.wantStatus {
+				t.Fatalf("ServeHTTP error = %v, want a %d handler error", err, tt.wantStatus)
+			}
+			repl := tt.req.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+			if got, _ := repl.GetString(placeholderAction); got != "failclosed" {
+				t.Errorf("action = %q, want failclosed", got)
+			}
+			if got := testutil.ToFloat64(wafMetrics.requestsTotal.WithLabelValues("failclosed")); got != before+1 {
+				t.Errorf("failclosed request count = %v, want %v", got, before+1)
+			}
+			if got := tt.engine.Fails(); got != 0 {
+				t.Errorf("engine Fails() = %d, want 0", got)
+			}
+			if got := tt.engine.breaker.currentState(); got != circuitClosed {
+				t.Errorf("circuit = %s, want closed", got)
+			}
+		})
+	}
+}
+
+func TestServeHTTPRequestsRefreshWithoutEngines(t *testing.T) {
+	ensureWAFMetrics(t)
+	down := &Engine{addr: "192.0.2.1:8000"}
+	down.admin.Store(adminDown)
+	g := newEngineGroup(context.Background(), &EngineGroup{}, "test", zap.NewNop())
+	g.engines = EnginePool{down}
+	g.refreshC = make(chan struct{}, 1)
+	m := newTestWAF(nil, 0)
+	m.group = g
+
+	_ = m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil), caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if len(g.refreshC) != 1 {
+		t.Error("no engine available, but no refresh was requested")
+	}
+}
+
+func TestServeHTTPFailClosedStillPassesCleanRequests(t *testing.T) {
+	ensureWAFMetrics(t)
+	engine := &Engine{addr: "192.0.2.1:8000", maxFails: 0, detectFn: func(*http.Request) (*detection.Result, error) {
+		return &detection.Result{Head: '.'}, nil
+	}}
+	m := newTestWAF(EnginePool{engine}, 0)
+	m.FailMode = failModeClosed
+	nextCalled := false
+	_ = m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil), caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		nextCalled = true
+		return nil
+	}))
+	if !nextCalled {
+		t.Fatal("expected clean request to reach next handler")
+	}
+}
+
+func TestValidateFailMode(t *testing.T) {
+	if err := (&CaddyWAF{FailMode: failModeClosed}).Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := (&CaddyWAF{FailMode: "ajar"}).Validate(); err == nil {
+		t.Fatal("expected error for unknown fail_mode")
+	}
+}
+
 func readAndRestoreBody(t *testing.T, r *http.Request) []byte {
 	t.Helper()
 	body, err := io.ReadAll(r.Body)